@@ -7,22 +7,29 @@ create table notebook.note
   plain_text text         not null,
   words      int          not null default 0,
   private    tinyint      not null default 0,
+  slug       varchar(255)          default null,
   created_at timestamp    not null default current_timestamp,
   update_at  timestamp    not null default current_timestamp on update current_timestamp,
   primary key (id),
-  index update_at (update_at)
+  unique key slug (slug),
+  index update_at (update_at),
+  index created_at (created_at)
 ) ENGINE = InnoDB
   AUTO_INCREMENT = 1
   DEFAULT CHARSET = utf8;
 
 create table notebook.tag
 (
-  id         int          not null auto_increment,
-  name       varchar(255) not null,
-  created_at timestamp    not null default current_timestamp,
-  update_at  timestamp    not null default current_timestamp on update current_timestamp,
+  id          int          not null auto_increment,
+  name        varchar(255) not null,
+  description varchar(255) not null default '',
+  color       varchar(16)  not null default '',
+  slug        varchar(255)          default null,
+  created_at  timestamp    not null default current_timestamp,
+  update_at   timestamp    not null default current_timestamp on update current_timestamp,
   primary key (id),
-  unique key (name)
+  unique key (name),
+  unique key slug (slug)
 ) ENGINE = InnoDB
   AUTO_INCREMENT = 1
   DEFAULT CHARSET = utf8;
@@ -42,3 +49,105 @@ create table notebook.note_tag
   AUTO_INCREMENT = 1
   DEFAULT CHARSET = utf8;
 
+
+create table notebook.note_link
+(
+  id          int          not null auto_increment,
+  src_note_id int          not null,
+  dst_note_id int          not null default 0,
+  target      varchar(255) not null,
+  created_at  timestamp    not null default current_timestamp,
+  update_at   timestamp    not null default current_timestamp on update current_timestamp,
+  primary key (id),
+  unique key src_target (src_note_id, target),
+  index dst_note_id (dst_note_id),
+  index target (target)
+) ENGINE = InnoDB
+  AUTO_INCREMENT = 1
+  DEFAULT CHARSET = utf8;
+
+create table notebook.series
+(
+  id          int          not null auto_increment,
+  title       varchar(255) not null,
+  description text         not null,
+  created_at  timestamp    not null default current_timestamp,
+  update_at   timestamp    not null default current_timestamp on update current_timestamp,
+  primary key (id)
+) ENGINE = InnoDB
+  AUTO_INCREMENT = 1
+  DEFAULT CHARSET = utf8;
+
+create table notebook.series_note
+(
+  id         int       not null auto_increment,
+  series_id  int       not null,
+  note_id    int       not null,
+  position   int       not null,
+  created_at timestamp not null default current_timestamp,
+  update_at  timestamp not null default current_timestamp on update current_timestamp,
+  primary key (id),
+  unique key note_id (note_id),
+  index series_position (series_id, position)
+) ENGINE = InnoDB
+  AUTO_INCREMENT = 1
+  DEFAULT CHARSET = utf8;
+
+create table notebook.note_slug
+(
+  id         int          not null auto_increment,
+  note_id    int          not null,
+  slug       varchar(255) not null,
+  created_at timestamp    not null default current_timestamp,
+  update_at  timestamp    not null default current_timestamp on update current_timestamp,
+  primary key (id),
+  unique key slug (slug),
+  index note_id (note_id)
+) ENGINE = InnoDB
+  AUTO_INCREMENT = 1
+  DEFAULT CHARSET = utf8;
+
+create table notebook.attachment
+(
+  id         int          not null auto_increment,
+  sha256     char(64)     not null,
+  name       varchar(255) not null,
+  mime       varchar(255) not null,
+  size       bigint       not null,
+  width      int          not null default 0,
+  height     int          not null default 0,
+  created_at timestamp    not null default current_timestamp,
+  update_at  timestamp    not null default current_timestamp on update current_timestamp,
+  primary key (id),
+  unique key sha256 (sha256)
+) ENGINE = InnoDB
+  AUTO_INCREMENT = 1
+  DEFAULT CHARSET = utf8;
+
+create table notebook.note_attachment
+(
+  id            int       not null auto_increment,
+  note_id       int       not null,
+  attachment_id int       not null,
+  created_at    timestamp not null default current_timestamp,
+  update_at     timestamp not null default current_timestamp on update current_timestamp,
+  primary key (id),
+  unique key note_attachment_id (note_id, attachment_id),
+  index attachment_id (attachment_id)
+) ENGINE = InnoDB
+  AUTO_INCREMENT = 1
+  DEFAULT CHARSET = utf8;
+
+create table notebook.note_import
+(
+  id         int          not null auto_increment,
+  note_id    int          not null,
+  source     varchar(255) not null,
+  created_at timestamp    not null default current_timestamp,
+  update_at  timestamp    not null default current_timestamp on update current_timestamp,
+  primary key (id),
+  unique key source (source),
+  index note_id (note_id)
+) ENGINE = InnoDB
+  AUTO_INCREMENT = 1
+  DEFAULT CHARSET = utf8;
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-redis/redis"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 func printDelimiter() {
@@ -117,6 +119,112 @@ func initRedis() error {
 	return nil
 }
 
+// runCommand runs the subcommand in args instead of starting the server
+func runCommand(args []string) error {
+	switch args[0] {
+	case "export-static":
+		flagSet := flag.NewFlagSet(args[0], flag.ExitOnError)
+		out := flagSet.String("out", "public", "output directory")
+		full := flagSet.Bool("full", false, "write every note page again")
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+		stats, err := server.ExportStatic(*out, *full)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("exported %d notes to %s: %d written, %d removed, %d listing pages\n",
+			stats.Notes, *out, stats.Written, stats.Removed, stats.Pages)
+		return nil
+	case "export-markdown":
+		flagSet := flag.NewFlagSet(args[0], flag.ExitOnError)
+		out := flagSet.String("out", "notebook.zip", "output zip file")
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		manifest, err := server.ExportMarkdown(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("exported %d notes to %s\n", len(manifest.Notes), *out)
+		return nil
+	case "import-markdown":
+		flagSet := flag.NewFlagSet(args[0], flag.ExitOnError)
+		dryRun := flagSet.Bool("dry-run", false, "only report what would be created")
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flagSet.NArg() != 1 {
+			return fmt.Errorf("usage: %s [-dry-run] <dir>", args[0])
+		}
+		results, err := server.ImportMarkdownDir(flagSet.Arg(0), *dryRun)
+		for _, result := range results {
+			fmt.Println(result)
+		}
+		return err
+	case "import-wxr":
+		flagSet := flag.NewFlagSet(args[0], flag.ExitOnError)
+		dryRun := flagSet.Bool("dry-run", false, "only report what would be created")
+		mapping := flagSet.String("mapping", "wxr-mapping.json", "file to write old urls and new note ids to")
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flagSet.NArg() != 1 {
+			return fmt.Errorf("usage: %s [-dry-run] [-mapping file] <export.xml>", args[0])
+		}
+		results, err := server.ImportWXR(flagSet.Arg(0), *mapping, *dryRun)
+		for _, result := range results {
+			fmt.Println(result)
+		}
+		return err
+	case "backup":
+		flagSet := flag.NewFlagSet(args[0], flag.ExitOnError)
+		out := flagSet.String("out", "notebook-backup-"+time.Now().Format("20060102-150405")+".zip", "output zip file")
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		manifest, err := server.Backup(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		for _, table := range manifest.Tables {
+			fmt.Printf("%s: %d rows\n", table.Name, table.Rows)
+		}
+		fmt.Printf("%d attachments\n", len(manifest.Blobs))
+		fmt.Printf("backup written to %s\n", *out)
+		return nil
+	case "restore":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s <backup.zip>", args[0])
+		}
+		manifest, err := server.Restore(args[1])
+		if err != nil {
+			return err
+		}
+		for _, table := range manifest.Tables {
+			fmt.Printf("%s: %d rows\n", table.Name, table.Rows)
+		}
+		fmt.Printf("restored backup of %s\n", manifest.CreatedAt)
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
 func main() {
 	if err := initConfig(); err != nil {
 		fmt.Printf("init config failed: %s\n", err.Error())
@@ -154,15 +262,52 @@ func main() {
 		}
 	}()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Printf("%s failed: %s\n", os.Args[1], err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	go server.BackfillNoteSlugs()
+	go server.BackfillNotePlainText()
+
 	http.HandleFunc("/api/note/publish", server.NotePublishHandler)
 	http.HandleFunc("/api/notes", server.NotesHandler)
 	http.HandleFunc("/api/note", server.NoteHandler)
+	http.HandleFunc("/api/notes/graph", server.NoteGraphHandler)
 	http.HandleFunc("/api/note/update", server.NoteUpdateHandler)
 	http.HandleFunc("/api/note/delete", server.NoteDeleteHandler)
 	http.HandleFunc("/api/tags", server.TagsHandler)
+	http.HandleFunc("/api/tag/rename", server.TagRenameHandler)
+	http.HandleFunc("/api/tag/merge", server.TagMergeHandler)
+	http.HandleFunc("/api/tag/update", server.TagUpdateHandler)
+	http.HandleFunc("/api/series", server.SeriesHandler)
+	http.HandleFunc("/api/series/list", server.SeriesListHandler)
+	http.HandleFunc("/api/series/create", server.SeriesCreateHandler)
+	http.HandleFunc("/api/series/update", server.SeriesUpdateHandler)
+	http.HandleFunc("/api/series/delete", server.SeriesDeleteHandler)
+	http.HandleFunc("/api/archive", server.ArchiveHandler)
+	http.HandleFunc("/api/archive/month", server.ArchiveMonthHandler)
+	http.HandleFunc("/api/calendar", server.CalendarHandler)
+	http.HandleFunc("/api/on_this_day", server.OnThisDayHandler)
+	http.HandleFunc("/api/export/markdown", server.ExportMarkdownHandler)
+	http.HandleFunc("/api/attachment/upload", server.AttachmentUploadHandler)
+	http.HandleFunc("/api/attachment", server.AttachmentInfoHandler)
 	http.HandleFunc("/api/auth", server.AuthHandler)
 	http.HandleFunc("/api/is_auth", server.IsAuthHandler)
 	http.HandleFunc("/api/logout", server.LogoutHandler)
+	http.Handle("/api/v2/", server.NewV2Router())
+	http.HandleFunc("/feed.xml", server.RSSFeedHandler)
+	http.HandleFunc("/atom.xml", server.AtomFeedHandler)
+	http.HandleFunc("/feed.json", server.JSONFeedHandler)
+	http.HandleFunc("/sitemap.xml", server.SitemapHandler)
+	http.HandleFunc("/robots.txt", server.RobotsHandler)
+	http.HandleFunc("/attachment/", server.AttachmentHandler)
+	if viper.GetBool("page.enabled") {
+		http.Handle("/", server.NewPageRouter())
+	}
 
 	printDelimiter()
 
@@ -2,7 +2,12 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func notesAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
@@ -19,7 +24,19 @@ func notesAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, er
 		token = tokenCookie.Value
 	}
 
-	notesInsPtr, page, err := getNotes(reqIns.PageNo, reqIns.Tag, token)
+	filterIns := notesFilterObj{
+		Tags: append(reqIns.Tags, reqIns.Tag), TagMode: reqIns.TagMode, From: reqIns.From, To: reqIns.To,
+		Visibility: reqIns.Visibility, Author: reqIns.Author, Sort: reqIns.Sort, Order: reqIns.Order,
+	}
+	if err := normalizeNotesFilter(&filterIns); err != nil {
+		return nil, paramsError, err
+	}
+
+	if reqIns.Mode == cursorMode || reqIns.Cursor != "" {
+		return notesByCursor(reqIns.Cursor, &filterIns, token)
+	}
+
+	notesInsPtr, page, err := getNotes(reqIns.PageNo, &filterIns, token)
 	if err != nil {
 		return nil, getNotesError, err
 	}
@@ -27,6 +44,24 @@ func notesAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, er
 	return notesRespObj{Notes: notesInsPtr, Page: page}, noError, nil
 }
 
+func notesByCursor(cursor string, filterIns *notesFilterObj, token string) (interface{}, int, error) {
+	var cursorInsPtr *notesCursorObj
+	if cursor != "" {
+		var err error
+		cursorInsPtr, err = decodeNotesCursor(cursor, notesSortKey(filterIns))
+		if err != nil {
+			return nil, paramsError, err
+		}
+	}
+
+	notesInsPtr, nextCursor, err := getNotesAfter(cursorInsPtr, filterIns, token)
+	if err != nil {
+		return nil, getNotesError, err
+	}
+
+	return notesRespObj{Notes: notesInsPtr, NextCursor: nextCursor}, noError, nil
+}
+
 func noteAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
 	var reqIns noteReqObj
 	decoder := json.NewDecoder(req.Body)
@@ -41,12 +76,51 @@ func noteAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, err
 		token = tokenCookie.Value
 	}
 
-	noteInsPtr, err := getNote(reqIns.NoteID, token)
+	var noteInsPtr *noteObj
+	var redirect string
+	var err error
+	if reqIns.Slug != "" {
+		noteInsPtr, redirect, err = getNoteBySlug(reqIns.Slug, token)
+	} else {
+		noteInsPtr, err = getNote(reqIns.NoteID, token)
+	}
+	if err != nil {
+		return nil, getNoteError, err
+	}
+
+	backlinksIns, err := getBacklinks(noteInsPtr.ID, token)
 	if err != nil {
 		return nil, getNoteError, err
 	}
 
-	return noteRespObj{Note: noteInsPtr}, noError, nil
+	seriesNavInsPtr, err := getSeriesNav(noteInsPtr.ID, token)
+	if err != nil {
+		return nil, getNoteError, err
+	}
+
+	modifiedAt, err := getNoteModifiedAt(noteInsPtr.ID)
+	if err != nil {
+		return nil, getNoteError, err
+	}
+
+	return noteRespObj{Note: noteInsPtr, Backlinks: backlinksIns, Series: seriesNavInsPtr, Redirect: redirect,
+		ModifiedAt: modifiedAt}, noError, nil
+}
+
+func noteGraphAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var token string
+	if tokenCookie, err := req.Cookie(tokenName); err != nil {
+		token = ""
+	} else {
+		token = tokenCookie.Value
+	}
+
+	nodesIns, edgesIns, err := getNoteGraph(token)
+	if err != nil {
+		return nil, getNoteGraphError, err
+	}
+
+	return noteGraphRespObj{Nodes: nodesIns, Edges: edgesIns}, noError, nil
 }
 
 func notePublishAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
@@ -60,12 +134,16 @@ func notePublishAPI(resp http.ResponseWriter, req *http.Request) (interface{}, i
 		return nil, paramsError, paramsErr
 	}
 
-	noteID, err := publishNote(reqIns.Title, reqIns.Content, reqIns.Private, reqIns.Tags...)
+	if err := validateShortcodes(reqIns.Content); err != nil {
+		return nil, shortcodeError, err
+	}
+
+	noteID, slug, err := publishNote(reqIns.Title, reqIns.Content, reqIns.Private, reqIns.Tags...)
 	if err != nil {
 		return nil, publishNoteError, err
 	}
 
-	return notePublishRespObj{NoteID: noteID}, noError, nil
+	return notePublishRespObj{NoteID: noteID, Slug: slug}, noError, nil
 }
 
 func noteUpdateAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
@@ -75,6 +153,10 @@ func noteUpdateAPI(resp http.ResponseWriter, req *http.Request) (interface{}, in
 		return nil, decodeError, err
 	}
 
+	if err := validateShortcodes(reqIns.Content); err != nil {
+		return nil, shortcodeError, err
+	}
+
 	if err := updateNote(reqIns.NoteID, reqIns.Title, reqIns.Content, reqIns.Private, reqIns.Tags...); err != nil {
 		return nil, updateNoteError, err
 	}
@@ -104,6 +186,265 @@ func tagsAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, err
 	return tagsRespObj{Tags: tagsIns}, noError, nil
 }
 
+func tagRenameAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns tagRenameReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	if reqIns.TagID == 0 || reqIns.Name == "" {
+		return nil, paramsError, paramsErr
+	}
+
+	if err := renameTag(reqIns.TagID, reqIns.Name); err != nil {
+		return nil, renameTagError, err
+	}
+
+	return tagRenameRespObj{TagID: reqIns.TagID}, noError, nil
+}
+
+func tagMergeAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns tagMergeReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	if reqIns.TargetID == 0 || len(reqIns.TagIDs) <= 0 {
+		return nil, paramsError, paramsErr
+	}
+
+	if err := mergeTags(reqIns.TargetID, reqIns.TagIDs...); err != nil {
+		return nil, mergeTagsError, err
+	}
+
+	return tagMergeRespObj{TagID: reqIns.TargetID}, noError, nil
+}
+
+func tagUpdateAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns tagUpdateReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	if reqIns.TagID == 0 || len([]rune(reqIns.Description)) > 255 ||
+		(reqIns.Color != "" && !tagColorRegexp.MatchString(reqIns.Color)) ||
+		(reqIns.Slug != "" && (!tagSlugRegexp.MatchString(reqIns.Slug) || isNumericSlug(reqIns.Slug))) {
+		return nil, paramsError, paramsErr
+	}
+
+	if err := updateTag(reqIns.TagID, reqIns.Description, reqIns.Color, reqIns.Slug); err != nil {
+		return nil, updateTagError, err
+	}
+
+	return tagUpdateRespObj{TagID: reqIns.TagID}, noError, nil
+}
+
+func seriesAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns seriesReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	var token string
+	if tokenCookie, err := req.Cookie(tokenName); err != nil {
+		token = ""
+	} else {
+		token = tokenCookie.Value
+	}
+
+	seriesInsPtr, err := getSeries(reqIns.SeriesID, token)
+	if err != nil {
+		return nil, getSeriesError, err
+	}
+
+	return seriesRespObj{Series: seriesInsPtr}, noError, nil
+}
+
+func seriesListAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var token string
+	if tokenCookie, err := req.Cookie(tokenName); err != nil {
+		token = ""
+	} else {
+		token = tokenCookie.Value
+	}
+
+	seriesListIns, err := getSeriesList(token)
+	if err != nil {
+		return nil, getSeriesListError, err
+	}
+
+	return seriesListRespObj{Series: seriesListIns}, noError, nil
+}
+
+func seriesCreateAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns seriesCreateReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	if reqIns.Title == "" || hasDuplicatedUint32(reqIns.NoteIDs) {
+		return nil, paramsError, paramsErr
+	}
+
+	seriesID, err := createSeries(reqIns.Title, reqIns.Description, reqIns.NoteIDs...)
+	if err != nil {
+		return nil, createSeriesError, err
+	}
+
+	return seriesCreateRespObj{SeriesID: seriesID}, noError, nil
+}
+
+func seriesUpdateAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns seriesUpdateReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	if reqIns.Title == "" || hasDuplicatedUint32(reqIns.NoteIDs) {
+		return nil, paramsError, paramsErr
+	}
+
+	if err := updateSeries(reqIns.SeriesID, reqIns.Title, reqIns.Description, reqIns.NoteIDs...); err != nil {
+		return nil, updateSeriesError, err
+	}
+
+	return seriesUpdateRespObj{SeriesID: reqIns.SeriesID}, noError, nil
+}
+
+func seriesDeleteAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns seriesDeleteReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	if err := deleteSeries(reqIns.SeriesID); err != nil {
+		return nil, deleteSeriesError, err
+	}
+
+	return seriesDeleteRespObj{SeriesID: reqIns.SeriesID}, noError, nil
+}
+
+func archiveAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	archiveIns, err := getArchive()
+	if err != nil {
+		return nil, getArchiveError, err
+	}
+
+	return archiveRespObj{Archive: archiveIns}, noError, nil
+}
+
+func archiveMonthAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns archiveMonthReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	return archiveMonth(reqIns.Year, reqIns.Month, reqIns.PageNo, reqToken(req))
+}
+
+func archiveMonth(year uint32, month uint32, pageNo uint32, token string) (interface{}, int, error) {
+	if year < 1970 || year > 9999 || month < 1 || month > 12 {
+		return nil, paramsError, paramsErr
+	}
+
+	notesInsPtr, page, err := getArchiveMonth(year, month, pageNo, token)
+	if err != nil {
+		return nil, getNotesError, err
+	}
+
+	return notesRespObj{Notes: notesInsPtr, Page: page}, noError, nil
+}
+
+func calendarAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns calendarReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	return calendar(reqIns.Year)
+}
+
+func calendar(year uint32) (interface{}, int, error) {
+	if year < 1970 || year > 9999 {
+		return nil, paramsError, paramsErr
+	}
+
+	daysIns, err := getCalendar(year)
+	if err != nil {
+		return nil, getCalendarError, err
+	}
+
+	respIns := calendarRespObj{Year: year, Days: daysIns}
+	for _, dayIns := range daysIns {
+		respIns.Count += dayIns.Count
+		respIns.Words += dayIns.Words
+	}
+	return respIns, noError, nil
+}
+
+func onThisDayAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	today, notesInsPtr, err := getOnThisDay(reqToken(req))
+	if err != nil {
+		return nil, getOnThisDayError, err
+	}
+
+	return onThisDayRespObj{Date: today, Notes: notesInsPtr}, noError, nil
+}
+
+func exportMarkdownAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	name := fmt.Sprintf("notebook-%s.zip", time.Now().Format("20060102-150405"))
+	return &fileObj{Name: name, ContentType: "application/zip", Write: func(w io.Writer) error {
+		_, err := ExportMarkdown(w)
+		return err
+	}}, noError, nil
+}
+
+func attachmentUploadAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	// room for the multipart headers
+	req.Body = http.MaxBytesReader(resp, req.Body, attachmentMaxSize()+1<<20)
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		return nil, paramsError, err
+	}
+	defer file.Close()
+	defer req.MultipartForm.RemoveAll()
+
+	attachmentInsPtr, err := uploadAttachment(file, header.Size, header.Filename)
+	switch err {
+	case nil:
+		return attachmentInsPtr, noError, nil
+	case attachmentTooLargeErr:
+		return nil, attachmentTooLargeError, err
+	case attachmentTypeErr:
+		return nil, attachmentTypeError, err
+	default:
+		return nil, uploadAttachmentError, err
+	}
+}
+
+func attachmentAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	var reqIns attachmentReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	attachmentInsPtr, err := getAttachment(reqIns.AttachmentID, reqToken(req))
+	if err != nil {
+		return nil, getAttachmentError, err
+	}
+	return attachmentInsPtr, noError, nil
+}
+
 func authAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
 	var reqIns authReqObj
 	decoder := json.NewDecoder(req.Body)
@@ -141,14 +482,189 @@ func logoutAPI(resp http.ResponseWriter, req *http.Request) (interface{}, int, e
 	return nil, noError, nil
 }
 
+// ------------------------------------------------------------------
+// v2 apis take parameters from the url, so that read only ones can be requested by GET
+
+func notesV2API(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	query := req.URL.Query()
+	pageNo, err := queryUint32(query, "page", 1)
+	if err != nil {
+		return nil, paramsError, err
+	}
+	tags, err := queryUint32s(query, "tag")
+	if err != nil {
+		return nil, paramsError, err
+	}
+
+	filterIns := notesFilterObj{
+		Tags: tags, TagMode: query.Get("tag_mode"), From: query.Get("from"), To: query.Get("to"),
+		Visibility: query.Get("visibility"), Author: query.Get("author"), Sort: query.Get("sort"), Order: query.Get("order"),
+	}
+	if err := normalizeNotesFilter(&filterIns); err != nil {
+		return nil, paramsError, err
+	}
+
+	if query.Get("mode") == cursorMode || query.Get("cursor") != "" {
+		return notesByCursor(query.Get("cursor"), &filterIns, reqToken(req))
+	}
+
+	notesInsPtr, page, err := getNotes(pageNo, &filterIns, reqToken(req))
+	if err != nil {
+		return nil, getNotesError, err
+	}
+
+	return notesRespObj{Notes: notesInsPtr, Page: page}, noError, nil
+}
+
+// noteV2API looks up the note by id if "{id}" is a number, by slug otherwise
+func noteV2API(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	token := reqToken(req)
+	idOrSlug := mux.Vars(req)["id"]
+
+	var noteInsPtr *noteObj
+	var redirect string
+	var err error
+	if noteID, parseErr := strconv.ParseUint(idOrSlug, 10, 32); parseErr == nil {
+		noteInsPtr, err = getNote(uint32(noteID), token)
+	} else {
+		noteInsPtr, redirect, err = getNoteBySlug(idOrSlug, token)
+	}
+	if err != nil {
+		return nil, getNoteError, err
+	}
+
+	backlinksIns, err := getBacklinks(noteInsPtr.ID, token)
+	if err != nil {
+		return nil, getNoteError, err
+	}
+
+	seriesNavInsPtr, err := getSeriesNav(noteInsPtr.ID, token)
+	if err != nil {
+		return nil, getNoteError, err
+	}
+
+	modifiedAt, err := getNoteModifiedAt(noteInsPtr.ID)
+	if err != nil {
+		return nil, getNoteError, err
+	}
+
+	return noteRespObj{Note: noteInsPtr, Backlinks: backlinksIns, Series: seriesNavInsPtr, Redirect: redirect,
+		ModifiedAt: modifiedAt}, noError, nil
+}
+
+func noteUpdateV2API(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	noteID, err := pathUint32(req, "id")
+	if err != nil {
+		return nil, paramsError, err
+	}
+
+	var reqIns notePublishReqObj
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reqIns); err != nil {
+		return nil, decodeError, err
+	}
+
+	if err := validateShortcodes(reqIns.Content); err != nil {
+		return nil, shortcodeError, err
+	}
+
+	if err := updateNote(noteID, reqIns.Title, reqIns.Content, reqIns.Private, reqIns.Tags...); err != nil {
+		return nil, updateNoteError, err
+	}
+
+	return noteUpdateRespObj{NoteID: noteID}, noError, nil
+}
+
+func noteDeleteV2API(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	noteID, err := pathUint32(req, "id")
+	if err != nil {
+		return nil, paramsError, err
+	}
+
+	if err := deleteNote(noteID); err != nil {
+		return nil, deleteNoteError, err
+	}
+
+	return noteDeleteRespObj{NoteID: noteID}, noError, nil
+}
+
+func archiveMonthV2API(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	year, err := pathUint32(req, "year")
+	if err != nil {
+		return nil, paramsError, err
+	}
+	month, err := pathUint32(req, "month")
+	if err != nil {
+		return nil, paramsError, err
+	}
+	pageNo, err := queryUint32(req.URL.Query(), "page", 1)
+	if err != nil {
+		return nil, paramsError, err
+	}
+
+	return archiveMonth(year, month, pageNo, reqToken(req))
+}
+
+func calendarV2API(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	year, err := pathUint32(req, "year")
+	if err != nil {
+		return nil, paramsError, err
+	}
+
+	return calendar(year)
+}
+
+func attachmentV2API(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	attachmentID, err := pathUint32(req, "id")
+	if err != nil {
+		return nil, paramsError, err
+	}
+
+	attachmentInsPtr, err := getAttachment(attachmentID, reqToken(req))
+	if err != nil {
+		return nil, getAttachmentError, err
+	}
+	return attachmentInsPtr, noError, nil
+}
+
+func seriesV2API(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+	seriesID, err := pathUint32(req, "id")
+	if err != nil {
+		return nil, paramsError, err
+	}
+
+	seriesInsPtr, err := getSeries(seriesID, reqToken(req))
+	if err != nil {
+		return nil, getSeriesError, err
+	}
+
+	return seriesRespObj{Series: seriesInsPtr}, noError, nil
+}
+
 // ------------------------------------------------------------------
 
 var NotePublishHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(notePublishAPI))), post))
 var NotesHandler = makeHandler(checkMethod(afterReq(beforeReq(notesAPI)), post))
 var NoteHandler = makeHandler(checkMethod(afterReq(beforeReq(noteAPI)), post))
+var NoteGraphHandler = makeHandler(checkMethod(afterReq(beforeReq(noteGraphAPI)), post))
 var NoteUpdateHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(noteUpdateAPI))), post))
 var NoteDeleteHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(noteDeleteAPI))), post))
 var TagsHandler = makeHandler(checkMethod(afterReq(beforeReq(tagsAPI)), post))
+var TagRenameHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(tagRenameAPI))), post))
+var TagMergeHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(tagMergeAPI))), post))
+var TagUpdateHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(tagUpdateAPI))), post))
+var SeriesHandler = makeHandler(checkMethod(afterReq(beforeReq(seriesAPI)), post))
+var SeriesListHandler = makeHandler(checkMethod(afterReq(beforeReq(seriesListAPI)), post))
+var SeriesCreateHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(seriesCreateAPI))), post))
+var SeriesUpdateHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(seriesUpdateAPI))), post))
+var SeriesDeleteHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(seriesDeleteAPI))), post))
+var ArchiveHandler = makeHandler(checkMethod(afterReq(beforeReq(archiveAPI)), post))
+var ArchiveMonthHandler = makeHandler(checkMethod(afterReq(beforeReq(archiveMonthAPI)), post))
+var CalendarHandler = makeHandler(checkMethod(afterReq(beforeReq(calendarAPI)), post))
+var OnThisDayHandler = makeHandler(checkMethod(afterReq(beforeReq(onThisDayAPI)), post))
+var ExportMarkdownHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(exportMarkdownAPI))), post))
+var AttachmentUploadHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(attachmentUploadAPI))), post))
+var AttachmentInfoHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(attachmentAPI))), post))
 var AuthHandler = makeHandler(checkMethod(afterReq(beforeReq(authAPI)), post))
 var IsAuthHandler = makeHandler(checkMethod(afterReq(beforeReq(isAuthAPI)), post))
 var LogoutHandler = makeHandler(checkMethod(afterReq(beforeReq(checkAuth(logoutAPI))), post))
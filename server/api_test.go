@@ -0,0 +1,85 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNoteV2APILastModified(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"cache.enabled": false, "mysql.loc": "UTC", "plugin.on_read": []string{}})
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text, update_at)
+					values (1, 'One', 'me', '', '', '2020-01-01 00:00:00'), (2, 'Two', 'me', '', '', '2021-06-01 08:00:00'),
+					(3, 'Three', 'me', '', '', '2019-01-01 00:00:00')`)
+	mustExec(t, db, `insert into notebook.note_link (src_note_id, dst_note_id, target, update_at)
+					values (2, 1, 'One', '2020-01-01 00:00:00')`)
+
+	get := func(ifModifiedSince string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v2/notes/1", nil)
+		if ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", ifModifiedSince)
+		}
+		resp := httptest.NewRecorder()
+		makeHandler(noteV2API)(resp, mux.SetURLVars(req, map[string]string{"id": "1"}))
+		return resp
+	}
+
+	// the backlink from note 2 is newer than note 1
+	resp := get("")
+	lastModified := resp.Header().Get("Last-Modified")
+	if resp.Code != http.StatusOK || lastModified != "Tue, 01 Jun 2021 08:00:00 GMT" {
+		t.Fatalf("status %d, Last-Modified %q", resp.Code, lastModified)
+	}
+	if resp = get(lastModified); resp.Code != http.StatusNotModified {
+		t.Errorf("status %d of an unchanged note", resp.Code)
+	}
+
+	// a series note shown as next is renamed
+	mustExec(t, db, `insert into notebook.series (id, title, description, update_at) values (1, 'S', '', '2020-01-01 00:00:00')`)
+	mustExec(t, db, `insert into notebook.series_note (series_id, note_id, position, update_at)
+					values (1, 1, 0, '2020-01-01 00:00:00'), (1, 3, 1, '2020-01-01 00:00:00')`)
+	mustExec(t, db, "update notebook.note set title = 'Renamed', update_at = '2022-01-01 00:00:00' where id = 3")
+	if resp = get(lastModified); resp.Code != http.StatusOK ||
+		resp.Header().Get("Last-Modified") != "Sat, 01 Jan 2022 00:00:00 GMT" {
+		t.Errorf("status %d, Last-Modified %q after renaming a series note", resp.Code, resp.Header().Get("Last-Modified"))
+	}
+}
+
+func TestV2RouterHTTPStatus(t *testing.T) {
+	openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"cache.enabled": false})
+	router := NewV2Router()
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "/api/v2/notes/99", "", http.StatusNotFound},
+		{http.MethodGet, "/api/v2/notes/no-such-slug", "", http.StatusNotFound},
+		{http.MethodGet, "/api/v2/series/5", "", http.StatusNotFound},
+		{http.MethodGet, "/api/v2/notes?page=x", "", http.StatusBadRequest},
+		{http.MethodGet, "/api/v2/archive/2020/1?page=-1", "", http.StatusBadRequest},
+		{http.MethodPut, "/api/v2/notes/1", "{}", http.StatusUnauthorized},
+		{http.MethodGet, "/api/v2/notes", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if resp.Code != c.code {
+			t.Errorf("%s %s: status %d, want %d, body %s", c.method, c.path, resp.Code, c.code, resp.Body)
+		}
+	}
+
+	// the POST only apis answer 200 with the status in the body
+	resp := httptest.NewRecorder()
+	NoteHandler(resp, httptest.NewRequest(http.MethodPost, "/api/note", strings.NewReader(`{"note_id": 99}`)))
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), strconv.Itoa(getNoteError)) {
+		t.Errorf("legacy api: status %d, body %s", resp.Code, resp.Body)
+	}
+}
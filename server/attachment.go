@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const attachmentPathPrefix = "/attachment/"
+
+const defaultAttachmentMaxSize = 10 << 20
+
+// the content of an attachment url never changes, but who may see it does when notes are made private or deleted,
+// so public copies are only kept for a while
+const attachmentMaxAge = 10 * 60
+
+// attachments are referenced by their url in the content of notes, e.g. <img src="/attachment/<sha256>">
+var attachmentRefRegexp = regexp.MustCompile(`/attachment/([0-9a-f]{64})`)
+
+var attachmentSHA256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ------------------------------------------------------------------
+
+func attachmentURL(sha256 string) string {
+	return attachmentPathPrefix + sha256
+}
+
+// attachmentMaxSize returns the size limit of uploads in bytes, "attachment.max_size"
+func attachmentMaxSize() int64 {
+	if size := viper.GetInt64("attachment.max_size"); size > 0 {
+		return size
+	}
+	return defaultAttachmentMaxSize
+}
+
+// isAttachmentTypeAllowed checks the sniffed type against "attachment.allowed_types", e.g. "image/png" or "image/*"
+func isAttachmentTypeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range viper.GetStringSlice("attachment.allowed_types") {
+		if allowed == mediaType || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffContentType detects the type from the content instead of trusting the client
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// uploadAttachment stores file by the sha256 of its content, the same content uploaded twice is stored once
+// and keeps the name it was uploaded with first
+func uploadAttachment(file io.ReadSeeker, size int64, name string) (*attachmentObj, error) {
+	if size > attachmentMaxSize() {
+		return nil, attachmentTooLargeErr
+	}
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		return nil, err
+	}
+	if !isAttachmentTypeAllowed(contentType) {
+		return nil, attachmentTypeErr
+	}
+
+	// images are read into memory, to remove the location from their metadata before hashing
+	var width, height int
+	if _, ok := variantFormats[mediaTypeOf(contentType)]; ok {
+		data, err := ioutil.ReadAll(io.LimitReader(file, attachmentMaxSize()+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > attachmentMaxSize() {
+			return nil, attachmentTooLargeErr
+		}
+		data = stripImageGPS(contentType, data)
+		// an image that cannot be decoded is still kept as a file, without variants
+		if width, height, err = imageSize(contentType, data); err != nil {
+			log.Logger.WithField("name", name).WithField("err", err).Warn("decode image failed")
+		}
+		if int64(width)*int64(height) > imageMaxPixels() {
+			return nil, attachmentTooLargeErr
+		}
+		file = bytes.NewReader(data)
+	}
+
+	hash := sha256.New()
+	// the size of the multipart header is not to be trusted
+	written, err := io.Copy(hash, io.LimitReader(file, attachmentMaxSize()+1))
+	if err != nil {
+		return nil, err
+	}
+	if written > attachmentMaxSize() {
+		return nil, attachmentTooLargeErr
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	store, err := newBlobStore()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := store.Exists(sum)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := store.Put(sum, file); err != nil {
+			return nil, err
+		}
+	}
+
+	name = path.Base(strings.Replace(name, `\`, "/", -1))
+	if runes := []rune(name); len(runes) > 255 {
+		name = string(runes[len(runes)-255:])
+	}
+	attachmentIns := &attachmentObj{SHA256: sum, Name: name, MIME: contentType, Size: written,
+		Width: width, Height: height}
+	ret, err := withTransaction(func(cursor cursorObj) (interface{}, error) {
+		if _, err := insertAttachment(cursor, attachmentIns); err != nil {
+			return nil, err
+		}
+		return selectAttachmentBySHA256(cursor, sum)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attachmentInsPtr := ret.(*attachmentObj)
+	attachmentInsPtr.URL = attachmentURL(sum)
+	log.Logger.WithField("sha256", sum).WithField("deduplicated", exists).Info("attachment uploaded")
+	if viper.GetBool("attachment.eager_variants") && attachmentInsPtr.Width > 0 {
+		go makeImageVariants(*attachmentInsPtr)
+	}
+	return attachmentInsPtr, nil
+}
+
+// extractAttachmentSHA256s returns the distinct attachments referenced by content
+func extractAttachmentSHA256s(content string) []string {
+	sha256s := make([]string, 0)
+	for _, submatch := range attachmentRefRegexp.FindAllStringSubmatch(content, -1) {
+		if !containsString(sha256s, submatch[1]) {
+			sha256s = append(sha256s, submatch[1])
+		}
+	}
+	return sha256s
+}
+
+// saveNoteAttachments replaces the attachments of a note with the ones referenced by its content
+func saveNoteAttachments(cursor cursorObj, noteID uint32, content string) error {
+	if _, err := deleteNoteAttachmentsByNoteID(cursor, noteID); err != nil {
+		return err
+	}
+	attachmentIDs, err := selectAttachmentIDsBySHA256s(cursor, true, extractAttachmentSHA256s(content)...)
+	if err != nil {
+		return err
+	}
+	_, err = insertNoteAttachments(cursor, noteID, attachmentIDs...)
+	return err
+}
+
+// getAttachment returns an attachment with the notes referencing it
+func getAttachment(attachmentID uint32, token string) (*attachmentObj, error) {
+	attachmentInsPtr, err := selectAttachmentByID(DB, attachmentID)
+	if err != nil {
+		return nil, err
+	}
+	if attachmentInsPtr == nil {
+		return nil, attachmentNotExistsErr
+	}
+	attachmentInsPtr.URL = attachmentURL(attachmentInsPtr.SHA256)
+	attachmentInsPtr.Notes, err = selectNotesByAttachmentID(DB, attachmentID, isAuth(token), true)
+	return attachmentInsPtr, err
+}
+
+// ------------------------------------------------------------------
+
+// AttachmentHandler serves "/attachment/<sha256>" with range requests. Attachments not referenced by any
+// public note, e.g. the ones of private notes, are only served to the authenticated
+func AttachmentHandler(resp http.ResponseWriter, req *http.Request) {
+	log.Logger.WithField("url", req.URL).Info("incoming request")
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(resp, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	sum := strings.TrimPrefix(req.URL.Path, attachmentPathPrefix)
+	if !attachmentSHA256Regexp.MatchString(sum) {
+		http.NotFound(resp, req)
+		return
+	}
+	attachmentInsPtr, err := selectAttachmentBySHA256(DB, sum)
+	var notesIns []noteLinkObj
+	if err == nil && attachmentInsPtr != nil {
+		notesIns, err = selectNotesByAttachmentID(DB, attachmentInsPtr.ID, false, true)
+	}
+	if err != nil {
+		log.Logger.WithField("err", err).Error("get attachment failed")
+		http.Error(resp, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	_isAuth := isAuth(reqToken(req))
+	if attachmentInsPtr == nil || len(notesIns) <= 0 && !_isAuth {
+		http.NotFound(resp, req)
+		return
+	}
+
+	store, err := newBlobStore()
+	// "?w=<width>" asks for a resized variant of an image, only the configured widths are made
+	key, contentType, etag := sum, attachmentInsPtr.MIME, sum
+	if w := req.URL.Query().Get("w"); w != "" && err == nil {
+		width, convErr := strconv.Atoi(w)
+		if convErr != nil || !isVariantWidth(width) {
+			http.NotFound(resp, req)
+			return
+		}
+		var variant string
+		if variant, err = getImageVariant(store, attachmentInsPtr, width); err == nil && variant != "" {
+			key, contentType, etag = variant, mime.TypeByExtension(path.Ext(variant)), fmt.Sprintf("%s-w%d", sum, width)
+		}
+	}
+	var blobInsPtr *blobObj
+	if err == nil {
+		blobInsPtr, err = store.Open(key)
+	}
+	if err == blobNotExistsErr {
+		log.Logger.WithField("key", key).Error("blob of attachment is missing")
+		http.NotFound(resp, req)
+		return
+	}
+	if err != nil {
+		log.Logger.WithField("err", err).Error("open attachment failed")
+		http.Error(resp, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer blobInsPtr.Close()
+
+	// attachments only the owner may see are checked again every time, so that logging out takes effect
+	cacheControl := fmt.Sprintf("public, max-age=%d", attachmentMaxAge)
+	if len(notesIns) <= 0 {
+		cacheControl = "private, no-cache"
+	}
+	resp.Header().Set("Cache-Control", cacheControl)
+	resp.Header().Set("Vary", "Cookie")
+	resp.Header().Set("Content-Type", contentType)
+	resp.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": attachmentInsPtr.Name}))
+	resp.Header().Set("ETag", `"`+etag+`"`)
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	modTime := parseDBTime(attachmentInsPtr.CreatedAt)
+	if modTime.IsZero() {
+		modTime = blobInsPtr.ModTime
+	}
+	http.ServeContent(resp, req, attachmentInsPtr.Name, modTime.Truncate(time.Second), blobInsPtr)
+}
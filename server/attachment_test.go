@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAttachmentHandlerCacheControl(t *testing.T) {
+	setTestConfig(t, map[string]interface{}{"attachment.store": "local", "attachment.dir": t.TempDir()})
+	db := openTestDB(t)
+	data := []byte("hello")
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	store, err := newBlobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, `insert into notebook.attachment (id, sha256, name, mime, size) values (1, ?, 'a.txt', 'text/plain', 5)`, key)
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text, private)
+					values (1, 'Public', 'me', '', '', 0), (2, 'Private', 'me', '', '', 1)`)
+
+	get := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		AttachmentHandler(resp, httptest.NewRequest(http.MethodGet, attachmentURL(key), nil))
+		return resp
+	}
+
+	// used by a private note only, so hidden from visitors
+	mustExec(t, db, "insert into notebook.note_attachment (note_id, attachment_id) values (2, 1)")
+	if resp := get(); resp.Code != http.StatusNotFound {
+		t.Errorf("status %d of an attachment of a private note", resp.Code)
+	}
+
+	mustExec(t, db, "insert into notebook.note_attachment (note_id, attachment_id) values (1, 1)")
+	resp := get()
+	if resp.Code != http.StatusOK || resp.Body.String() != "hello" {
+		t.Fatalf("status %d, body %q", resp.Code, resp.Body)
+	}
+	if cacheControl := resp.Header().Get("Cache-Control"); cacheControl != "public, max-age=600" {
+		t.Errorf("Cache-Control %q", cacheControl)
+	}
+	if vary := resp.Header().Get("Vary"); vary != "Cookie" {
+		t.Errorf("Vary %q", vary)
+	}
+}
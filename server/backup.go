@@ -0,0 +1,304 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"time"
+)
+
+// version of the backup archive, restore refuses archives newer than it knows
+const backupVersion = 1
+
+// tables in the backup, in the order they are restored
+var backupTables = []string{"note", "tag", "note_tag", "note_link", "series", "series_note", "note_slug",
+	"attachment", "note_attachment", "note_import"}
+
+var backupColumnRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// ------------------------------------------------------------------
+
+type backupManifestObj struct {
+	Version      int              `json:"version"`
+	CreatedAt    string           `json:"created_at"`
+	ConfigSHA256 string           `json:"config_sha256"`
+	Tables       []backupTableObj `json:"tables"`
+	// sha256 of the attachments, whose content is in "blobs/<sha256>"
+	Blobs []string `json:"blobs"`
+}
+
+// backupTableObj describes "tables/<name>.jsonl", which has one json array of values per row
+type backupTableObj struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Rows    uint32   `json:"rows"`
+	SHA256  string   `json:"sha256"`
+}
+
+// ------------------------------------------------------------------
+
+func backupTableFile(table string) string {
+	return "tables/" + table + ".jsonl"
+}
+
+func backupBlobFile(sum string) string {
+	return "blobs/" + sum
+}
+
+func backupBlob(zipWriter *zip.Writer, store blobStore, sum string) error {
+	blobInsPtr, err := store.Open(sum)
+	if err != nil {
+		return fmt.Errorf("blob %s: %w", sum, err)
+	}
+	defer blobInsPtr.Close()
+
+	// the content is compressed already for most attachments
+	fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{Name: backupBlobFile(sum), Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fileWriter, blobInsPtr)
+	return err
+}
+
+// restoreBlob puts a blob of the archive into the store, after checking its content against its name
+func restoreBlob(zipReader *zip.Reader, store blobStore, sum string) error {
+	exists, err := store.Exists(sum)
+	if err != nil || exists {
+		return err
+	}
+	data, err := readBackupFile(zipReader, backupBlobFile(sum))
+	if err != nil {
+		return err
+	}
+	if actual := sha256.Sum256(data); hex.EncodeToString(actual[:]) != sum {
+		return fmt.Errorf("checksum of blob %s: %w", sum, backupCorruptedErr)
+	}
+	return store.Put(sum, bytes.NewReader(data))
+}
+
+// configSHA256 returns the checksum of the config file in use, so that a restore can tell it runs with another config
+func configSHA256() string {
+	data, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Backup writes all the tables and the content of the attachments to w as a zip archive. The tables are read in one
+// read only repeatable read transaction, whose snapshot is taken by the first read, so the archive is consistent
+// without locking whatever the default isolation level of the server is.
+// Sessions in redis are not backed up, users log in again after a restore
+func Backup(w io.Writer) (backupManifestObj, error) {
+	manifestIns := backupManifestObj{Version: backupVersion, CreatedAt: time.Now().Format(time.RFC3339),
+		ConfigSHA256: configSHA256(), Tables: make([]backupTableObj, 0, len(backupTables))}
+	store, err := newBlobStore()
+	if err != nil {
+		return manifestIns, err
+	}
+	zipWriter := zip.NewWriter(w)
+
+	_, err = withSnapshot(func(cursor cursorObj) (interface{}, error) {
+		for _, table := range backupTables {
+			fileWriter, err := zipWriter.Create(backupTableFile(table))
+			if err != nil {
+				return nil, err
+			}
+			hash := sha256.New()
+			encoder := json.NewEncoder(io.MultiWriter(fileWriter, hash))
+
+			tableIns := backupTableObj{Name: table}
+			tableIns.Columns, err = selectTableRows(cursor, table, func(values []interface{}) error {
+				for i, value := range values {
+					if data, ok := value.([]byte); ok {
+						values[i] = string(data)
+					}
+				}
+				tableIns.Rows++
+				return encoder.Encode(values)
+			})
+			if err != nil {
+				return nil, err
+			}
+			tableIns.SHA256 = hex.EncodeToString(hash.Sum(nil))
+			manifestIns.Tables = append(manifestIns.Tables, tableIns)
+		}
+
+		// blobs are never changed once stored, so the ones of the snapshot can be copied in the transaction
+		var err error
+		if manifestIns.Blobs, err = selectAttachmentSHA256s(cursor, true); err != nil {
+			return nil, err
+		}
+		for _, sum := range manifestIns.Blobs {
+			if err := backupBlob(zipWriter, store, sum); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return manifestIns, err
+	}
+
+	data, err := json.MarshalIndent(manifestIns, "", "  ")
+	if err != nil {
+		return manifestIns, err
+	}
+	fileWriter, err := zipWriter.Create("manifest.json")
+	if err != nil {
+		return manifestIns, err
+	}
+	if _, err := fileWriter.Write(data); err != nil {
+		return manifestIns, err
+	}
+	if err := zipWriter.Close(); err != nil {
+		return manifestIns, err
+	}
+
+	log.Logger.WithField("tables", len(manifestIns.Tables)).Info("done backup")
+	return manifestIns, nil
+}
+
+func readBackupFile(zipReader *zip.Reader, name string) ([]byte, error) {
+	for _, file := range zipReader.File {
+		if file.Name != name {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("%s not found: %w", name, backupCorruptedErr)
+}
+
+// checkBackupManifest makes sure the archive can be restored by this version before anything is written
+func checkBackupManifest(manifestIns *backupManifestObj) error {
+	if manifestIns.Version <= 0 || manifestIns.Version > backupVersion {
+		return fmt.Errorf("version %d: %w", manifestIns.Version, backupVersionErr)
+	}
+	for _, tableIns := range manifestIns.Tables {
+		// names are put into sql, so only the known tables and plain column names are accepted
+		if !containsString(backupTables, tableIns.Name) {
+			return fmt.Errorf("unknown table %s: %w", tableIns.Name, backupCorruptedErr)
+		}
+		for _, column := range tableIns.Columns {
+			if !backupColumnRegexp.MatchString(column) {
+				return fmt.Errorf("bad column %s of %s: %w", column, tableIns.Name, backupCorruptedErr)
+			}
+		}
+	}
+	// blob names become keys of the blob store
+	for _, sum := range manifestIns.Blobs {
+		if !attachmentSHA256Regexp.MatchString(sum) {
+			return fmt.Errorf("bad blob %s: %w", sum, backupCorruptedErr)
+		}
+	}
+	return nil
+}
+
+// Restore loads a backup archive into an empty database, in one transaction. Checksums of the tables are
+// verified before they are loaded, a different config only gives a warning
+func Restore(path string) (backupManifestObj, error) {
+	var manifestIns backupManifestObj
+	zipReadCloser, err := zip.OpenReader(path)
+	if err != nil {
+		return manifestIns, err
+	}
+	defer zipReadCloser.Close()
+	zipReader := &zipReadCloser.Reader
+
+	data, err := readBackupFile(zipReader, "manifest.json")
+	if err != nil {
+		return manifestIns, err
+	}
+	if err := json.Unmarshal(data, &manifestIns); err != nil {
+		return manifestIns, fmt.Errorf("manifest.json: %s: %w", err.Error(), backupCorruptedErr)
+	}
+	if err := checkBackupManifest(&manifestIns); err != nil {
+		return manifestIns, err
+	}
+	if manifestIns.ConfigSHA256 != configSHA256() {
+		log.Logger.WithField("backup", manifestIns.ConfigSHA256).WithField("current", configSHA256()).
+			Warn("backup was made with another config")
+	}
+
+	store, err := newBlobStore()
+	if err != nil {
+		return manifestIns, err
+	}
+
+	_, err = withTransaction(func(cursor cursorObj) (interface{}, error) {
+		for _, table := range backupTables {
+			cnt, err := selectTableRowsCount(cursor, table)
+			if err != nil {
+				return nil, err
+			}
+			if cnt > 0 {
+				return nil, fmt.Errorf("table %s has %d rows: %w", table, cnt, restoreNotEmptyErr)
+			}
+		}
+
+		for _, tableIns := range manifestIns.Tables {
+			data, err := readBackupFile(zipReader, backupTableFile(tableIns.Name))
+			if err != nil {
+				return nil, err
+			}
+			if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != tableIns.SHA256 {
+				return nil, fmt.Errorf("checksum of %s: %w", tableIns.Name, backupCorruptedErr)
+			}
+
+			var rows uint32
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			// a row holds a whole note
+			scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+			for scanner.Scan() {
+				var values []interface{}
+				decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+				// ids are kept as they are instead of becoming float64
+				decoder.UseNumber()
+				if err := decoder.Decode(&values); err != nil || len(values) != len(tableIns.Columns) {
+					return nil, fmt.Errorf("row %d of %s: %w", rows+1, tableIns.Name, backupCorruptedErr)
+				}
+				if _, err := insertTableRow(cursor, tableIns.Name, tableIns.Columns, values); err != nil {
+					return nil, err
+				}
+				rows++
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			if rows != tableIns.Rows {
+				return nil, fmt.Errorf("%d rows of %s, %d expected: %w", rows, tableIns.Name, tableIns.Rows, backupCorruptedErr)
+			}
+		}
+
+		// blobs are put before committing, a failed restore may leave some behind, which is harmless
+		for _, sum := range manifestIns.Blobs {
+			if err := restoreBlob(zipReader, store, sum); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return manifestIns, err
+	}
+
+	invalidateAllCaches()
+	log.Logger.WithField("file", path).Info("done restore")
+	return manifestIns, nil
+}
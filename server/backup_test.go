@@ -0,0 +1,201 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// dumpTables returns the rows of every backed up table, formatted so that they can be compared across databases
+func dumpTables(t *testing.T, db *sql.DB) map[string][]string {
+	tables := map[string][]string{}
+	for _, table := range backupTables {
+		rows := make([]string, 0)
+		_, err := selectTableRows(db, table, func(values []interface{}) error {
+			for i, value := range values {
+				if data, ok := value.([]byte); ok {
+					values[i] = string(data)
+				}
+			}
+			rows = append(rows, fmt.Sprintf("%#v", values))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[table] = rows
+	}
+	return tables
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	setTestConfig(t, map[string]interface{}{"cache.enabled": false, "attachment.store": "local",
+		"attachment.dir": t.TempDir()})
+	srcDB := openTestDB(t)
+
+	blobs := map[string][]byte{}
+	for _, data := range [][]byte{[]byte("first attachment"), {0, 1, 2, 0xff, '\n'}} {
+		sum := sha256.Sum256(data)
+		blobs[hex.EncodeToString(sum[:])] = data
+	}
+	var sums []string
+	store, err := newBlobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sum, data := range blobs {
+		if err := store.Put(sum, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, sum)
+	}
+
+	mustExec(t, srcDB, `insert into notebook.note (id, title, author, content, plain_text, words, private, slug, created_at, update_at)
+					values (1, 'Héllo "quoted"', 'me', '<p>line\nbreak [[#3]]</p>', 'line break', 2, 0, 'hello', '2019-05-01 10:00:00', '2019-05-02 11:00:00'),
+					(3, '私密', 'me', '', '', 0, 1, null, '2020-01-01 00:00:00', '2020-01-01 00:00:00')`)
+	mustExec(t, srcDB, `insert into notebook.tag (id, name, description, color, slug) values (1, 'lang', '', '', null),
+					(2, 'lang/go', 'Go', '#00add8', 'go')`)
+	mustExec(t, srcDB, `insert into notebook.note_tag (note_id, tag_id, tag_name) values (1, 2, 'lang/go'), (3, 1, 'lang')`)
+	mustExec(t, srcDB, `insert into notebook.note_link (src_note_id, dst_note_id, target) values (1, 3, '#3'), (3, 0, 'Missing')`)
+	mustExec(t, srcDB, `insert into notebook.series (id, title, description) values (1, 'Series', 'about')`)
+	mustExec(t, srcDB, `insert into notebook.series_note (series_id, note_id, position) values (1, 1, 0), (1, 3, 1)`)
+	mustExec(t, srcDB, `insert into notebook.note_slug (note_id, slug) values (1, 'hello'), (1, 'old-hello')`)
+	mustExec(t, srcDB, `insert into notebook.attachment (id, sha256, name, mime, size, width, height)
+					values (1, ?, 'a.txt', 'text/plain', 16, 0, 0), (2, ?, 'b.bin', 'application/octet-stream', 5, 0, 0)`,
+		sums[0], sums[1])
+	mustExec(t, srcDB, `insert into notebook.note_attachment (note_id, attachment_id) values (1, 1), (3, 2)`)
+	mustExec(t, srcDB, `insert into notebook.note_import (note_id, source) values (1, 'wp:42')`)
+	want := dumpTables(t, srcDB)
+	for _, table := range backupTables {
+		if len(want[table]) == 0 {
+			t.Fatalf("no rows in %s", table)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupManifestIns, err := Backup(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupManifestIns.Version != backupVersion || len(backupManifestIns.Tables) != len(backupTables) ||
+		len(backupManifestIns.Blobs) != len(blobs) {
+		t.Errorf("backup manifest %+v", backupManifestIns)
+	}
+
+	// restore into an empty schema and an empty blob store
+	setTestConfig(t, map[string]interface{}{"attachment.dir": t.TempDir()})
+	dstDB := openTestDB(t)
+	if _, err := Restore(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := dumpTables(t, dstDB); !reflect.DeepEqual(got, want) {
+		for _, table := range backupTables {
+			if !reflect.DeepEqual(got[table], want[table]) {
+				t.Errorf("%s restored as\n%v\nwant\n%v", table, got[table], want[table])
+			}
+		}
+	}
+	if store, err = newBlobStore(); err != nil {
+		t.Fatal(err)
+	}
+	for sum, data := range blobs {
+		blobInsPtr, err := store.Open(sum)
+		if err != nil {
+			t.Fatalf("blob %s: %s", sum, err)
+		}
+		got, err := ioutil.ReadAll(blobInsPtr)
+		_ = blobInsPtr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("blob %s restored as %q, want %q", sum, got, data)
+		}
+	}
+
+	// the restored database is not empty anymore
+	if _, err := Restore(path); err == nil {
+		t.Error("restore into a non-empty database succeeded")
+	}
+}
+
+// writeBackupArchive writes a backup archive of the given version, with the tables and blobs of manifestIns
+// and their empty files
+func writeBackupArchive(t *testing.T, manifestIns backupManifestObj) string {
+	path := filepath.Join(t.TempDir(), "backup.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zipWriter := zip.NewWriter(file)
+	empty := sha256.Sum256(nil)
+	for i, tableIns := range manifestIns.Tables {
+		if _, err := zipWriter.Create(backupTableFile(tableIns.Name)); err != nil {
+			t.Fatal(err)
+		}
+		manifestIns.Tables[i].SHA256 = hex.EncodeToString(empty[:])
+	}
+	data, err := json.Marshal(manifestIns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileWriter, err := zipWriter.Create("manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileWriter.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRestoreVersions(t *testing.T) {
+	setTestConfig(t, map[string]interface{}{"cache.enabled": false, "attachment.store": "local",
+		"attachment.dir": t.TempDir()})
+	var tables []backupTableObj
+	for _, table := range backupTables {
+		tables = append(tables, backupTableObj{Name: table})
+	}
+
+	cases := []struct {
+		version int
+		ok      bool
+	}{
+		{backupVersion, true},
+		{backupVersion + 1, false},
+		{0, false},
+	}
+	for _, c := range cases {
+		openTestDB(t)
+		path := writeBackupArchive(t, backupManifestObj{Version: c.version, Tables: tables})
+		_, err := Restore(path)
+		if c.ok && err != nil {
+			t.Errorf("restore version %d: %s", c.version, err)
+		}
+		if !c.ok && !errors.Is(err, backupVersionErr) {
+			t.Errorf("restore version %d: %v, want %v", c.version, err, backupVersionErr)
+		}
+	}
+}
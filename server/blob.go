@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------------
+
+// blobStore keeps the content of attachments by key, "attachment.store" chooses the implementation
+type blobStore interface {
+	// Put stores the content of r, replacing the blob of the same key
+	Put(key string, r io.Reader) error
+	// Open returns blobNotExistsErr if there is no such blob
+	Open(key string) (*blobObj, error)
+	Exists(key string) (bool, error)
+	Delete(key string) error
+}
+
+// blobObj is an opened blob, seekable for range requests
+type blobObj struct {
+	io.ReadSeeker
+	io.Closer
+	Size    int64
+	ModTime time.Time
+}
+
+// localBlobStore keeps blobs as files under a directory, sharded by the first characters of the key
+type localBlobStore struct {
+	dir string
+}
+
+// ------------------------------------------------------------------
+
+func newBlobStore() (blobStore, error) {
+	switch name := viper.GetString("attachment.store"); name {
+	case "", "local":
+		return &localBlobStore{dir: viper.GetString("attachment.dir")}, nil
+	default:
+		return nil, fmt.Errorf("unknown blob store: %s", name)
+	}
+}
+
+// path returns the file of a key, "abcdef" is kept as "ab/cd/abcdef"
+func (s *localBlobStore) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return "", fmt.Errorf("bad blob key: %s", key)
+	}
+	name := filepath.FromSlash(key)
+	base := filepath.Base(name)
+	if len(base) < 4 {
+		return filepath.Join(s.dir, name), nil
+	}
+	return filepath.Join(s.dir, filepath.Dir(name), base[:2], base[2:4], base), nil
+}
+
+// Put writes to a temporary file renamed into place, so that readers never see half of a blob
+func (s *localBlobStore) Put(key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Open(key string) (*blobObj, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, blobNotExistsErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &blobObj{ReadSeeker: file, Closer: file, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localBlobStore) Exists(key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"time"
+)
+
+// ------------------------------------------------------------------
+
+// rendered notes, notes pages and the tag tree are cached in redis until a note or tag changes.
+// "cache.ttl" bounds the staleness of anything not invalidated precisely
+func isCacheEnabled() bool {
+	return viper.GetBool("cache.enabled") && RDS != nil
+}
+
+func cacheTTL() time.Duration {
+	return time.Second * time.Duration(viper.GetInt("cache.ttl"))
+}
+
+// authed and anonymous readers see different content of private notes, so they are cached separately
+func cacheView(isAuth bool) string {
+	if isAuth {
+		return "auth"
+	}
+	return "anon"
+}
+
+func noteCacheKey(noteID uint32, isAuth bool) string {
+	return fmt.Sprintf("%snote:%d:%s", cacheKeyPrefix, noteID, cacheView(isAuth))
+}
+
+// all pages of a notes list are kept in one hash, so that they can be dropped at once
+func notesCacheKey(tagID uint32) string {
+	return fmt.Sprintf("%snotes:%d", cacheKeyPrefix, tagID)
+}
+
+func notesCacheField(filterIns *notesFilterObj, pageNo uint32, isAuth bool) string {
+	return fmt.Sprintf("%s:%d:%s", cacheView(isAuth), pageNo, notesFilterKey(filterIns))
+}
+
+func notesCursorCacheField(filterIns *notesFilterObj, cursor string, isAuth bool) string {
+	return fmt.Sprintf("%s:cursor:%s:%s", cacheView(isAuth), cursor, notesFilterKey(filterIns))
+}
+
+func tagsCacheKey() string {
+	return cacheKeyPrefix + "tags"
+}
+
+// ------------------------------------------------------------------
+
+// getCache unmarshals the cached value into v, redis errors are treated as cache misses
+func getCache(key string, field string, v interface{}) bool {
+	if !isCacheEnabled() {
+		return false
+	}
+
+	var val string
+	var err error
+	if field == "" {
+		val, err = RDS.Get(key).Result()
+	} else {
+		val, err = RDS.HGet(key, field).Result()
+	}
+	if err != nil {
+		if err != redis.Nil {
+			log.Logger.WithField("key", key).WithField("err", err).Warn("get cache failed")
+		}
+		return false
+	}
+
+	if err := json.Unmarshal([]byte(val), v); err != nil {
+		log.Logger.WithField("key", key).WithField("err", err).Warn("decode cache failed")
+		return false
+	}
+	return true
+}
+
+func setCache(key string, field string, v interface{}) {
+	if !isCacheEnabled() {
+		return
+	}
+
+	val, err := json.Marshal(v)
+	if err != nil {
+		log.Logger.WithField("key", key).WithField("err", err).Warn("encode cache failed")
+		return
+	}
+
+	if field == "" {
+		err = RDS.Set(key, val, cacheTTL()).Err()
+	} else {
+		_, err = RDS.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(key, field, val)
+			pipe.Expire(key, cacheTTL())
+			return nil
+		})
+	}
+	if err != nil {
+		log.Logger.WithField("key", key).WithField("err", err).Warn("set cache failed")
+	}
+}
+
+func deleteCache(keys ...string) {
+	if !isCacheEnabled() || len(keys) <= 0 {
+		return
+	}
+	if err := RDS.Del(keys...).Err(); err != nil {
+		log.Logger.WithField("keys", keys).WithField("err", err).Warn("delete cache failed")
+	}
+}
+
+// invalidateNoteCaches drops the given notes, the notes lists of the given tags and the full list,
+// and the tag tree whose counts may have changed
+func invalidateNoteCaches(noteIDs []uint32, tagIDs []uint32) {
+	keys := []string{tagsCacheKey(), notesCacheKey(0)}
+	for _, noteID := range noteIDs {
+		keys = append(keys, noteCacheKey(noteID, true), noteCacheKey(noteID, false))
+	}
+	for _, tagID := range tagIDs {
+		keys = append(keys, notesCacheKey(tagID))
+	}
+	deleteCache(keys...)
+}
+
+// invalidateAllCaches is used when tags are renamed or merged, which changes the tags of many notes
+func invalidateAllCaches() {
+	if !isCacheEnabled() {
+		return
+	}
+
+	var cursor uint64
+	for {
+		keys, next, err := RDS.Scan(cursor, cacheKeyPrefix+"*", 100).Result()
+		if err != nil {
+			log.Logger.WithField("err", err).Warn("scan cache failed")
+			return
+		}
+		deleteCache(keys...)
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+// selectCacheDependencies returns the notes rendered with the title of the note, i.e. itself and its backlinks,
+// which include the notes referencing it by the "note" shortcode, and the tags whose notes lists contain it
+func selectCacheDependencies(cursor cursorObj, noteID uint32) ([]uint32, []uint32, error) {
+	noteIDs := []uint32{noteID}
+	linksIns, err := selectBacklinksByNoteID(cursor, noteID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, linkIns := range linksIns {
+		noteIDs = append(noteIDs, linkIns.NoteID)
+	}
+
+	tagIDs, err := selectAncestorTagIDsByNoteID(cursor, noteID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return noteIDs, tagIDs, nil
+}
@@ -14,6 +14,36 @@ const tokenKey = "notebook:token"
 
 const tokenExpire = 3600 * 24 * 3
 
+const cacheKeyPrefix = "notebook:cache:"
+
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+const digestEllipsis = "…"
+
+const saveStage = "on_save"
+
+const readStage = "on_read"
+
+const cursorMode = "cursor"
+
+const dateLayout = "2006-01-02"
+
+const sortUpdated = "updated"
+
+const orderAsc = "asc"
+
+const orderDesc = "desc"
+
+const tagModeAnd = "and"
+
+const tagModeOr = "or"
+
+const visibilityAll = "all"
+
+const visibilityPublic = "public"
+
+const visibilityPrivate = "private"
+
 // ------------------------------------------------------------------
 
 const defaultError = -1
@@ -44,8 +74,42 @@ const updateNoteError = -2003
 
 const deleteNoteError = -2004
 
+const shortcodeError = -2005
+
+const getNoteGraphError = -2006
+
 const getTagsError = -2010
 
+const renameTagError = -2011
+
+const mergeTagsError = -2012
+
+const updateTagError = -2013
+
+const createSeriesError = -2020
+
+const updateSeriesError = -2021
+
+const deleteSeriesError = -2022
+
+const getSeriesError = -2023
+
+const getSeriesListError = -2024
+
+const getArchiveError = -2030
+
+const getCalendarError = -2031
+
+const getOnThisDayError = -2032
+
+const uploadAttachmentError = -2050
+
+const getAttachmentError = -2051
+
+const attachmentTooLargeError = -2052
+
+const attachmentTypeError = -2053
+
 // ------------------------------------------------------------------
 
 var methodNotAllowErr = errors.New("method not allow")
@@ -55,3 +119,23 @@ var notAuthErr = errors.New("not auth")
 var paramsErr = errors.New("params error")
 
 var noteNotExistsErr = errors.New("notes does not exists")
+
+var tagNotExistsErr = errors.New("tag does not exists")
+
+var tagExistsErr = errors.New("tag already exists")
+
+var seriesNotExistsErr = errors.New("series does not exists")
+
+var backupVersionErr = errors.New("backup version not supported")
+
+var backupCorruptedErr = errors.New("backup corrupted")
+
+var restoreNotEmptyErr = errors.New("database is not empty")
+
+var attachmentNotExistsErr = errors.New("attachment does not exists")
+
+var attachmentTooLargeErr = errors.New("attachment too large")
+
+var attachmentTypeErr = errors.New("attachment type not allowed")
+
+var blobNotExistsErr = errors.New("blob does not exists")
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var moreMarkerRegexp = regexp.MustCompile(`<!--\s*more\s*-->`)
+
+// block level elements are separated by whitespace when extracting plain text,
+// otherwise "<p>hello</p><p>world</p>" becomes "helloworld"
+var blockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true, "dd": true, "div": true,
+	"dl": true, "dt": true, "figcaption": true, "figure": true, "footer": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true, "hr": true, "li": true, "ol": true,
+	"p": true, "pre": true, "section": true, "table": true, "td": true, "th": true, "tr": true, "ul": true,
+}
+
+// tags and attributes kept in the html excerpt, everything else is unwrapped
+var excerptAllowedTags = map[string][]string{
+	"a": {"href", "title"}, "b": nil, "blockquote": nil, "br": nil, "code": nil, "em": nil, "i": nil,
+	"img": {"src", "alt", "title"}, "li": nil, "ol": nil, "p": nil, "pre": nil, "strong": nil, "ul": nil,
+}
+
+// tags dropped from the html excerpt together with their children
+var excerptDroppedTags = map[string]bool{
+	"embed": true, "form": true, "iframe": true, "object": true, "script": true, "style": true, "title": true,
+}
+
+// ------------------------------------------------------------------
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r) || (r >= 0x3000 && r <= 0x303f) || (r >= 0xff00 && r <= 0xffef)
+}
+
+// joinTextFields joins fields with a single space, except between two CJK characters
+func joinTextFields(fields []string) string {
+	var sb strings.Builder
+	var last rune
+	for i, field := range fields {
+		runes := []rune(field)
+		if i > 0 && !(isCJK(last) && isCJK(runes[0])) {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(field)
+		last = runes[len(runes)-1]
+	}
+	return sb.String()
+}
+
+func writeNodeText(sb *strings.Builder, node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		sb.WriteString(node.Data)
+		return
+	case html.CommentNode:
+		return
+	case html.ElementNode:
+		if excerptDroppedTags[node.Data] {
+			return
+		}
+	}
+
+	isBlock := node.Type == html.ElementNode && blockTags[node.Data]
+	if isBlock {
+		sb.WriteString(" ")
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writeNodeText(sb, child)
+	}
+	if isBlock {
+		sb.WriteString(" ")
+	}
+}
+
+// countWords counts every CJK character as one word and every run of other letters or digits as one word
+func countWords(plainText string) uint32 {
+	var words uint32
+	inWord := false
+	for _, r := range plainText {
+		if isCJK(r) {
+			if unicode.IsLetter(r) || unicode.IsNumber(r) {
+				words++
+			}
+			inWord = false
+		} else if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if !inWord {
+				words++
+			}
+			inWord = true
+		} else if r != '\'' && r != '-' {
+			inWord = false
+		}
+	}
+	return words
+}
+
+// splitMoreMarker returns the content before the "<!--more-->" marker, if there is one
+func splitMoreMarker(content string) (string, bool) {
+	loc := moreMarkerRegexp.FindStringIndex(content)
+	if loc == nil {
+		return content, false
+	}
+	return content[:loc[0]], true
+}
+
+func isSentenceEnd(runes []rune, i int) bool {
+	switch runes[i] {
+	case '。', '！', '？', '；', '…':
+		return true
+	case '.', '!', '?', ';':
+		// "3.14" and "e.g" are not the end of a sentence
+		return i+1 >= len(runes) || unicode.IsSpace(runes[i+1]) || isCJK(runes[i+1])
+	}
+	return false
+}
+
+// cutPlainText cuts plain text to at most length runes, preferring to end at a sentence boundary
+// and never splitting a latin word unless the word is longer than half of the digest
+func cutPlainText(plainText string, length int) string {
+	runes := []rune(plainText)
+	if length <= 0 || len(runes) <= length {
+		return plainText
+	}
+
+	for i := length - 1; i >= length/2; i-- {
+		if isSentenceEnd(runes, i) {
+			return string(runes[:i+1])
+		}
+	}
+
+	end := length
+	isWordRune := func(r rune) bool {
+		return !unicode.IsSpace(r) && !isCJK(r)
+	}
+	if isWordRune(runes[end-1]) && isWordRune(runes[end]) {
+		for i := end - 1; i >= length/2; i-- {
+			if !isWordRune(runes[i]) {
+				end = i + 1
+				break
+			}
+		}
+	}
+
+	return strings.TrimRightFunc(string(runes[:end]), unicode.IsSpace) + digestEllipsis
+}
+
+func isSafeURL(rawURL string) bool {
+	lower := strings.ToLower(strings.TrimSpace(rawURL))
+	if lower == "" {
+		return false
+	}
+	if i := strings.IndexAny(lower, ":/?#"); i >= 0 && lower[i] == ':' {
+		return strings.HasPrefix(lower, "http:") || strings.HasPrefix(lower, "https:") ||
+			strings.HasPrefix(lower, "mailto:")
+	}
+	return true
+}
+
+func writeSanitizedNode(sb *strings.Builder, node *html.Node, imgWritten *bool) {
+	switch node.Type {
+	case html.TextNode:
+		sb.WriteString(html.EscapeString(node.Data))
+		return
+	case html.CommentNode:
+		return
+	case html.ElementNode:
+		if excerptDroppedTags[node.Data] {
+			return
+		}
+	}
+
+	allowedAttrs, allowed := excerptAllowedTags[node.Data]
+	if node.Type != html.ElementNode || !allowed {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			writeSanitizedNode(sb, child, imgWritten)
+		}
+		return
+	}
+
+	if node.Data == "img" {
+		if *imgWritten || !isSafeURL(attrValue(node, "src")) {
+			return
+		}
+		*imgWritten = true
+	}
+
+	sb.WriteString("<" + node.Data)
+	for _, attr := range node.Attr {
+		if !containsString(allowedAttrs, attr.Key) {
+			continue
+		}
+		if (attr.Key == "href" || attr.Key == "src") && !isSafeURL(attr.Val) {
+			continue
+		}
+		sb.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+	}
+	sb.WriteString(">")
+
+	if node.Data == "img" || node.Data == "br" {
+		return
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writeSanitizedNode(sb, child, imgWritten)
+	}
+	sb.WriteString("</" + node.Data + ">")
+}
+
+func attrValue(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func containsString(strs []string, target string) bool {
+	for _, str := range strs {
+		if str == target {
+			return true
+		}
+	}
+	return false
+}
+
+func firstImageHTML(content string) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	imgWritten := false
+	doc.Find("img").EachWithBreak(func(i int, img *goquery.Selection) bool {
+		writeSanitizedNode(&sb, img.Get(0), &imgWritten)
+		return !imgWritten
+	})
+	return sb.String(), nil
+}
+
+// makeHTMLExcerpt returns the sanitized html before the "<!--more-->" marker,
+// or the digest wrapped in a paragraph if there is no marker, led by the first image of the note
+func makeHTMLExcerpt(content string, digest string) (string, error) {
+	var sb strings.Builder
+	imgWritten := false
+
+	excerpt, hasMore := splitMoreMarker(content)
+	if hasMore {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(excerpt))
+		if err != nil {
+			return "", err
+		}
+		for _, node := range doc.Nodes {
+			writeSanitizedNode(&sb, node, &imgWritten)
+		}
+	} else {
+		sb.WriteString("<p>" + html.EscapeString(digest) + "</p>")
+	}
+
+	if imgWritten {
+		return sb.String(), nil
+	}
+	img, err := firstImageHTML(content)
+	if err != nil {
+		return "", err
+	}
+	return img + sb.String(), nil
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/speed18/d18-notebook/log"
+	"go.yaml.in/yaml/v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const exportManifestName = ".export-manifest.json"
+
+// version of the layout of the markdown archive, bumped when it changes incompatibly
+const markdownArchiveVersion = 1
+
+// ------------------------------------------------------------------
+
+// exportManifestObj records the sha256 of every note page written by the last export, so that unchanged pages
+// are not written again. A page shows the titles of linked notes, tags, the theme..., so it is the rendered
+// body which is compared rather than the update time of the note
+type exportManifestObj struct {
+	Notes map[uint32]string `json:"notes"`
+}
+
+type exportStatsObj struct {
+	Notes   int
+	Written int
+	Removed int
+	Pages   int
+}
+
+type markdownFrontMatterObj struct {
+	ID        uint32   `yaml:"id"`
+	Title     string   `yaml:"title"`
+	Author    string   `yaml:"author"`
+	Tags      []string `yaml:"tags"`
+	Private   bool     `yaml:"private"`
+	Slug      string   `yaml:"slug,omitempty"`
+	CreatedAt string   `yaml:"created_at"`
+	UpdatedAt string   `yaml:"updated_at"`
+}
+
+type markdownManifestObj struct {
+	Version    int                       `json:"version"`
+	ExportedAt string                    `json:"exported_at"`
+	Notes      []markdownManifestNoteObj `json:"notes"`
+	Tags       []tagObj                  `json:"tags"`
+}
+
+type markdownManifestNoteObj struct {
+	ID      uint32 `json:"id"`
+	Title   string `json:"title"`
+	File    string `json:"file"`
+	Private bool   `json:"private"`
+	SHA256  string `json:"sha256"`
+}
+
+// ------------------------------------------------------------------
+
+// writeStaticFile writes the page of the url path, "/note/1" goes to "note/1/index.html" and "/feed.xml" to "feed.xml"
+func writeStaticFile(dir string, urlPath string, body []byte) error {
+	filename := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(urlPath, "/")))
+	if path.Ext(urlPath) == "" {
+		filename = filepath.Join(filename, "index.html")
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, body, 0644)
+}
+
+func readExportManifest(dir string) exportManifestObj {
+	manifestIns := exportManifestObj{Notes: map[uint32]string{}}
+	data, err := ioutil.ReadFile(filepath.Join(dir, exportManifestName))
+	if err != nil {
+		return manifestIns
+	}
+	if err := json.Unmarshal(data, &manifestIns); err != nil || manifestIns.Notes == nil {
+		log.Logger.WithField("err", err).Warn("bad export manifest, export everything")
+		return exportManifestObj{Notes: map[uint32]string{}}
+	}
+	return manifestIns
+}
+
+// exportListing writes every page of a listing, and returns the number of pages
+func exportListing(dir string, tagID uint32) (int, error) {
+	dataIns, err := notesPageData(1, tagID, true, "")
+	if err != nil {
+		return 0, err
+	}
+	for pageNo := uint32(1); ; pageNo++ {
+		if pageNo > 1 {
+			if dataIns, err = notesPageData(pageNo, tagID, true, ""); err != nil {
+				return 0, err
+			}
+		}
+		dataIns.Static = true
+		body, err := renderPage("notes.html", dataIns)
+		if err != nil {
+			return 0, err
+		}
+		if err := writeStaticFile(dir, pageLink(dataIns.BasePath, pageNo), body); err != nil {
+			return 0, err
+		}
+		if pageNo >= dataIns.Page.Total {
+			return int(pageNo), nil
+		}
+	}
+}
+
+func flattenTags(tagsInsPtr []*tagObj) []*tagObj {
+	var flat []*tagObj
+	for _, tagInsPtr := range tagsInsPtr {
+		flat = append(flat, tagInsPtr)
+		flat = append(flat, flattenTags(tagInsPtr.Children)...)
+	}
+	return flat
+}
+
+// ExportStatic writes a read only mirror of the public notes into dir: note pages, listings, tag pages,
+// feeds and the sitemap. Note pages rendered the same as in the last export are not written again
+// unless full is set, everything else is cheap and always written again
+func ExportStatic(dir string, full bool) (exportStatsObj, error) {
+	var statsIns exportStatsObj
+
+	manifestIns := readExportManifest(dir)
+
+	// ------ note pages
+	notesIns, err := selectSitemapNotes(DB, nil, 0, ^uint32(0), true)
+	if err != nil {
+		return statsIns, err
+	}
+	statsIns.Notes = len(notesIns)
+	exported := map[uint32]string{}
+	for _, noteIns := range notesIns {
+		dataIns, _, err := notePageData(strconv.FormatUint(uint64(noteIns.ID), 10), "")
+		if err != nil {
+			return statsIns, err
+		}
+		dataIns.Static = true
+		body, err := renderPage("note.html", dataIns)
+		if err != nil {
+			return statsIns, err
+		}
+
+		sum := sha256.Sum256(body)
+		exported[noteIns.ID] = hex.EncodeToString(sum[:])
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(noteLink(noteIns.ID)), "index.html")); err == nil &&
+			!full && manifestIns.Notes[noteIns.ID] == exported[noteIns.ID] {
+			continue
+		}
+		if err := writeStaticFile(dir, noteLink(noteIns.ID), body); err != nil {
+			return statsIns, err
+		}
+		statsIns.Written++
+	}
+
+	// notes deleted or made private since the last export
+	for noteID := range manifestIns.Notes {
+		if _, ok := exported[noteID]; ok {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, filepath.FromSlash(noteLink(noteID)))); err != nil {
+			return statsIns, err
+		}
+		statsIns.Removed++
+	}
+
+	// ------ listings and tag pages, old pages may be out of range now
+	for _, sub := range []string{"page", "tag"} {
+		if err := os.RemoveAll(filepath.Join(dir, sub)); err != nil {
+			return statsIns, err
+		}
+	}
+	pages, err := exportListing(dir, 0)
+	if err != nil {
+		return statsIns, err
+	}
+	statsIns.Pages += pages
+
+	tagsInsPtr, err := getTags()
+	if err != nil {
+		return statsIns, err
+	}
+	for _, tagInsPtr := range flattenTags(tagsInsPtr) {
+		// virtual ancestors have no pages
+		if tagInsPtr.ID == 0 {
+			continue
+		}
+		pages, err := exportListing(dir, tagInsPtr.ID)
+		if err != nil {
+			return statsIns, err
+		}
+		statsIns.Pages += pages
+	}
+
+	// ------ feeds, sitemap and robots.txt
+	feedIns, err := getFeed(0)
+	if err != nil {
+		return statsIns, err
+	}
+	rss, err := makeRSS(feedIns)
+	if err != nil {
+		return statsIns, err
+	}
+	atom, err := makeAtom(feedIns, absoluteURL("/atom.xml"))
+	if err != nil {
+		return statsIns, err
+	}
+	jsonFeed, err := makeJSONFeed(feedIns, absoluteURL("/feed.json"))
+	if err != nil {
+		return statsIns, err
+	}
+
+	sitemapPath := "/sitemap-%d.xml"
+	sitemap, err := makeSitemap(0, sitemapPath)
+	if err != nil {
+		return statsIns, err
+	}
+	docs := map[string][]byte{"/feed.xml": rss, "/atom.xml": atom, "/feed.json": jsonFeed,
+		"/sitemap.xml": sitemap, "/robots.txt": makeRobots()}
+	sitemapPages, err := sitemapPagesCount()
+	if err != nil {
+		return statsIns, err
+	}
+	for page := uint32(1); sitemapPages > 1 && page <= sitemapPages; page++ {
+		if docs[fmt.Sprintf(sitemapPath, page)], err = makeSitemap(page, sitemapPath); err != nil {
+			return statsIns, err
+		}
+	}
+	for urlPath, body := range docs {
+		if err := writeStaticFile(dir, urlPath, body); err != nil {
+			return statsIns, err
+		}
+	}
+
+	// ------ manifest, written last so that a failed export is retried in full
+	data, err := json.MarshalIndent(exportManifestObj{Notes: exported}, "", "  ")
+	if err != nil {
+		return statsIns, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, exportManifestName), data, 0644); err != nil {
+		return statsIns, err
+	}
+
+	log.Logger.WithField("stats", statsIns).Info("done exporting static site")
+	return statsIns, nil
+}
+
+// ------------------------------------------------------------------
+
+func markdownFilename(noteIns *noteObj) string {
+	if noteIns.Slug == "" {
+		return fmt.Sprintf("notes/%d.md", noteIns.ID)
+	}
+	return fmt.Sprintf("notes/%d-%s.md", noteIns.ID, noteIns.Slug)
+}
+
+func formatExportTime(value string) string {
+	t := parseDBTime(value)
+	if t.IsZero() {
+		return value
+	}
+	return t.Format(time.RFC3339)
+}
+
+// makeMarkdownNote returns a note as markdown led by yaml front matter
+func makeMarkdownNote(noteIns *noteObj) ([]byte, error) {
+	frontMatterIns := markdownFrontMatterObj{ID: noteIns.ID, Title: noteIns.Title, Author: noteIns.Author,
+		Tags: make([]string, 0), Private: noteIns.Private, Slug: noteIns.Slug,
+		CreatedAt: formatExportTime(noteIns.CreatedAt), UpdatedAt: formatExportTime(noteIns.UpdateAt)}
+	for _, tagIns := range noteIns.Tags {
+		frontMatterIns.Tags = append(frontMatterIns.Tags, tagIns.Name)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(frontMatterIns); err != nil {
+		return nil, err
+	}
+	markdown, err := htmlToMarkdown(noteIns.Content)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString("---\n\n" + markdown)
+	return buf.Bytes(), nil
+}
+
+// ExportMarkdown writes a zip archive of all the notes, private ones included, to w: one markdown file per note
+// under "notes/" and a "manifest.json" listing the notes and the tags
+func ExportMarkdown(w io.Writer) (markdownManifestObj, error) {
+	manifestIns := markdownManifestObj{Version: markdownArchiveVersion, ExportedAt: time.Now().Format(time.RFC3339),
+		Notes: make([]markdownManifestNoteObj, 0)}
+
+	var notesInsPtr []*noteObj
+	// read in one transaction, so that the notes and the tags agree
+	_, err := withTransaction(func(cursor cursorObj) (interface{}, error) {
+		filterIns := &notesFilterObj{Visibility: visibilityAll, Sort: "created", Order: orderAsc}
+		var err error
+		if notesInsPtr, err = selectNotesByFilter(cursor, filterIns, nil, 0, ^uint32(0), true); err != nil {
+			return nil, err
+		}
+		manifestIns.Tags, err = selectTagsWithNotesCount(cursor, true)
+		return nil, err
+	})
+	if err != nil {
+		return manifestIns, err
+	}
+
+	zipWriter := zip.NewWriter(w)
+	for _, noteInsPtr := range notesInsPtr {
+		data, err := makeMarkdownNote(noteInsPtr)
+		if err != nil {
+			return manifestIns, err
+		}
+		filename := markdownFilename(noteInsPtr)
+		header := &zip.FileHeader{Name: filename, Method: zip.Deflate, Modified: parseDBTime(noteInsPtr.UpdateAt)}
+		fileWriter, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return manifestIns, err
+		}
+		if _, err := fileWriter.Write(data); err != nil {
+			return manifestIns, err
+		}
+
+		sum := sha256.Sum256(data)
+		manifestIns.Notes = append(manifestIns.Notes, markdownManifestNoteObj{ID: noteInsPtr.ID, Title: noteInsPtr.Title,
+			File: filename, Private: noteInsPtr.Private, SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	data, err := json.MarshalIndent(manifestIns, "", "  ")
+	if err != nil {
+		return manifestIns, err
+	}
+	fileWriter, err := zipWriter.Create("manifest.json")
+	if err != nil {
+		return manifestIns, err
+	}
+	if _, err := fileWriter.Write(data); err != nil {
+		return manifestIns, err
+	}
+	if err := zipWriter.Close(); err != nil {
+		return manifestIns, err
+	}
+
+	log.Logger.WithField("notes", len(manifestIns.Notes)).Info("done exporting markdown")
+	return manifestIns, nil
+}
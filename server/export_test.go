@@ -0,0 +1,99 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportStaticRewritesChangedPages(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{
+		"page.template_dir":    filepath.Join("..", "template", "default"),
+		"page.reload":          true,
+		"plugin.on_read":       []string{"wiki_link"},
+		"note.link_format":     "/note/%d",
+		"pagination.page_size": 5,
+		"pagination.win_size":  9,
+		"cache.enabled":        false,
+		"server.base_url":      "http://127.0.0.1:13000",
+		"note.feed_size":       20,
+	})
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text)
+					values (1, 'One', 'me', '<p>see [[#2]]</p>', 'see'), (2, 'Two', 'me', '<p>two</p>', 'two')`)
+	mustExec(t, db, `insert into notebook.note_link (src_note_id, target, dst_note_id) values (1, '#2', 2)`)
+
+	dir := t.TempDir()
+	statsIns, err := ExportStatic(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statsIns.Notes != 2 || statsIns.Written != 2 {
+		t.Errorf("first export %+v", statsIns)
+	}
+
+	statsIns, err = ExportStatic(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statsIns.Written != 0 {
+		t.Errorf("export of unchanged notes %+v", statsIns)
+	}
+
+	// note 1 shows the title of note 2, its own update time does not change
+	mustExec(t, db, "update notebook.note set title = 'Renamed' where id = 2")
+	statsIns, err = ExportStatic(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statsIns.Written != 2 {
+		t.Errorf("export after renaming note 2 %+v", statsIns)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "note", "1", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "Renamed") {
+		t.Errorf("note 1 page not rewritten:\n%s", data)
+	}
+
+	statsIns, err = ExportStatic(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statsIns.Written != 2 {
+		t.Errorf("full export %+v", statsIns)
+	}
+}
+
+func TestExportMarkdownAPIStreams(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text, slug)
+					values (1, 'One', 'me', '<p>one</p>', 'one', 'one')`)
+
+	resp := httptest.NewRecorder()
+	makeHandler(exportMarkdownAPI)(resp, httptest.NewRequest(http.MethodGet, "/api/v2/export/markdown", nil))
+
+	if contentType := resp.Header().Get("Content-Type"); contentType != "application/zip" {
+		t.Fatalf("content type %q, body %s", contentType, resp.Body)
+	}
+	if !strings.HasPrefix(resp.Header().Get("Content-Disposition"), "attachment;") {
+		t.Errorf("content disposition %q", resp.Header().Get("Content-Disposition"))
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range zipReader.File {
+		names = append(names, file.Name)
+	}
+	if strings.Join(names, ",") != "notes/1-one.md,manifest.json" {
+		t.Errorf("files %v", names)
+	}
+}
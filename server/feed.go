@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const feedModeFull = "full"
+
+const jsonFeedVersion = "https://jsonfeed.org/version/1.1"
+
+const atomNamespace = "http://www.w3.org/2005/Atom"
+
+// ------------------------------------------------------------------
+
+type rssObj struct {
+	XMLName xml.Name      `xml:"rss"`
+	Version string        `xml:"version,attr"`
+	Channel rssChannelObj `xml:"channel"`
+}
+
+type rssChannelObj struct {
+	Title         string       `xml:"title"`
+	Link          string       `xml:"link"`
+	Description   string       `xml:"description"`
+	LastBuildDate string       `xml:"lastBuildDate,omitempty"`
+	Items         []rssItemObj `xml:"item"`
+}
+
+type rssItemObj struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        string   `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Description string   `xml:"description"`
+	Categories  []string `xml:"category"`
+}
+
+type atomFeedObj struct {
+	XMLName xml.Name       `xml:"feed"`
+	Xmlns   string         `xml:"xmlns,attr"`
+	Title   string         `xml:"title"`
+	ID      string         `xml:"id"`
+	Updated string         `xml:"updated"`
+	Links   []atomLinkObj  `xml:"link"`
+	Entries []atomEntryObj `xml:"entry"`
+}
+
+type atomLinkObj struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomTextObj struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomAuthorObj struct {
+	Name string `xml:"name"`
+}
+
+type atomCategoryObj struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntryObj struct {
+	Title      string            `xml:"title"`
+	ID         string            `xml:"id"`
+	Link       atomLinkObj       `xml:"link"`
+	Published  string            `xml:"published"`
+	Updated    string            `xml:"updated"`
+	Author     atomAuthorObj     `xml:"author"`
+	Summary    *atomTextObj      `xml:"summary,omitempty"`
+	Content    *atomTextObj      `xml:"content,omitempty"`
+	Categories []atomCategoryObj `xml:"category"`
+}
+
+type jsonFeedObj struct {
+	Version     string            `json:"version"`
+	Title       string            `json:"title"`
+	HomePageURL string            `json:"home_page_url"`
+	FeedURL     string            `json:"feed_url"`
+	Description string            `json:"description,omitempty"`
+	Items       []jsonFeedItemObj `json:"items"`
+}
+
+type jsonFeedAuthorObj struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItemObj struct {
+	ID            string              `json:"id"`
+	URL           string              `json:"url"`
+	Title         string              `json:"title"`
+	ContentHTML   string              `json:"content_html,omitempty"`
+	ContentText   string              `json:"content_text,omitempty"`
+	Summary       string              `json:"summary,omitempty"`
+	DatePublished string              `json:"date_published"`
+	DateModified  string              `json:"date_modified"`
+	Authors       []jsonFeedAuthorObj `json:"authors"`
+	Tags          []string            `json:"tags,omitempty"`
+}
+
+// feedObj is what the three formats are generated from
+type feedObj struct {
+	Title       string
+	Description string
+	Link        string
+	Notes       []*noteObj
+	Updated     time.Time
+}
+
+// Updated does not change when a note of the feed is deleted, so the feed is validated by ETag only
+func (f feedObj) lastModified() time.Time {
+	return time.Time{}
+}
+
+func (f feedObj) hasPrivateNote() bool {
+	return false
+}
+
+// ------------------------------------------------------------------
+
+func absoluteURL(path string) string {
+	return strings.TrimRight(viper.GetString("server.base_url"), "/") + path
+}
+
+func isFullFeed() bool {
+	return viper.GetString("note.feed_mode") == feedModeFull
+}
+
+// getFeed returns the newest public notes, of the tag if tagID is not 0. Notes are rendered in full mode,
+// and cut to digests otherwise
+func getFeed(tagID uint32) (*feedObj, error) {
+	feedIns := &feedObj{
+		Title:       viper.GetString("note.feed_title"),
+		Description: viper.GetString("note.feed_description"),
+		Link:        absoluteURL("/"),
+	}
+
+	filterIns := notesFilterObj{Visibility: visibilityPublic, Sort: "created", Order: orderDesc}
+	if tagID != 0 {
+		tagsIns, err := selectTagsByID(DB, true, false, tagID)
+		if err != nil {
+			return nil, err
+		}
+		if len(tagsIns) <= 0 {
+			return nil, tagNotExistsErr
+		}
+		feedIns.Title += " - " + tagsIns[0].Name
+		filterIns.Tags = []uint32{tagID}
+	}
+	if err := normalizeNotesFilter(&filterIns); err != nil {
+		return nil, err
+	}
+
+	notesInsPtr, err := selectNotesByFilter(DB, &filterIns, nil, 0, viper.GetUint32("note.feed_size"), true)
+	if err != nil {
+		return nil, err
+	}
+	for _, noteInsPtr := range notesInsPtr {
+		if isFullFeed() || viper.GetBool("note.html_excerpt") {
+			renderNote(DB, noteInsPtr, false)
+		}
+		if !isFullFeed() {
+			cutNote(noteInsPtr)
+		}
+		if updated := parseDBTime(noteInsPtr.UpdateAt); updated.After(feedIns.Updated) {
+			feedIns.Updated = updated
+		}
+	}
+	feedIns.Notes = notesInsPtr
+	return feedIns, nil
+}
+
+// feedBody returns the full content in full mode, and the html excerpt or the plain digest otherwise
+func feedBody(noteInsPtr *noteObj) (string, bool) {
+	if isFullFeed() {
+		return noteInsPtr.Content, true
+	}
+	if noteInsPtr.Excerpt != "" {
+		return noteInsPtr.Excerpt, true
+	}
+	return noteInsPtr.PlainText, false
+}
+
+func makeRSS(feedIns *feedObj) ([]byte, error) {
+	rssIns := rssObj{Version: "2.0", Channel: rssChannelObj{
+		Title: feedIns.Title, Link: feedIns.Link, Description: feedIns.Description,
+	}}
+	if !feedIns.Updated.IsZero() {
+		rssIns.Channel.LastBuildDate = feedIns.Updated.Format(time.RFC1123Z)
+	}
+	for _, noteInsPtr := range feedIns.Notes {
+		link := absoluteURL(noteLink(noteInsPtr.ID))
+		body, _ := feedBody(noteInsPtr)
+		itemIns := rssItemObj{
+			Title: noteInsPtr.Title, Link: link, GUID: link, Description: body,
+			PubDate: parseDBTime(noteInsPtr.CreatedAt).Format(time.RFC1123Z),
+		}
+		for _, tagIns := range noteInsPtr.Tags {
+			itemIns.Categories = append(itemIns.Categories, tagIns.Name)
+		}
+		rssIns.Channel.Items = append(rssIns.Channel.Items, itemIns)
+	}
+
+	return marshalXML(rssIns)
+}
+
+func makeAtom(feedIns *feedObj, selfURL string) ([]byte, error) {
+	atomIns := atomFeedObj{
+		Xmlns: atomNamespace, Title: feedIns.Title, ID: selfURL, Updated: feedIns.Updated.Format(time.RFC3339),
+		Links: []atomLinkObj{{Rel: "self", Href: selfURL}, {Rel: "alternate", Href: feedIns.Link}},
+	}
+	for _, noteInsPtr := range feedIns.Notes {
+		link := absoluteURL(noteLink(noteInsPtr.ID))
+		entryIns := atomEntryObj{
+			Title: noteInsPtr.Title, ID: link, Link: atomLinkObj{Rel: "alternate", Href: link},
+			Published: parseDBTime(noteInsPtr.CreatedAt).Format(time.RFC3339),
+			Updated:   parseDBTime(noteInsPtr.UpdateAt).Format(time.RFC3339),
+			Author:    atomAuthorObj{Name: noteInsPtr.Author},
+		}
+		body, isHTML := feedBody(noteInsPtr)
+		textType := "text"
+		if isHTML {
+			textType = "html"
+		}
+		if isFullFeed() {
+			entryIns.Content = &atomTextObj{Type: textType, Text: body}
+		} else {
+			entryIns.Summary = &atomTextObj{Type: textType, Text: body}
+		}
+		for _, tagIns := range noteInsPtr.Tags {
+			entryIns.Categories = append(entryIns.Categories, atomCategoryObj{Term: tagIns.Name})
+		}
+		atomIns.Entries = append(atomIns.Entries, entryIns)
+	}
+
+	return marshalXML(atomIns)
+}
+
+func makeJSONFeed(feedIns *feedObj, selfURL string) ([]byte, error) {
+	jsonFeedIns := jsonFeedObj{
+		Version: jsonFeedVersion, Title: feedIns.Title, HomePageURL: feedIns.Link, FeedURL: selfURL,
+		Description: feedIns.Description, Items: make([]jsonFeedItemObj, 0),
+	}
+	for _, noteInsPtr := range feedIns.Notes {
+		link := absoluteURL(noteLink(noteInsPtr.ID))
+		itemIns := jsonFeedItemObj{
+			ID: link, URL: link, Title: noteInsPtr.Title,
+			DatePublished: parseDBTime(noteInsPtr.CreatedAt).Format(time.RFC3339),
+			DateModified:  parseDBTime(noteInsPtr.UpdateAt).Format(time.RFC3339),
+			Authors:       []jsonFeedAuthorObj{{Name: noteInsPtr.Author}},
+		}
+		// one of content_html and content_text is required, the digest is also the summary
+		body, isHTML := feedBody(noteInsPtr)
+		if isHTML {
+			itemIns.ContentHTML = body
+		} else {
+			itemIns.ContentText = body
+		}
+		if !isFullFeed() {
+			itemIns.Summary = noteInsPtr.PlainText
+		}
+		for _, tagIns := range noteInsPtr.Tags {
+			itemIns.Tags = append(itemIns.Tags, tagIns.Name)
+		}
+		jsonFeedIns.Items = append(jsonFeedIns.Items, itemIns)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(jsonFeedIns); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// feedTagID accepts both the id and the slug of a tag in "?tag=", 0 is returned for the feed of all notes
+func feedTagID(req *http.Request) (uint32, error) {
+	tag := req.URL.Query().Get("tag")
+	if tag == "" {
+		return 0, nil
+	}
+	if tagID, err := strconv.ParseUint(tag, 10, 32); err == nil {
+		return uint32(tagID), nil
+	}
+	tagID, err := selectTagIDBySlug(DB, tag)
+	if err != nil {
+		return 0, err
+	}
+	if tagID == 0 {
+		return 0, tagNotExistsErr
+	}
+	return tagID, nil
+}
+
+func makeFeedHandler(contentType string, makeFeed func(feedIns *feedObj, selfURL string) ([]byte, error)) func(resp http.ResponseWriter, req *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		log.Logger.WithField("url", req.URL).Info("incoming request")
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(resp, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		tagID, err := feedTagID(req)
+		if err == tagNotExistsErr {
+			http.NotFound(resp, req)
+			return
+		}
+		if err != nil {
+			log.Logger.WithField("err", err).Error("get feed tag failed")
+			http.Error(resp, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		feedIns, err := getFeed(tagID)
+		if err == tagNotExistsErr {
+			http.NotFound(resp, req)
+			return
+		}
+		var body []byte
+		if err == nil {
+			body, err = makeFeed(feedIns, absoluteURL(req.URL.RequestURI()))
+		}
+		if err != nil {
+			log.Logger.WithField("err", err).Error("make feed failed")
+			http.Error(resp, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		resp.Header().Set("Content-Type", contentType)
+		if notModified := setCacheHeaders(resp, req, feedIns, body); notModified {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = resp.Write(body)
+		log.Logger.WithField("url", req.URL).Info("done processing request")
+	}
+}
+
+// ------------------------------------------------------------------
+
+var RSSFeedHandler = makeFeedHandler("application/rss+xml; charset=utf-8", func(feedIns *feedObj, selfURL string) ([]byte, error) {
+	return makeRSS(feedIns)
+})
+var AtomFeedHandler = makeFeedHandler("application/atom+xml; charset=utf-8", makeAtom)
+var JSONFeedHandler = makeFeedHandler("application/feed+json; charset=utf-8", makeJSONFeed)
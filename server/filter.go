@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notes can only be sorted by these columns, the names are used in sql directly
+var noteSortColumns = map[string]string{
+	"created": "created_at",
+	"updated": "update_at",
+	"title":   "title",
+	"words":   "words",
+}
+
+// ------------------------------------------------------------------
+
+// normalizeNotesFilter fills in the defaults and rejects unknown values, the dates "from" and "to"
+// are inclusive days in the time zone of mysql
+func normalizeNotesFilter(filterIns *notesFilterObj) error {
+	filterIns.Sort = strings.ToLower(filterIns.Sort)
+	if filterIns.Sort == "" {
+		filterIns.Sort = sortUpdated
+	}
+	if _, ok := noteSortColumns[filterIns.Sort]; !ok {
+		return paramsErr
+	}
+
+	filterIns.Order = strings.ToLower(filterIns.Order)
+	if filterIns.Order == "" {
+		filterIns.Order = orderDesc
+	}
+	if filterIns.Order != orderAsc && filterIns.Order != orderDesc {
+		return paramsErr
+	}
+
+	filterIns.TagMode = strings.ToLower(filterIns.TagMode)
+	if filterIns.TagMode == "" {
+		filterIns.TagMode = tagModeOr
+	}
+	if filterIns.TagMode != tagModeAnd && filterIns.TagMode != tagModeOr {
+		return paramsErr
+	}
+
+	filterIns.Visibility = strings.ToLower(filterIns.Visibility)
+	if filterIns.Visibility == "" {
+		filterIns.Visibility = visibilityAll
+	}
+	if filterIns.Visibility != visibilityAll && filterIns.Visibility != visibilityPublic &&
+		filterIns.Visibility != visibilityPrivate {
+		return paramsErr
+	}
+
+	var tags []uint32
+	for _, tagID := range filterIns.Tags {
+		if tagID != 0 && !containsUint32(tags, tagID) {
+			tags = append(tags, tagID)
+		}
+	}
+	filterIns.Tags = tags
+
+	filterIns.Author = strings.TrimSpace(filterIns.Author)
+
+	var from, to time.Time
+	var err error
+	if filterIns.From != "" {
+		if from, err = time.ParseInLocation(dateLayout, filterIns.From, dbLocation()); err != nil {
+			return paramsErr
+		}
+		filterIns.From = from.Format(dbTimeLayout)
+	}
+	if filterIns.To != "" {
+		if to, err = time.ParseInLocation(dateLayout, filterIns.To, dbLocation()); err != nil {
+			return paramsErr
+		}
+		filterIns.To = to.AddDate(0, 0, 1).Format(dbTimeLayout)
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return paramsErr
+	}
+
+	return nil
+}
+
+func notesSortKey(filterIns *notesFilterObj) string {
+	return filterIns.Sort + "_" + filterIns.Order
+}
+
+// notesCursorValue returns the value of the sort column of the note, as stored in the cursor
+func notesCursorValue(noteInsPtr *noteObj, sort string) string {
+	switch sort {
+	case "created":
+		return noteInsPtr.CreatedAt
+	case "title":
+		return noteInsPtr.Title
+	case "words":
+		return strconv.FormatUint(uint64(noteInsPtr.Words), 10)
+	default:
+		return noteInsPtr.UpdateAt
+	}
+}
+
+// notesFilterKey identifies the filter in cache fields
+func notesFilterKey(filterIns *notesFilterObj) string {
+	data, _ := json.Marshal(filterIns)
+	return string(data)
+}
+
+// notesCacheTagID returns the tag whose changes invalidate the notes list, every note in the list
+// has the tag unless the list is not filtered by tag or any of several tags may match
+func notesCacheTagID(filterIns *notesFilterObj) uint32 {
+	if len(filterIns.Tags) == 1 || (len(filterIns.Tags) > 1 && filterIns.TagMode == tagModeAnd) {
+		return filterIns.Tags[0]
+	}
+	return 0
+}
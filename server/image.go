@@ -0,0 +1,546 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/sync/singleflight"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const exifGPSTag = 0x8825
+
+const exifOrientationTag = 0x0112
+
+const defaultJPEGQuality = 82
+
+const defaultImageMaxPixels = 40000000
+
+// sizes of the exif value types by type id
+var exifTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// variants are encoded in the format of the original, there is no pure go webp encoder so webp becomes jpeg.
+// Gif is left alone, the animation would be lost
+var variantFormats = map[string]string{"image/jpeg": "jpg", "image/png": "png", "image/webp": "jpg"}
+
+// the same variant requested at once is generated once
+var variantGroup singleflight.Group
+
+// ------------------------------------------------------------------
+
+// imageVariantWidths returns the widths of "attachment.variant_widths" in ascending order
+func imageVariantWidths() []int {
+	var widths []int
+	for _, width := range viper.GetIntSlice("attachment.variant_widths") {
+		if width > 0 {
+			widths = append(widths, width)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+// imageMaxPixels returns the largest width * height of images which are decoded, "attachment.max_pixels".
+// A small file may still hold a huge image, which takes 4 bytes per pixel or more once decoded
+func imageMaxPixels() int64 {
+	if pixels := viper.GetInt64("attachment.max_pixels"); pixels > 0 {
+		return pixels
+	}
+	return defaultImageMaxPixels
+}
+
+func isVariantWidth(width int) bool {
+	for _, w := range imageVariantWidths() {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+func mediaTypeOf(contentType string) string {
+	return strings.TrimSpace(strings.Split(contentType, ";")[0])
+}
+
+func variantKey(sum string, width int, format string) string {
+	return fmt.Sprintf("%s-w%d.%s", sum, width, format)
+}
+
+// findExif returns the tiff data of the exif metadata in an image, as a slice of data to be edited in place,
+// and a function to call after editing, which fixes the checksum of the png chunk
+func findExif(mediaType string, data []byte) ([]byte, func()) {
+	noop := func() {}
+	switch mediaType {
+	case "image/jpeg":
+		// segments before the image data: 0xff, marker, big endian length including itself, content
+		for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+			marker := data[i+1]
+			if marker == 0xff {
+				i++
+				continue
+			}
+			if marker == 0xd8 || marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+				i += 2
+				continue
+			}
+			if marker == 0xda || marker == 0xd9 {
+				break
+			}
+			end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+			if end > len(data) {
+				break
+			}
+			if segment := data[i+4 : end]; marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment[6:], noop
+			}
+			i = end
+		}
+	case "image/png":
+		// chunks after the signature: big endian length, type, content, crc of type and content
+		for i := 8; i+12 <= len(data); {
+			end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+			if end > len(data) || end < i {
+				break
+			}
+			if string(data[i+4:i+8]) == "eXIf" {
+				chunk := data[i+4 : end-4]
+				return chunk[4:], func() { binary.BigEndian.PutUint32(data[end-4:], crc32.ChecksumIEEE(chunk)) }
+			}
+			i = end
+		}
+	case "image/webp":
+		// riff chunks after the header: type, little endian length, content padded to even length
+		for i := 12; i+8 <= len(data); {
+			size := int(binary.LittleEndian.Uint32(data[i+4:]))
+			end := i + 8 + size
+			if end > len(data) || end < i {
+				break
+			}
+			if string(data[i:i+4]) == "EXIF" {
+				return bytes.TrimPrefix(data[i+8:end], []byte("Exif\x00\x00")), noop
+			}
+			i = end + size%2
+		}
+	}
+	return nil, noop
+}
+
+// exifIFD0 returns the byte order of tiff data and the offset of its first directory
+func exifIFD0(tiff []byte) (binary.ByteOrder, uint32, bool) {
+	if len(tiff) < 8 {
+		return nil, 0, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	return order, order.Uint32(tiff[4:]), true
+}
+
+// exifEntries calls fn with the offset of every 12 bytes entry of the directory at offset
+func exifEntries(tiff []byte, order binary.ByteOrder, offset uint32, fn func(entry uint32)) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return
+	}
+	count := uint32(order.Uint16(tiff[offset:]))
+	for i := uint32(0); i < count; i++ {
+		entry := offset + 2 + i*12
+		if uint64(entry)+12 > uint64(len(tiff)) {
+			return
+		}
+		fn(entry)
+	}
+}
+
+// exifTagValue returns the value or offset field of the entry with tag in the first directory
+func exifTagValue(tiff []byte, tag uint16) (binary.ByteOrder, uint32, bool) {
+	order, ifd0, ok := exifIFD0(tiff)
+	if !ok {
+		return nil, 0, false
+	}
+	var value uint32
+	found := false
+	exifEntries(tiff, order, ifd0, func(entry uint32) {
+		if order.Uint16(tiff[entry:]) != tag {
+			return
+		}
+		found = true
+		if order.Uint16(tiff[entry+2:]) == 3 {
+			value = uint32(order.Uint16(tiff[entry+8:]))
+		} else {
+			value = order.Uint32(tiff[entry+8:])
+		}
+	})
+	return order, value, found
+}
+
+// stripExifGPS blanks the gps directory and the values it points to, leaving an empty directory behind so that
+// no other offset in the tiff data has to change. It returns whether there was location data
+func stripExifGPS(tiff []byte) bool {
+	order, offset, ok := exifTagValue(tiff, exifGPSTag)
+	if !ok || uint64(offset)+2 > uint64(len(tiff)) {
+		return false
+	}
+	exifEntries(tiff, order, offset, func(entry uint32) {
+		size := uint64(exifTypeSizes[order.Uint16(tiff[entry+2:])]) * uint64(order.Uint32(tiff[entry+4:]))
+		if valueOffset := uint64(order.Uint32(tiff[entry+8:])); size > 4 && valueOffset+size <= uint64(len(tiff)) {
+			for i := valueOffset; i < valueOffset+size; i++ {
+				tiff[i] = 0
+			}
+		}
+		for i := entry; i < entry+12; i++ {
+			tiff[i] = 0
+		}
+	})
+	// no entries, and the zeroed first entry reads as no next directory
+	order.PutUint16(tiff[offset:], 0)
+	return true
+}
+
+// stripXMP removes the xmp packets of an image, which may hold the location as well as exif does.
+// Unlike exif the packets are dropped as a whole, they are text whose offsets nothing else refers to
+func stripXMP(mediaType string, data []byte) ([]byte, bool) {
+	stripped := false
+	cut := func(start int, end int) {
+		data = append(data[:start:start], data[end:]...)
+		stripped = true
+	}
+	switch mediaType {
+	case "image/jpeg":
+		for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+			marker := data[i+1]
+			if marker == 0xff {
+				i++
+				continue
+			}
+			if marker == 0xd8 || marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+				i += 2
+				continue
+			}
+			if marker == 0xda || marker == 0xd9 {
+				break
+			}
+			end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+			if end > len(data) {
+				break
+			}
+			// the packet, and the rest of it in extended xmp segments when it does not fit
+			if segment := data[i+4 : end]; marker == 0xe1 && (bytes.HasPrefix(segment, []byte("http://ns.adobe.com/xap/1.0/\x00")) ||
+				bytes.HasPrefix(segment, []byte("http://ns.adobe.com/xmp/extension/\x00"))) {
+				cut(i, end)
+				continue
+			}
+			i = end
+		}
+	case "image/png":
+		for i := 8; i+12 <= len(data); {
+			end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+			if end > len(data) || end < i {
+				break
+			}
+			if string(data[i+4:i+8]) == "iTXt" && bytes.HasPrefix(data[i+8:end-4], []byte("XML:com.adobe.xmp\x00")) {
+				cut(i, end)
+				continue
+			}
+			i = end
+		}
+	case "image/webp":
+		for i := 12; i+8 <= len(data); {
+			size := int(binary.LittleEndian.Uint32(data[i+4:]))
+			end := i + 8 + size
+			if end > len(data) || end < i {
+				break
+			}
+			if string(data[i:i+4]) == "XMP " {
+				cut(i, end+size%2)
+				continue
+			}
+			i = end + size%2
+		}
+		if stripped {
+			binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+			// the xmp flag of the extended header
+			if len(data) >= 21 && string(data[12:16]) == "VP8X" {
+				data[20] &^= 0x04
+			}
+		}
+	}
+	return data, stripped
+}
+
+// stripImageGPS removes the location where a photo was taken from its metadata: the gps directory of exif
+// and the xmp packets, the rest is kept
+func stripImageGPS(contentType string, data []byte) []byte {
+	mediaType := mediaTypeOf(contentType)
+	data, stripped := stripXMP(mediaType, data)
+	if stripped {
+		log.Logger.Info("xmp metadata stripped")
+	}
+
+	tiff, fix := findExif(mediaType, data)
+	if tiff == nil {
+		return data
+	}
+	if stripExifGPS(tiff) {
+		fix()
+		log.Logger.Info("gps metadata stripped")
+	}
+	return data
+}
+
+// imageOrientation returns the exif orientation, 1 to 8, by which the image has to be turned for display
+func imageOrientation(contentType string, data []byte) int {
+	tiff, _ := findExif(mediaTypeOf(contentType), data)
+	if tiff == nil {
+		return 1
+	}
+	if _, value, ok := exifTagValue(tiff, exifOrientationTag); ok && value >= 1 && value <= 8 {
+		return int(value)
+	}
+	return 1
+}
+
+// imageSize returns the displayed size of an image, i.e. turned by its orientation
+func imageSize(contentType string, data []byte) (int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	if imageOrientation(contentType, data) >= 5 {
+		return config.Height, config.Width, nil
+	}
+	return config.Width, config.Height, nil
+}
+
+// orientImage turns an image as its exif orientation says, 5 to 8 swap width and height
+func orientImage(src *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// makeImageVariant resizes an image to width, keeping its aspect ratio and turning it by its orientation.
+// Variants carry no metadata. It returns nil if the image is not wider than width, the original does then
+func makeImageVariant(contentType string, data []byte, width int) ([]byte, error) {
+	format, ok := variantFormats[mediaTypeOf(contentType)]
+	if !ok {
+		return nil, nil
+	}
+	// images uploaded before the budget was lowered are served as they are
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > imageMaxPixels() {
+		log.Logger.WithField("width", config.Width).WithField("height", config.Height).Warn("image too large to resize")
+		return nil, nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	orientation := imageOrientation(contentType, data)
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	// displayed width and height
+	dispW, dispH := srcW, srcH
+	if orientation >= 5 {
+		dispW, dispH = srcH, srcW
+	}
+	if dispW <= width {
+		return nil, nil
+	}
+	height := dispH * width / dispW
+	if height < 1 {
+		height = 1
+	}
+
+	// scaled before turning, which is cheaper on the smaller image
+	scaledW, scaledH := width, height
+	if orientation >= 5 {
+		scaledW, scaledH = height, width
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, scaledW, scaledH))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, src.Bounds(), draw.Src, nil)
+	dst := orientImage(scaled, orientation)
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		// jpeg has no transparency, which would turn black
+		opaque := image.NewRGBA(dst.Bounds())
+		draw.Draw(opaque, opaque.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(opaque, opaque.Bounds(), dst, image.Point{}, draw.Over)
+		quality := viper.GetInt("attachment.jpeg_quality")
+		if quality <= 0 || quality > 100 {
+			quality = defaultJPEGQuality
+		}
+		err = jpeg.Encode(&buf, opaque, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// getImageVariant returns the blob key of a variant of an attachment, making it on first request.
+// An empty key means the original is to be served instead
+func getImageVariant(store blobStore, attachmentIns *attachmentObj, width int) (string, error) {
+	format, ok := variantFormats[mediaTypeOf(attachmentIns.MIME)]
+	if !ok || attachmentIns.Width > 0 && attachmentIns.Width <= width {
+		return "", nil
+	}
+	key := variantKey(attachmentIns.SHA256, width, format)
+
+	ret, err, _ := variantGroup.Do(key, func() (interface{}, error) {
+		exists, err := store.Exists(key)
+		if err != nil || exists {
+			return key, err
+		}
+
+		blobInsPtr, err := store.Open(attachmentIns.SHA256)
+		if err != nil {
+			return "", err
+		}
+		defer blobInsPtr.Close()
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(blobInsPtr); err != nil {
+			return "", err
+		}
+
+		data, err := makeImageVariant(attachmentIns.MIME, buf.Bytes(), width)
+		if err != nil || data == nil {
+			return "", err
+		}
+		if err := store.Put(key, bytes.NewReader(data)); err != nil {
+			return "", err
+		}
+		log.Logger.WithField("key", key).Info("image variant generated")
+		return key, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return ret.(string), nil
+}
+
+// makeImageVariants generates all the variants of an attachment, when "attachment.eager_variants" is set
+func makeImageVariants(attachmentIns attachmentObj) {
+	store, err := newBlobStore()
+	if err != nil {
+		log.Logger.WithField("err", err).Error("make image variants failed")
+		return
+	}
+	for _, width := range imageVariantWidths() {
+		if _, err := getImageVariant(store, &attachmentIns, width); err != nil {
+			log.Logger.WithField("sha256", attachmentIns.SHA256).WithField("err", err).Error("make image variant failed")
+			return
+		}
+	}
+}
+
+// ------------------------------------------------------------------
+
+// responsiveImageTransformer lets browsers pick a variant of the images of attachments by srcset, and gives them
+// their width and height so that the page does not jump while they load. Images with a srcset are left alone
+func responsiveImageTransformer(ctx *transformCtxObj, content string) (string, error) {
+	widths := imageVariantWidths()
+	sha256s := extractAttachmentSHA256s(content)
+	if len(widths) <= 0 || len(sha256s) <= 0 {
+		return content, nil
+	}
+	attachmentsIns, err := selectAttachmentsBySHA256s(ctx.Cursor, true, sha256s...)
+	if err != nil {
+		return "", err
+	}
+	attachmentsMap := map[string]attachmentObj{}
+	for _, attachmentIns := range attachmentsIns {
+		if _, ok := variantFormats[mediaTypeOf(attachmentIns.MIME)]; ok && attachmentIns.Width > 0 {
+			attachmentsMap[attachmentIns.SHA256] = attachmentIns
+		}
+	}
+	baseURL := strings.TrimSuffix(viper.GetString("server.base_url"), "/")
+	sizes := viper.GetString("attachment.sizes")
+
+	return transformFragment(content, func(sel *goquery.Selection) {
+		sel.Find("img[src]:not([srcset])").Each(func(i int, img *goquery.Selection) {
+			src, _ := img.Attr("src")
+			link := src
+			if baseURL != "" {
+				link = strings.TrimPrefix(link, baseURL)
+			}
+			attachmentIns, ok := attachmentsMap[strings.TrimPrefix(link, attachmentPathPrefix)]
+			if !ok || !strings.HasPrefix(link, attachmentPathPrefix) {
+				return
+			}
+
+			var candidates []string
+			for _, width := range widths {
+				if width < attachmentIns.Width {
+					candidates = append(candidates, fmt.Sprintf("%s?w=%d %dw", src, width, width))
+				}
+			}
+			if len(candidates) <= 0 {
+				return
+			}
+			candidates = append(candidates, fmt.Sprintf("%s %dw", src, attachmentIns.Width))
+			img.SetAttr("srcset", strings.Join(candidates, ", "))
+			if _, ok := img.Attr("sizes"); !ok && sizes != "" {
+				img.SetAttr("sizes", sizes)
+			}
+			_, hasWidth := img.Attr("width")
+			_, hasHeight := img.Attr("height")
+			if !hasWidth && !hasHeight {
+				img.SetAttr("width", strconv.Itoa(attachmentIns.Width))
+				img.SetAttr("height", strconv.Itoa(attachmentIns.Height))
+			}
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testPNG(t *testing.T, w int, h int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImagePixelBudget(t *testing.T) {
+	setTestConfig(t, map[string]interface{}{"attachment.max_pixels": 100 * 50, "attachment.store": "local",
+		"attachment.dir": t.TempDir(), "attachment.allowed_types": []string{"image/*"}})
+	openTestDB(t)
+
+	data, err := makeImageVariant("image/png", testPNG(t, 100, 50), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width != 40 || config.Height != 20 {
+		t.Errorf("variant %dx%d, %v", config.Width, config.Height, err)
+	}
+	attachmentInsPtr, err := uploadAttachment(bytes.NewReader(testPNG(t, 100, 50)), 0, "ok.png")
+	if err != nil || attachmentInsPtr.Width != 100 || attachmentInsPtr.Height != 50 {
+		t.Errorf("upload within the budget %+v, %v", attachmentInsPtr, err)
+	}
+
+	// one pixel over, the image is not decoded
+	large := testPNG(t, 101, 50)
+	if data, err := makeImageVariant("image/png", large, 40); err != nil || data != nil {
+		t.Errorf("variant of an image over the budget %d bytes, %v", len(data), err)
+	}
+	if _, err := uploadAttachment(bytes.NewReader(large), int64(len(large)), "large.png"); err != attachmentTooLargeErr {
+		t.Errorf("upload over the budget: %v", err)
+	}
+}
+
+func TestStripImageGPSDropsXMP(t *testing.T) {
+	xmp := `<x:xmpmeta><rdf:Description exif:GPSLatitude="31,14.0N"/></x:xmpmeta>`
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	segment := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...)
+	app1 := append([]byte{0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}, segment...)
+	jpegData := append(append(append([]byte{}, buf.Bytes()[:2]...), app1...), buf.Bytes()[2:]...)
+
+	pngData := testPNG(t, 8, 8)
+	// after the signature and the 25 bytes of the header chunk
+	content := append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), xmp...)
+	chunk := make([]byte, 8, 12+len(content))
+	binary.BigEndian.PutUint32(chunk, uint32(len(content)))
+	copy(chunk[4:], "iTXt")
+	chunk = append(chunk, content...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+	pngData = append(append(append([]byte{}, pngData[:33]...), chunk...), pngData[33:]...)
+
+	// an extended header with the xmp flag, and the packet of odd length which is padded
+	riffChunk := func(name string, content []byte) []byte {
+		c := append([]byte(name), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(c[4:], uint32(len(content)))
+		c = append(c, content...)
+		if len(content)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	webpData := append([]byte("RIFF\x00\x00\x00\x00WEBP"), riffChunk("VP8X", []byte{0x04 | 0x10, 0, 0, 0, 7, 0, 0, 7, 0, 0})...)
+	webpData = append(webpData, riffChunk("XMP ", []byte(xmp+"!"))...)
+	webpData = append(webpData, riffChunk("ALPH", []byte{1})...)
+	binary.LittleEndian.PutUint32(webpData[4:], uint32(len(webpData)-8))
+
+	for _, c := range []struct {
+		contentType string
+		data        []byte
+		size        int
+	}{
+		{"image/jpeg", jpegData, len(buf.Bytes())},
+		{"image/png", pngData, len(pngData) - len(chunk)},
+		{"image/webp", webpData, 12 + 18 + 10},
+	} {
+		got := stripImageGPS(c.contentType, append([]byte{}, c.data...))
+		if bytes.Contains(got, []byte("GPSLatitude")) || len(got) != c.size {
+			t.Errorf("%s: %d bytes left, want %d: %q", c.contentType, len(got), c.size, got)
+			continue
+		}
+		switch c.contentType {
+		case "image/webp":
+			if size := binary.LittleEndian.Uint32(got[4:]); int(size) != len(got)-8 || got[20] != 0x10 {
+				t.Errorf("webp riff size %d, flags %#x", size, got[20])
+			}
+		default:
+			if _, _, err := image.Decode(bytes.NewReader(got)); err != nil {
+				t.Errorf("%s: %s", c.contentType, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+	"go.yaml.in/yaml/v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// jekyll posts are named like "2019-05-01-hello-world.md"
+var jekyllFilenameRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)$`)
+
+// layouts of dates found in front matter, timezone-less ones are in "note.timezone"
+var frontMatterTimeLayouts = []string{
+	time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05 -0700", "2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02",
+}
+
+// raw html is kept, as hugo with "unsafe" and jekyll do
+var markdownRenderer = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, extension.Footnote),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// ------------------------------------------------------------------
+
+// importNoteObj is a note read from an export of another blog engine
+type importNoteObj struct {
+	Source    string
+	Title     string
+	Content   string
+	Private   bool
+	Tags      []string
+	CreatedAt time.Time
+	UpdateAt  time.Time
+	// urls the note was published at before
+	Links []string
+}
+
+type importResultObj struct {
+	Source    string
+	Title     string
+	Private   bool
+	Tags      []string
+	CreatedAt time.Time
+	NoteID    uint32
+	Slug      string
+	Skipped   string
+}
+
+// String is a line of the import report
+func (r importResultObj) String() string {
+	if r.Skipped != "" {
+		return fmt.Sprintf("skip    %s: %s", r.Source, r.Skipped)
+	}
+	action := "create "
+	if r.NoteID != 0 {
+		action = fmt.Sprintf("#%-6d", r.NoteID)
+	}
+	date := "now"
+	if !r.CreatedAt.IsZero() {
+		date = r.CreatedAt.Format(time.RFC3339)
+	}
+	visibility := "public"
+	if r.Private {
+		visibility = "private"
+	}
+	return fmt.Sprintf("%s %s: %q, %s, %s, tags [%s]", action, r.Source, r.Title, date, visibility, strings.Join(r.Tags, ", "))
+}
+
+// ------------------------------------------------------------------
+
+// splitFrontMatter separates the yaml ("---") or toml ("+++") front matter from the markdown body
+func splitFrontMatter(data []byte) (map[string]interface{}, []byte, error) {
+	frontMatter := map[string]interface{}{}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+
+	var delimiter string
+	for _, candidate := range []string{"---", "+++"} {
+		if strings.HasPrefix(text, candidate+"\n") {
+			delimiter = candidate
+		}
+	}
+	if delimiter == "" {
+		return frontMatter, []byte(text), nil
+	}
+
+	rest := text[len(delimiter)+1:]
+	end := strings.Index(rest, "\n"+delimiter+"\n")
+	if end < 0 {
+		if !strings.HasSuffix(rest, "\n"+delimiter) {
+			return nil, nil, fmt.Errorf("front matter is not closed by %s", delimiter)
+		}
+		end = len(rest) - len(delimiter) - 1
+	}
+	head := rest[:end]
+	body := ""
+	if end+len(delimiter)+2 < len(rest) {
+		body = rest[end+len(delimiter)+2:]
+	}
+
+	var err error
+	if delimiter == "---" {
+		err = yaml.Unmarshal([]byte(head), &frontMatter)
+	} else {
+		err = toml.Unmarshal([]byte(head), &frontMatter)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if frontMatter == nil {
+		frontMatter = map[string]interface{}{}
+	}
+	return frontMatter, []byte(body), nil
+}
+
+func frontMatterString(frontMatter map[string]interface{}, key string) string {
+	value, ok := frontMatter[key]
+	if !ok || value == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprint(value))
+}
+
+// frontMatterStrings reads a list, or a single string which jekyll splits by spaces
+func frontMatterStrings(frontMatter map[string]interface{}, key string) []string {
+	values := make([]string, 0)
+	switch value := frontMatter[key].(type) {
+	case string:
+		values = append(values, strings.Fields(value)...)
+	case []interface{}:
+		for _, item := range value {
+			if item != nil {
+				values = append(values, strings.TrimSpace(fmt.Sprint(item)))
+			}
+		}
+	}
+	return values
+}
+
+func frontMatterBool(frontMatter map[string]interface{}, key string) (bool, bool) {
+	switch value := frontMatter[key].(type) {
+	case bool:
+		return value, true
+	case string:
+		return strings.EqualFold(value, "true") || value == "yes", true
+	}
+	return false, false
+}
+
+// frontMatterTime reads a date, which is decoded to time.Time by yaml and to local date types by toml
+func frontMatterTime(frontMatter map[string]interface{}, keys ...string) time.Time {
+	for _, key := range keys {
+		value, ok := frontMatter[key]
+		if !ok || value == nil {
+			continue
+		}
+		if t, ok := value.(time.Time); ok {
+			return t
+		}
+		text := strings.TrimSpace(fmt.Sprint(value))
+		for _, layout := range frontMatterTimeLayouts {
+			if t, err := time.ParseInLocation(layout, text, noteLocation()); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// parseMarkdownNote maps the front matter of a hugo or jekyll post onto a note, the body is rendered to html
+func parseMarkdownNote(path string, data []byte) (*importNoteObj, error) {
+	frontMatter, body, err := splitFrontMatter(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// "post/hello/index.md" is a hugo page bundle named by its directory
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if name == "index" {
+		name = filepath.Base(filepath.Dir(path))
+	}
+	var nameDate string
+	if submatch := jekyllFilenameRegexp.FindStringSubmatch(name); submatch != nil {
+		nameDate, name = submatch[1], submatch[2]
+	}
+
+	noteInsPtr := &importNoteObj{Source: path, Title: frontMatterString(frontMatter, "title")}
+	if noteInsPtr.Title == "" {
+		noteInsPtr.Title = strings.Replace(name, "-", " ", -1)
+	}
+
+	noteInsPtr.CreatedAt = frontMatterTime(frontMatter, "date", "publishDate")
+	if noteInsPtr.CreatedAt.IsZero() && nameDate != "" {
+		noteInsPtr.CreatedAt, _ = time.ParseInLocation(dateLayout, nameDate, noteLocation())
+	}
+	noteInsPtr.UpdateAt = frontMatterTime(frontMatter, "lastmod", "last_modified_at", "updated")
+
+	// categories are tags too, a note has one flat list of tags
+	noteInsPtr.Tags = append(frontMatterStrings(frontMatter, "tags"), frontMatterStrings(frontMatter, "categories")...)
+	if category := frontMatterString(frontMatter, "category"); category != "" {
+		noteInsPtr.Tags = append(noteInsPtr.Tags, category)
+	}
+
+	// drafts of hugo and unpublished posts of jekyll are kept private
+	if draft, ok := frontMatterBool(frontMatter, "draft"); ok && draft {
+		noteInsPtr.Private = true
+	}
+	if published, ok := frontMatterBool(frontMatter, "published"); ok && !published {
+		noteInsPtr.Private = true
+	}
+
+	var buf bytes.Buffer
+	if err := markdownRenderer.Convert(body, &buf); err != nil {
+		return nil, err
+	}
+	noteInsPtr.Content = buf.String()
+	return noteInsPtr, nil
+}
+
+// markdownImportSource names a markdown file by its path in the imported directory, e.g. "md:post/hello.md",
+// so that the same posts are recognized wherever the directory is
+func markdownImportSource(dir string, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil {
+		path = rel
+	}
+	return "md:" + filepath.ToSlash(path)
+}
+
+// readMarkdownDir parses every markdown file under dir, in path order. Hugo section pages ("_index.md")
+// are not posts and are skipped
+func readMarkdownDir(dir string) ([]*importNoteObj, []importResultObj, error) {
+	notesInsPtr := make([]*importNoteObj, 0)
+	skipped := make([]importResultObj, 0)
+
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && path != dir {
+			return filepath.SkipDir
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !info.IsDir() && (ext == ".md" || ext == ".markdown") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		source := markdownImportSource(dir, path)
+		if filepath.Base(path) == "_index.md" {
+			skipped = append(skipped, importResultObj{Source: source, Skipped: "section page"})
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		noteInsPtr, err := parseMarkdownNote(path, data)
+		if err != nil {
+			skipped = append(skipped, importResultObj{Source: source, Skipped: err.Error()})
+			continue
+		}
+		noteInsPtr.Source = source
+		notesInsPtr = append(notesInsPtr, noteInsPtr)
+	}
+	return notesInsPtr, skipped, nil
+}
+
+// importNotes publishes the notes through publishNoteAt, or only reports what would be created if dryRun is set.
+// Notes without a date are published as written now. Notes imported from the same source before are skipped,
+// so that an import which failed half way can be run again
+func importNotes(notesInsPtr []*importNoteObj, dryRun bool) ([]importResultObj, error) {
+	results := make([]importResultObj, 0, len(notesInsPtr))
+	for _, noteInsPtr := range notesInsPtr {
+		resultIns := importResultObj{Source: noteInsPtr.Source, Title: noteInsPtr.Title, Private: noteInsPtr.Private,
+			Tags: normalizeTagNames(noteInsPtr.Tags), CreatedAt: noteInsPtr.CreatedAt}
+		if strings.TrimSpace(noteInsPtr.Title) == "" {
+			resultIns.Skipped = "no title"
+			results = append(results, resultIns)
+			continue
+		}
+
+		noteID, err := selectNoteIDByImportSource(DB, noteInsPtr.Source)
+		if err != nil {
+			return results, fmt.Errorf("import %s: %s", noteInsPtr.Source, err.Error())
+		}
+		if noteID != 0 {
+			// the note id is kept, so that the wxr mapping still has the note
+			resultIns.NoteID, resultIns.Skipped = noteID, fmt.Sprintf("imported before as #%d", noteID)
+			results = append(results, resultIns)
+			continue
+		}
+
+		if !dryRun {
+			noteID, slug, err := publishNoteAt(noteInsPtr.Source, noteInsPtr.CreatedAt, noteInsPtr.UpdateAt, noteInsPtr.Title,
+				noteInsPtr.Content, noteInsPtr.Private, noteInsPtr.Tags...)
+			if err != nil {
+				return results, fmt.Errorf("import %s: %s", noteInsPtr.Source, err.Error())
+			}
+			resultIns.NoteID, resultIns.Slug = noteID, slug
+		}
+		results = append(results, resultIns)
+	}
+	return results, nil
+}
+
+// ImportMarkdownDir imports a directory of markdown posts with yaml or toml front matter, e.g. the content
+// of a hugo site or the _posts of a jekyll one
+func ImportMarkdownDir(dir string, dryRun bool) ([]importResultObj, error) {
+	notesInsPtr, skipped, err := readMarkdownDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	results, err := importNotes(notesInsPtr, dryRun)
+	results = append(results, skipped...)
+	if err != nil {
+		return results, err
+	}
+
+	log.Logger.WithField("dir", dir).WithField("notes", len(notesInsPtr)).WithField("dry_run", dryRun).
+		Info("done importing markdown")
+	return results, nil
+}
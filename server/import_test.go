@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportMarkdownDirTwice(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"cache.enabled": false, "plugin.on_save": []string{}})
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "post"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"post/2019-05-01-hello.md": "---\ntitle: Hello\ntags: [go]\n---\nhello",
+		"post/world.md":            "---\ntitle: World\ntags: [misc]\n---\nworld",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := ImportMarkdownDir(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Source != "md:post/2019-05-01-hello.md" || results[0].NoteID == 0 ||
+		results[0].Skipped != "" || results[1].NoteID == 0 {
+		t.Fatalf("first import %v", results)
+	}
+
+	// the notes imported before are skipped, the one deleted since is imported again
+	if err := deleteNote(results[1].NoteID); err != nil {
+		t.Fatal(err)
+	}
+	again, err := ImportMarkdownDir(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 2 || again[0].NoteID != results[0].NoteID || again[0].Skipped == "" ||
+		again[1].Skipped != "" || again[1].NoteID == results[1].NoteID {
+		t.Errorf("second import %v", again)
+	}
+
+	var cnt int
+	if err := db.QueryRow("select count(id) from notebook.note").Scan(&cnt); err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 2 {
+		t.Errorf("%d notes, want 2", cnt)
+	}
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"encoding/base64"
+	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/speed18/d18-notebook/log"
 	"github.com/spf13/viper"
@@ -13,17 +15,36 @@ import (
 
 // ------------------------------------------------------------------
 
+func noteLink(noteID uint32) string {
+	return fmt.Sprintf(viper.GetString("note.link_format"), noteID)
+}
+
 func hideNote(noteInsPtr *noteObj) {
 	noteInsPtr.Content = ""
 	noteInsPtr.PlainText = ""
+	noteInsPtr.Excerpt = ""
 }
 
 func cutNote(noteInsPtr *noteObj) {
-	digestLength := viper.GetUint32("note.digest_length")
-	// copy is needed so that the original plain text can be garbage collected
-	part := make([]rune, digestLength)
-	copy(part, []rune(noteInsPtr.PlainText)[:min(int(noteInsPtr.Words), int(digestLength))])
-	noteInsPtr.PlainText = string(part)
+	digestLength := viper.GetInt("note.digest_length")
+	if excerpt, hasMore := splitMoreMarker(noteInsPtr.Content); hasMore {
+		if plainText, err := extractPlainTextFromHTML(excerpt); err != nil {
+			log.Logger.WithField("err", err).Warn("extract plain text from excerpt failed")
+			noteInsPtr.PlainText = cutPlainText(noteInsPtr.PlainText, digestLength)
+		} else {
+			noteInsPtr.PlainText = plainText
+		}
+	} else {
+		noteInsPtr.PlainText = cutPlainText(noteInsPtr.PlainText, digestLength)
+	}
+
+	if viper.GetBool("note.html_excerpt") {
+		if excerpt, err := makeHTMLExcerpt(noteInsPtr.Content, noteInsPtr.PlainText); err != nil {
+			log.Logger.WithField("err", err).Warn("make html excerpt failed")
+		} else {
+			noteInsPtr.Excerpt = excerpt
+		}
+	}
 	noteInsPtr.Content = ""
 }
 
@@ -32,12 +53,44 @@ func extractPlainTextFromHTML(content string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	plainText := doc.Text()
-	plainText = strings.Join(strings.Fields(plainText), "")
+	var sb strings.Builder
+	for _, node := range doc.Nodes {
+		writeNodeText(&sb, node)
+	}
+	plainText := joinTextFields(strings.Fields(sb.String()))
 	log.Logger.WithField("plainText", plainText).Debug("")
 	return plainText, nil
 }
 
+// processContent runs the save stage transformers and extracts plain text and words from the result
+func processContent(cursor cursorObj, noteID uint32, content string) (string, string, uint32, error) {
+	content, err := runTransformers(&transformCtxObj{Cursor: cursor, NoteID: noteID, Stage: saveStage}, content)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	var words uint32
+	plainText, err := extractPlainTextFromHTML(content)
+	if err != nil {
+		log.Logger.WithField("err", err).Warn("extract plain text failed")
+		words = 0
+	} else {
+		words = countWords(plainText)
+	}
+	return content, plainText, words, nil
+}
+
+// renderNote runs the read stage transformers, the raw content is kept if any of them fails
+func renderNote(cursor cursorObj, noteInsPtr *noteObj, isAuth bool) {
+	ctx := &transformCtxObj{Cursor: cursor, NoteID: noteInsPtr.ID, Stage: readStage, IsAuth: isAuth}
+	content, err := runTransformers(ctx, noteInsPtr.Content)
+	if err != nil {
+		log.Logger.WithField("note id", noteInsPtr.ID).WithField("err", err).Warn("render note failed, use raw content")
+		return
+	}
+	noteInsPtr.Content = content
+}
+
 func calcPage(curPage int, pageSize int, totalCount int) pageObj {
 	if pageSize <= 0 || curPage <= 0 || totalCount <= 0 {
 		return pageObj{Left: 0, Right: 0, Cur: 0, Total: 0}
@@ -64,11 +117,18 @@ func calcPage(curPage int, pageSize int, totalCount int) pageObj {
 	return pageObj{Left: uint32(left), Right: uint32(right), Cur: uint32(curPage), Total: uint32(totalPage)}
 }
 
-func getNotes(pageNo uint32, tagID uint32, token string) ([]*noteObj, pageObj, error) {
+func getNotes(pageNo uint32, filterIns *notesFilterObj, token string) ([]*noteObj, pageObj, error) {
 	var pageIns pageObj
 	notesInsPtr := make([]*noteObj, 0)
 
-	notesCount, err := selectNotesCountByTagID(DB, tagID)
+	_isAuth := isAuth(token)
+	cacheKey, cacheField := notesCacheKey(notesCacheTagID(filterIns)), notesCacheField(filterIns, pageNo, _isAuth)
+	var cacheIns notesRespObj
+	if getCache(cacheKey, cacheField, &cacheIns) {
+		return cacheIns.Notes, cacheIns.Page, nil
+	}
+
+	notesCount, err := selectNotesCountByFilter(DB, filterIns)
 	if err != nil {
 		return notesInsPtr, pageIns, err
 	}
@@ -79,24 +139,72 @@ func getNotes(pageNo uint32, tagID uint32, token string) ([]*noteObj, pageObj, e
 		return notesInsPtr, pageIns, nil
 	}
 
-	notesInsPtr, err = selectNotesByTagID(DB, pageIns.Cur, pageSize, tagID, true, true)
+	notesInsPtr, err = selectNotesByFilter(DB, filterIns, nil, (pageIns.Cur-1)*pageSize, pageSize, true)
 	if err != nil {
 		return notesInsPtr, pageIns, err
 	}
+	prepareListedNotes(notesInsPtr, _isAuth)
+
+	setCache(cacheKey, cacheField, notesRespObj{Notes: notesInsPtr, Page: pageIns})
+	return notesInsPtr, pageIns, err
+}
+
+// getNotesAfter returns the page of notes after the cursor, and the cursor of the next page
+// which is empty if there are no more notes
+func getNotesAfter(cursorInsPtr *notesCursorObj, filterIns *notesFilterObj, token string) ([]*noteObj, string, error) {
+	var cursor string
+	if cursorInsPtr != nil {
+		cursor = encodeNotesCursor(*cursorInsPtr)
+	}
 
 	_isAuth := isAuth(token)
+	cacheKey, cacheField := notesCacheKey(notesCacheTagID(filterIns)), notesCursorCacheField(filterIns, cursor, _isAuth)
+	var cacheIns notesRespObj
+	if getCache(cacheKey, cacheField, &cacheIns) {
+		return cacheIns.Notes, cacheIns.NextCursor, nil
+	}
+
+	// one more note is selected to know if there is a next page
+	pageSize := viper.GetUint32("pagination.page_size")
+	notesInsPtr, err := selectNotesByFilter(DB, filterIns, cursorInsPtr, 0, pageSize+1, true)
+	if err != nil {
+		return notesInsPtr, "", err
+	}
+
+	var nextCursor string
+	if uint32(len(notesInsPtr)) > pageSize {
+		notesInsPtr = notesInsPtr[:pageSize]
+		last := notesInsPtr[len(notesInsPtr)-1]
+		nextCursor = encodeNotesCursor(notesCursorObj{
+			Sort: notesSortKey(filterIns), Value: notesCursorValue(last, filterIns.Sort), ID: last.ID})
+	}
+	prepareListedNotes(notesInsPtr, _isAuth)
+
+	setCache(cacheKey, cacheField, notesRespObj{Notes: notesInsPtr, NextCursor: nextCursor})
+	return notesInsPtr, nextCursor, nil
+}
+
+// prepareListedNotes hides private notes from anonymous readers and cuts the others to digests
+func prepareListedNotes(notesInsPtr []*noteObj, isAuth bool) {
 	for _, noteInsPtr := range notesInsPtr {
-		if noteInsPtr.Private && !_isAuth {
+		if noteInsPtr.Private && !isAuth {
 			hideNote(noteInsPtr)
 		} else {
+			if viper.GetBool("note.html_excerpt") {
+				renderNote(DB, noteInsPtr, isAuth)
+			}
 			cutNote(noteInsPtr)
 		}
 	}
-
-	return notesInsPtr, pageIns, err
 }
 
 func getNote(noteID uint32, token string) (*noteObj, error) {
+	_isAuth := isAuth(token)
+	var cacheIns noteObj
+	if getCache(noteCacheKey(noteID, _isAuth), "", &cacheIns) {
+		return &cacheIns, nil
+	}
+
 	noteInsPtr, err := selectNoteByNoteID(DB, noteID, true)
 	if err != nil {
 		return noteInsPtr, err
@@ -104,21 +212,52 @@ func getNote(noteID uint32, token string) (*noteObj, error) {
 	if noteInsPtr == nil {
 		return nil, noteNotExistsErr
 	}
-	if noteInsPtr.Private && !isAuth(token) {
+	if noteInsPtr.Private && !_isAuth {
 		hideNote(noteInsPtr)
+	} else {
+		renderNote(DB, noteInsPtr, _isAuth)
 	}
+
+	setCache(noteCacheKey(noteID, _isAuth), "", noteInsPtr)
 	return noteInsPtr, nil
 }
 
-func publishNote(title string, content string, private bool, tagsName ...string) (uint32, error) {
+// getNoteBySlug looks up a note by its current or old slug, the current slug is returned for redirecting
+// if an old one is used
+func getNoteBySlug(slug string, token string) (*noteObj, string, error) {
+	noteID, err := selectNoteIDBySlug(DB, slug, false)
+	if err != nil {
+		return nil, "", err
+	}
+	if noteID == 0 {
+		return nil, "", noteNotExistsErr
+	}
+
+	noteInsPtr, err := getNote(noteID, token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var redirect string
+	if noteInsPtr.Slug != slug {
+		redirect = noteInsPtr.Slug
+	}
+	return noteInsPtr, redirect, nil
+}
+
+func publishNote(title string, content string, private bool, tagsName ...string) (uint32, string, error) {
+	return publishNoteAt("", time.Time{}, time.Time{}, title, content, private, tagsName...)
+}
+
+// publishNoteAt publishes a note written before, e.g. an imported one, keeping its timestamps if they are not zero.
+// A note imported from source is recorded, so that it is not imported twice
+func publishNoteAt(source string, createdAt time.Time, updateAt time.Time, title string, content string, private bool, tagsName ...string) (uint32, string, error) {
+	tagsName = normalizeTagNames(tagsName)
+	var cacheNoteIDs, cacheTagIDs []uint32
 	ret, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
-		var words uint32
-		plainText, err := extractPlainTextFromHTML(content)
+		content, plainText, words, err := processContent(cursor, 0, content)
 		if err != nil {
-			log.Logger.WithField("err", err).Warn("extract plain text failed")
-			words = 0
-		} else {
-			words = uint32(len([]rune(plainText)))
+			return 0, err
 		}
 
 		author := viper.GetString("note.default_author")
@@ -127,73 +266,147 @@ func publishNote(title string, content string, private bool, tagsName ...string)
 			return 0, err
 		}
 
-		_, err = insertTags(cursor, true, tagsName...)
+		slug, err := assignNoteSlug(cursor, noteID, title)
+		if err != nil {
+			return 0, err
+		}
+
+		if source != "" {
+			// the unique source fails the import done twice at the same time
+			if _, err := insertNoteImport(cursor, noteID, source); err != nil {
+				return 0, err
+			}
+		}
+
+		if err := saveNoteLinks(cursor, noteID, title, content); err != nil {
+			return 0, err
+		}
+
+		if err := saveNoteAttachments(cursor, noteID, content); err != nil {
+			return 0, err
+		}
+
+		// ancestors are inserted too, so that "lang" can be filtered by when only "lang/go" is used
+		_, err = insertTags(cursor, true, withTagAncestors(tagsName)...)
 		if err != nil {
 			return 0, err
 		}
 
 		// lock is required in case tags are deleted by "deleteUnusedTags"
-		tagsIns, err := selectTagsByName(cursor, false, true, tagsName...)
+		tagsIns, err := selectTagsByName(cursor, false, true, withTagAncestors(tagsName)...)
 		if err != nil {
 			return 0, err
 		}
+		tagsIns = filterTagsByName(tagsIns, tagsName)
 
 		_, err = insertNoteTags(cursor, noteID, tagsIns...)
 		if err != nil {
 			return 0, err
 		}
 
-		return noteID, nil
+		// set last, since update_at changes on every update of the note
+		if !createdAt.IsZero() {
+			if updateAt.Before(createdAt) {
+				updateAt = createdAt
+			}
+			_, err = updateNoteTimesByNoteID(cursor, noteID, createdAt.In(dbLocation()).Format(dbTimeLayout),
+				updateAt.In(dbLocation()).Format(dbTimeLayout))
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		// notes linking to the title of the new note are rendered differently now
+		cacheNoteIDs, cacheTagIDs, err = selectCacheDependencies(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
+		return &noteObj{ID: noteID, Slug: slug}, nil
 	})
 
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 
-	noteID := ret.(uint32)
-	return noteID, nil
+	invalidateNoteCaches(cacheNoteIDs, cacheTagIDs)
+
+	noteInsPtr := ret.(*noteObj)
+	return noteInsPtr.ID, noteInsPtr.Slug, nil
 }
 
 func updateNote(noteID uint32, title string, content string, private bool, tagsName ...string) error {
+	tagsName = normalizeTagNames(tagsName)
+	var cacheNoteIDs, cacheTagIDs []uint32
 	_, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
-		var words uint32
-		plainText, err := extractPlainTextFromHTML(content)
+		oldNoteInsPtr, err := selectNoteBriefByNoteID(cursor, noteID)
 		if err != nil {
-			log.Logger.WithField("err", err).Warn("extract plain text failed")
-			words = 0
-		} else {
-			words = uint32(len([]rune(plainText)))
+			return 0, err
+		}
+		if oldNoteInsPtr == nil {
+			return 0, noteNotExistsErr
+		}
+
+		// the notes lists of the old tags have to be dropped too
+		cacheNoteIDs, cacheTagIDs, err = selectCacheDependencies(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
+		content, plainText, words, err := processContent(cursor, noteID, content)
+		if err != nil {
+			return 0, err
 		}
 
 		rowsAffected, err := updateNoteByNoteID(cursor, noteID, title, content, plainText, words, private)
 		if err != nil {
 			return 0, err
 		}
-		//if rowsAffected <= 0 {
-		//	return 0, noteNotExistsErr
-		//}
+
+		// the old slug is kept and redirected to the new one
+		if oldNoteInsPtr.Title != title || oldNoteInsPtr.Slug == "" {
+			if _, err := assignNoteSlug(cursor, noteID, title); err != nil {
+				return 0, err
+			}
+		}
+
+		if err := saveNoteLinks(cursor, noteID, title, content); err != nil {
+			return 0, err
+		}
+
+		if err := saveNoteAttachments(cursor, noteID, content); err != nil {
+			return 0, err
+		}
 
 		_, err = deleteNoteTagsByNoteID(cursor, noteID)
 		if err != nil {
 			return 0, err
 		}
 
-		_, err = insertTags(cursor, true, tagsName...)
+		_, err = insertTags(cursor, true, withTagAncestors(tagsName)...)
 		if err != nil {
 			return 0, err
 		}
 
 		// lock is required in case tags are deleted by func "deleteUnusedTags"
-		tagsIns, err := selectTagsByName(cursor, false, true, tagsName...)
+		tagsIns, err := selectTagsByName(cursor, false, true, withTagAncestors(tagsName)...)
 		if err != nil {
 			return 0, err
 		}
+		tagsIns = filterTagsByName(tagsIns, tagsName)
 
 		_, err = insertNoteTags(cursor, noteID, tagsIns...)
 		if err != nil {
 			return 0, err
 		}
 
+		newNoteIDs, newTagIDs, err := selectCacheDependencies(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+		cacheNoteIDs = append(cacheNoteIDs, newNoteIDs...)
+		cacheTagIDs = append(cacheTagIDs, newTagIDs...)
+
 		return rowsAffected, nil
 	})
 
@@ -201,13 +414,23 @@ func updateNote(noteID uint32, title string, content string, private bool, tagsN
 		return err
 	}
 
+	invalidateNoteCaches(cacheNoteIDs, cacheTagIDs)
+
 	go cleanUnusedTags()
 
 	return nil
 }
 
 func deleteNote(noteID uint32) error {
+	var cacheNoteIDs, cacheTagIDs []uint32
 	_, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
+		// the links and tags of the note are gone after deleting
+		var err error
+		cacheNoteIDs, cacheTagIDs, err = selectCacheDependencies(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
 		rowsAffected, err := deleteNoteByNoteID(cursor, noteID)
 		if err != nil {
 			return 0, err
@@ -221,6 +444,37 @@ func deleteNote(noteID uint32) error {
 			return 0, err
 		}
 
+		_, err = deleteNoteLinksBySrcNoteID(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = deleteSeriesNotesByNoteID(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = deleteNoteSlugsByNoteID(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
+		// so that the note can be imported again
+		_, err = deleteNoteImportsByNoteID(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = deleteNoteAttachmentsByNoteID(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = unresolveNoteLinksByDstNoteID(cursor, noteID)
+		if err != nil {
+			return 0, err
+		}
+
 		return rowsAffected, nil
 	})
 
@@ -228,17 +482,604 @@ func deleteNote(noteID uint32) error {
 		return err
 	}
 
+	invalidateNoteCaches(cacheNoteIDs, cacheTagIDs)
+
 	go cleanUnusedTags()
 
 	return nil
 }
 
-func getTags() ([]tagObj, error) {
+// saveNoteLinks replaces the links of a note with the wiki links found in its content
+func saveNoteLinks(cursor cursorObj, noteID uint32, title string, content string) error {
+	if _, err := deleteNoteLinksBySrcNoteID(cursor, noteID); err != nil {
+		return err
+	}
+
+	targets, err := extractWikiLinks(content)
+	if err != nil {
+		return err
+	}
+	// "{{< note 42 >}}" shows the title of note 42 like "[[#42]]" does, so it is recorded as the same link
+	refs, err := extractShortcodeNoteRefs(content)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if !containsString(targets, ref) {
+			targets = append(targets, ref)
+		}
+	}
+
+	linksIns := make([]noteLinkObj, 0)
+	for _, target := range targets {
+		dstNoteID, err := resolveWikiLink(cursor, target)
+		if err != nil {
+			return err
+		}
+		if dstNoteID == noteID {
+			continue
+		}
+		linksIns = append(linksIns, noteLinkObj{Target: target, NoteID: dstNoteID})
+	}
+
+	if _, err := insertNoteLinks(cursor, noteID, linksIns...); err != nil {
+		return err
+	}
+
+	_, err = resolvePendingNoteLinks(cursor, noteID, title)
+	return err
+}
+
+// getNoteModifiedAt returns when the note response last changed, zero if unknown
+func getNoteModifiedAt(noteID uint32) (time.Time, error) {
+	modifiedAt, err := selectNoteModifiedAt(DB, noteID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseDBTime(modifiedAt), nil
+}
+
+func getBacklinks(noteID uint32, token string) ([]noteLinkObj, error) {
+	linksIns, err := selectBacklinksByNoteID(DB, noteID, true)
+	if err != nil {
+		return linksIns, err
+	}
+	if isAuth(token) {
+		return linksIns, nil
+	}
+
+	publicLinksIns := make([]noteLinkObj, 0)
+	for _, linkIns := range linksIns {
+		if !linkIns.Private {
+			publicLinksIns = append(publicLinksIns, linkIns)
+		}
+	}
+	return publicLinksIns, nil
+}
+
+// getNoteGraph returns all notes and the links between them, private notes are left out if not auth
+func getNoteGraph(token string) ([]graphNodeObj, []graphEdgeObj, error) {
+	nodesIns, err := selectGraphNodes(DB, true)
+	if err != nil {
+		return nodesIns, nil, err
+	}
+	edgesIns, err := selectGraphEdges(DB, true)
+	if err != nil {
+		return nodesIns, edgesIns, err
+	}
+	if isAuth(token) {
+		return nodesIns, edgesIns, nil
+	}
+
+	publicNodesIns := make([]graphNodeObj, 0)
+	publicNoteIDs := map[uint32]bool{}
+	for _, nodeIns := range nodesIns {
+		if !nodeIns.Private {
+			publicNodesIns = append(publicNodesIns, nodeIns)
+			publicNoteIDs[nodeIns.ID] = true
+		}
+	}
+	publicEdgesIns := make([]graphEdgeObj, 0)
+	for _, edgeIns := range edgesIns {
+		if publicNoteIDs[edgeIns.Source] && publicNoteIDs[edgeIns.Target] {
+			publicEdgesIns = append(publicEdgesIns, edgeIns)
+		}
+	}
+	return publicNodesIns, publicEdgesIns, nil
+}
+
+// setSeriesNotes replaces the notes of a series in the given order,
+// notes which already belong to another series are moved to this one
+func setSeriesNotes(cursor cursorObj, seriesID uint32, noteIDs []uint32) error {
+	if len(noteIDs) > 0 {
+		cnt, err := selectNotesCountByNoteIDs(cursor, noteIDs...)
+		if err != nil {
+			return err
+		}
+		if int(cnt) != len(noteIDs) {
+			return noteNotExistsErr
+		}
+
+		if _, err := deleteSeriesNotesByNoteID(cursor, noteIDs...); err != nil {
+			return err
+		}
+	}
+
+	if _, err := deleteSeriesNotesBySeriesID(cursor, seriesID); err != nil {
+		return err
+	}
+
+	_, err := insertSeriesNotes(cursor, seriesID, noteIDs...)
+	return err
+}
+
+func createSeries(title string, description string, noteIDs ...uint32) (uint32, error) {
+	ret, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
+		seriesID, err := insertSeries(cursor, title, description)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := setSeriesNotes(cursor, seriesID, noteIDs); err != nil {
+			return 0, err
+		}
+
+		return seriesID, nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	seriesID := ret.(uint32)
+	return seriesID, nil
+}
+
+func updateSeries(seriesID uint32, title string, description string, noteIDs ...uint32) error {
+	_, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
+		seriesInsPtr, err := selectSeriesBySeriesID(cursor, seriesID, true)
+		if err != nil {
+			return 0, err
+		}
+		if seriesInsPtr == nil {
+			return 0, seriesNotExistsErr
+		}
+
+		rowsAffected, err := updateSeriesBySeriesID(cursor, seriesID, title, description)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := setSeriesNotes(cursor, seriesID, noteIDs); err != nil {
+			return 0, err
+		}
+
+		return rowsAffected, nil
+	})
+	return err
+}
+
+func deleteSeries(seriesID uint32) error {
+	_, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
+		rowsAffected, err := deleteSeriesBySeriesID(cursor, seriesID)
+		if err != nil {
+			return 0, err
+		}
+		if rowsAffected <= 0 {
+			return 0, seriesNotExistsErr
+		}
+
+		_, err = deleteSeriesNotesBySeriesID(cursor, seriesID)
+		if err != nil {
+			return 0, err
+		}
+
+		return rowsAffected, nil
+	})
+	return err
+}
+
+// getSeries returns the series with its notes in order, private notes are left out if not auth
+func getSeries(seriesID uint32, token string) (*seriesObj, error) {
+	seriesInsPtr, err := selectSeriesBySeriesID(DB, seriesID, false)
+	if err != nil {
+		return nil, err
+	}
+	if seriesInsPtr == nil {
+		return nil, seriesNotExistsErr
+	}
+
+	notesIns, err := selectSeriesNotesBySeriesID(DB, seriesID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	_isAuth := isAuth(token)
+	for _, noteIns := range notesIns {
+		if !noteIns.Private || _isAuth {
+			seriesInsPtr.Notes = append(seriesInsPtr.Notes, noteIns)
+		}
+	}
+	seriesInsPtr.Count = uint32(len(seriesInsPtr.Notes))
+
+	return seriesInsPtr, nil
+}
+
+func getSeriesList(token string) ([]seriesObj, error) {
+	return selectSeriesWithNotesCount(DB, isAuth(token), true)
+}
+
+// getSeriesNav returns the previous and next notes of the series the note belongs to, nil if there is none
+func getSeriesNav(noteID uint32, token string) (*seriesNavObj, error) {
+	seriesID, err := selectSeriesIDByNoteID(DB, noteID)
+	if err != nil || seriesID == 0 {
+		return nil, err
+	}
+
+	seriesInsPtr, err := getSeries(seriesID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, noteIns := range seriesInsPtr.Notes {
+		if noteIns.NoteID != noteID {
+			continue
+		}
+
+		navInsPtr := &seriesNavObj{ID: seriesInsPtr.ID, Title: seriesInsPtr.Title,
+			Position: uint32(i + 1), Total: seriesInsPtr.Count}
+		if i > 0 {
+			navInsPtr.Prev = &seriesInsPtr.Notes[i-1]
+		}
+		if i < len(seriesInsPtr.Notes)-1 {
+			navInsPtr.Next = &seriesInsPtr.Notes[i+1]
+		}
+		return navInsPtr, nil
+	}
+
+	// the note is private and not auth
+	return nil, nil
+}
+
+func getArchive() ([]archiveObj, error) {
+	return selectArchive(DB, true)
+}
+
+// getArchiveMonth returns the notes created in the month, in the order they were written
+func getArchiveMonth(year uint32, month uint32, pageNo uint32, token string) ([]*noteObj, pageObj, error) {
+	first := time.Date(int(year), time.Month(month), 1, 0, 0, 0, 0, dbLocation())
+	filterIns := notesFilterObj{
+		From: first.Format(dateLayout), To: first.AddDate(0, 1, -1).Format(dateLayout),
+		Sort: "created", Order: orderAsc,
+	}
+	if err := normalizeNotesFilter(&filterIns); err != nil {
+		return nil, pageObj{}, err
+	}
+	return getNotes(pageNo, &filterIns, token)
+}
+
+// getCalendar returns the days of the year with notes, for drawing a heatmap
+func getCalendar(year uint32) ([]calendarDayObj, error) {
+	first := time.Date(int(year), time.January, 1, 0, 0, 0, 0, dbLocation())
+	return selectCalendarDays(DB, first.Format(dbTimeLayout), first.AddDate(1, 0, 0).Format(dbTimeLayout), true)
+}
+
+// getOnThisDay returns the notes written on the same month and day as today in previous years,
+// "today" is in the time zone of "note.timezone" and notes written on Feb 29 only come back in leap years
+func getOnThisDay(token string) (string, []*noteObj, error) {
+	now := time.Now().In(noteLocation())
+	today := now.Format(dateLayout)
+
+	firstCreatedAt, err := selectFirstNoteCreatedAt(DB)
+	if err != nil {
+		return today, nil, err
+	}
+	first := parseDBTime(firstCreatedAt)
+	if first.IsZero() {
+		return today, make([]*noteObj, 0), nil
+	}
+
+	var ranges [][2]string
+	for year := now.Year() - 1; year >= first.In(noteLocation()).Year(); year-- {
+		day := time.Date(year, now.Month(), now.Day(), 0, 0, 0, 0, noteLocation())
+		if day.Day() != now.Day() {
+			continue
+		}
+		ranges = append(ranges, [2]string{
+			day.In(dbLocation()).Format(dbTimeLayout), day.AddDate(0, 0, 1).In(dbLocation()).Format(dbTimeLayout)})
+	}
+
+	notesInsPtr, err := selectNotesByCreatedRanges(DB, ranges, true)
+	if err != nil {
+		return today, nil, err
+	}
+	prepareListedNotes(notesInsPtr, isAuth(token))
+	return today, notesInsPtr, nil
+}
+
+// BackfillNoteSlugs generates slugs for notes published before slugs were supported
+func BackfillNoteSlugs() {
+	notesIns, err := selectNotesWithoutSlug(DB, true)
+	if err != nil {
+		log.Logger.WithField("err", err).Warn("select notes without slug failed")
+		return
+	}
+
+	for _, noteIns := range notesIns {
+		_, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
+			return assignNoteSlug(cursor, noteIns.NoteID, noteIns.Title)
+		})
+		if err != nil {
+			log.Logger.WithField("note id", noteIns.NoteID).WithField("err", err).Warn("backfill note slug failed")
+		}
+	}
+	log.Logger.WithField("num of notes", len(notesIns)).Info("done backfilling note slugs")
+}
+
+// BackfillNotePlainText extracts the plain text of notes again and recounts their words. Notes saved before had
+// the texts of adjacent blocks glued together, e.g. "helloworld", and every CJK character counted as a word
+func BackfillNotePlainText() {
+	changed := make([]noteObj, 0)
+	err := selectNotesContent(DB, func(noteIns noteObj) error {
+		plainText, err := extractPlainTextFromHTML(noteIns.Content)
+		if err != nil {
+			log.Logger.WithField("note id", noteIns.ID).WithField("err", err).Warn("extract plain text failed")
+			return nil
+		}
+		if words := countWords(plainText); plainText != noteIns.PlainText || words != noteIns.Words {
+			changed = append(changed, noteObj{ID: noteIns.ID, PlainText: plainText, Words: words})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Logger.WithField("err", err).Warn("select notes content failed")
+		return
+	}
+
+	for _, noteIns := range changed {
+		if _, err := updateNotePlainTextByNoteID(DB, noteIns.ID, noteIns.PlainText, noteIns.Words); err != nil {
+			log.Logger.WithField("note id", noteIns.ID).WithField("err", err).Warn("backfill note plain text failed")
+		}
+	}
+	if len(changed) > 0 {
+		invalidateAllCaches()
+	}
+	log.Logger.WithField("num of notes", len(changed)).Info("done backfilling note plain text")
+}
+
+func getTags() ([]*tagObj, error) {
+	var cacheIns []*tagObj
+	if getCache(tagsCacheKey(), "", &cacheIns) {
+		return cacheIns, nil
+	}
+
 	tagsIns, err := selectTagsWithNotesCount(DB, true)
 	if err != nil {
-		return tagsIns, err
+		return nil, err
+	}
+	ancestorsTagged := map[string]uint32{}
+	for _, name := range missingTagAncestors(tagsIns) {
+		// a note tagged with several descendants is counted once
+		if ancestorsTagged[name], err = selectNotesCountInTagSubtree(DB, name); err != nil {
+			return nil, err
+		}
 	}
-	return tagsIns, nil
+	tagsInsPtr := buildTagTree(tagsIns, ancestorsTagged)
+
+	setCache(tagsCacheKey(), "", tagsInsPtr)
+	return tagsInsPtr, nil
+}
+
+// renameTag renames a tag and all its descendants, e.g. "go" to "lang/go" moves "go/concurrency"
+// to "lang/go/concurrency" as well
+func renameTag(tagID uint32, name string) error {
+	names := normalizeTagNames([]string{name})
+	if len(names) <= 0 {
+		return paramsErr
+	}
+	newName := names[0]
+
+	_, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
+		tagsIns, err := selectTagsByID(cursor, true, true, tagID)
+		if err != nil {
+			return 0, err
+		}
+		if len(tagsIns) <= 0 {
+			return 0, tagNotExistsErr
+		}
+
+		oldName := tagsIns[0].Name
+		if oldName == newName {
+			return 0, nil
+		}
+		// a tag can not be moved under itself
+		if strings.HasPrefix(newName, oldName+tagSeparator) {
+			return 0, paramsErr
+		}
+
+		cnt, err := selectTagsCountInSubtree(cursor, newName, true)
+		if err != nil {
+			return 0, err
+		}
+		if cnt > 0 {
+			return 0, tagExistsErr
+		}
+
+		rowsAffected, err := renameTagsInSubtree(cursor, oldName, newName)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = renameNoteTagsInSubtree(cursor, oldName, newName)
+		if err != nil {
+			return 0, err
+		}
+
+		if ancestors := withTagAncestors([]string{newName})[1:]; len(ancestors) > 0 {
+			_, err = insertTags(cursor, true, ancestors...)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return rowsAffected, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	invalidateAllCaches()
+
+	// the old ancestors may be unused now
+	go cleanUnusedTags()
+
+	return nil
+}
+
+// moveTagInto renames a tag to name, or merges it into the tag of that name if there is one
+func moveTagInto(cursor cursorObj, tagIns tagObj, name string) error {
+	existingIns, err := selectTagsByName(cursor, true, true, name)
+	if err != nil {
+		return err
+	}
+	if len(existingIns) <= 0 {
+		if _, err := updateTagNameByTagID(cursor, tagIns.ID, name); err != nil {
+			return err
+		}
+		// ancestors may be missing for tags created before nesting was supported
+		_, err := insertTags(cursor, true, withTagAncestors([]string{name})...)
+		return err
+	}
+
+	if _, err := mergeNoteTags(cursor, existingIns[0], tagIns.ID); err != nil {
+		return err
+	}
+	if _, err := deleteNoteTagsByTagID(cursor, tagIns.ID); err != nil {
+		return err
+	}
+	_, err = deleteTagsByID(cursor, tagIns.ID)
+	return err
+}
+
+// mergeTags moves the notes of the source tags to the target tag and deletes the source tags. Descendants of the
+// source tags move under the target tag, e.g. merging "lang" into "code" moves "lang/go" to "code/go", which is
+// merged into "code/go" if that exists
+func mergeTags(targetID uint32, srcIDs ...uint32) error {
+	var ids []uint32
+	for _, id := range srcIDs {
+		if id != targetID && !containsUint32(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) <= 0 {
+		return paramsErr
+	}
+
+	_, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
+		targetsIns, err := selectTagsByID(cursor, true, true, targetID)
+		if err != nil {
+			return 0, err
+		}
+		if len(targetsIns) <= 0 {
+			return 0, tagNotExistsErr
+		}
+
+		srcsIns, err := selectTagsByID(cursor, true, true, ids...)
+		if err != nil {
+			return 0, err
+		}
+		if len(srcsIns) != len(ids) {
+			return 0, tagNotExistsErr
+		}
+
+		// a tag can not be merged with its ancestors or descendants
+		allIns := append([]tagObj{targetsIns[0]}, srcsIns...)
+		for _, ancestorIns := range allIns {
+			for _, tagIns := range allIns {
+				if strings.HasPrefix(tagIns.Name, ancestorIns.Name+tagSeparator) {
+					return 0, paramsErr
+				}
+			}
+		}
+
+		for _, srcIns := range srcsIns {
+			subtreeIns, err := selectTagsInSubtree(cursor, srcIns.Name, true, true)
+			if err != nil {
+				return 0, err
+			}
+			// parents come first, so the parent of a moved tag is always in place
+			for _, tagIns := range subtreeIns {
+				if tagIns.ID == srcIns.ID {
+					continue
+				}
+				name := targetsIns[0].Name + strings.TrimPrefix(tagIns.Name, srcIns.Name)
+				if err := moveTagInto(cursor, tagIns, name); err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		_, err = mergeNoteTags(cursor, targetsIns[0], ids...)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = deleteNoteTagsByTagID(cursor, ids...)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := deleteTagsByID(cursor, ids...)
+		if err != nil {
+			return 0, err
+		}
+
+		return rowsAffected, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	invalidateAllCaches()
+
+	go cleanUnusedTags()
+
+	return nil
+}
+
+func updateTag(tagID uint32, description string, color string, slug string) error {
+	_, err := withTransaction(func(cursor cursorObj) (i interface{}, e error) {
+		tagsIns, err := selectTagsByID(cursor, true, true, tagID)
+		if err != nil {
+			return 0, err
+		}
+		if len(tagsIns) <= 0 {
+			return 0, tagNotExistsErr
+		}
+
+		if slug != "" {
+			slugTagID, err := selectTagIDBySlug(cursor, slug)
+			if err != nil {
+				return 0, err
+			}
+			if slugTagID != 0 && slugTagID != tagID {
+				return 0, tagExistsErr
+			}
+		}
+
+		// slug is unique, so an empty one is stored as null
+		return updateTagByTagID(cursor, tagID, description, color, sql.NullString{String: slug, Valid: slug != ""})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	deleteCache(tagsCacheKey())
+
+	return nil
 }
 
 func cleanUnusedTags() {
@@ -247,6 +1088,9 @@ func cleanUnusedTags() {
 		log.Logger.WithField("err", err).Warn("clean up unused tags error")
 	} else {
 		log.Logger.WithField("num of unused tags deleted", deletedTagsNum).Info()
+		if deletedTagsNum > 0 {
+			deleteCache(tagsCacheKey())
+		}
 	}
 	log.Logger.Info("done cleaning up unused tags")
 }
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestBackfillNotePlainText(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"cache.enabled": false})
+	plainText, err := extractPlainTextFromHTML("<p>hello</p><p>world</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// note 1 was saved with the blocks glued together
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text, words, update_at)
+					values (1, 'Old', 'me', '<p>hello</p><p>world</p>', 'helloworld', 1, '2020-01-01 00:00:00'),
+					(2, 'New', 'me', '<p>hello</p><p>world</p>', ?, ?, '2020-01-01 00:00:00')`,
+		plainText, countWords(plainText))
+
+	BackfillNotePlainText()
+
+	for _, noteID := range []uint32{1, 2} {
+		var stored, updateAt string
+		var words uint32
+		err := db.QueryRow("select plain_text, words, update_at from notebook.note where id = ?", noteID).
+			Scan(&stored, &words, &updateAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != plainText || words != 2 || updateAt != "2020-01-01 00:00:00" {
+			t.Errorf("note %d: %q, %d words, updated at %s", noteID, stored, words, updateAt)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/sirupsen/logrus"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// doc/tbl.sql is translated to sqlite, so that the tests run against the real schema without a mysql server
+var testSchemaReplacements = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?m)^(\s*)id(\s+)int\s+not null auto_increment,`), "${1}id${2}integer primary key autoincrement,"},
+	{regexp.MustCompile(`(?m)^\s*primary key \(id\),?\n`), ""},
+	{regexp.MustCompile(`(?m)^\s*index \w+ \([^)]*\),?\n`), ""},
+	{regexp.MustCompile(`unique key (?:\w+ )?\(`), "unique ("},
+	{regexp.MustCompile(` on update current_timestamp`), ""},
+	// the mysql driver returns timestamps as text, which the code parses with dbTimeLayout
+	{regexp.MustCompile(`\btimestamp\b(\s+not null default current_timestamp)`), "text$1"},
+	// the tables are utf8 with its case insensitive default collation
+	{regexp.MustCompile(`\b((?:var)?char\(\d+\))`), "$1 collate nocase"},
+	{regexp.MustCompile(`\)\s*ENGINE[^;]*;`), ");"},
+	// a trailing comma is left behind by the removed indexes
+	{regexp.MustCompile(`,(\s*\n\);)`), "$1"},
+}
+
+// mysqlCompatDriverObj rewrites the mysql statements of the store into sqlite ones
+type mysqlCompatDriverObj struct {
+	driver.Driver
+}
+
+type mysqlCompatConnObj struct {
+	driver.Conn
+}
+
+var mysqlCompatReplacer = strings.NewReplacer("insert ignore into", "insert or ignore into", " for update", "")
+
+func (d *mysqlCompatDriverObj) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlCompatConnObj{Conn: conn}, nil
+}
+
+func (c *mysqlCompatConnObj) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(mysqlCompatReplacer.Replace(query))
+}
+
+func (c *mysqlCompatConnObj) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func TestMain(m *testing.M) {
+	log.Logger = logrus.New()
+	log.Logger.SetOutput(ioutil.Discard)
+
+	// the tables are in the "notebook" schema, which sqlite has as an attached database
+	sqlite.RegisterConnectionHook(func(conn sqlite.ExecQuerierContext, dsn string) error {
+		path := strings.Split(dsn, "?")[0]
+		_, err := conn.ExecContext(context.Background(), "attach database ? as notebook",
+			[]driver.NamedValue{{Ordinal: 1, Value: filepath.Join(filepath.Dir(path), "notebook.db")}})
+		return err
+	})
+	// the mysql syntax used by the queries which sqlite does not have
+	db, err := sql.Open("sqlite", "")
+	if err != nil {
+		panic(err)
+	}
+	sql.Register("sqlite_mysql", &mysqlCompatDriverObj{Driver: db.Driver()})
+	_ = db.Close()
+	// the mysql functions used by the queries which sqlite does not have
+	sqlite.MustRegisterDeterministicScalarFunction("char_length", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, _ := args[0].(string)
+		return int64(len([]rune(s))), nil
+	})
+	sqlite.MustRegisterDeterministicScalarFunction("left", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, _ := args[0].(string)
+		n, _ := args[1].(int64)
+		if runes := []rune(s); int64(len(runes)) > n {
+			return string(runes[:n]), nil
+		}
+		return s, nil
+	})
+
+	os.Exit(m.Run())
+}
+
+// testSchema returns the statements creating the tables of doc/tbl.sql in sqlite
+func testSchema(t *testing.T) []string {
+	data, err := ioutil.ReadFile(filepath.Join("..", "doc", "tbl.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := string(data)
+	for _, replacement := range testSchemaReplacements {
+		schema = replacement.re.ReplaceAllString(schema, replacement.repl)
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(schema, ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// openTestDB opens an empty database with the schema as DB. It is closed when the test ends, but stays DB
+// so that goroutines left behind, e.g. cleanUnusedTags, fail instead of panicking
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite_mysql", filepath.Join(t.TempDir(), "main.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range testSchema(t) {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s\n%s", err, statement)
+		}
+	}
+
+	DB = db
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+// setTestConfig sets config keys for one test, viper has no way to unset them so the previous values are put back
+func setTestConfig(t *testing.T, values map[string]interface{}) {
+	for key, value := range values {
+		prev, isSet := viper.Get(key), viper.IsSet(key)
+		viper.Set(key, value)
+		t.Cleanup(func() {
+			if isSet {
+				viper.Set(key, prev)
+			} else {
+				viper.Set(key, nil)
+			}
+		})
+	}
+}
+
+func mustExec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+}
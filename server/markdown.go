@@ -0,0 +1,330 @@
+package server
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var whitespaceRegexp = regexp.MustCompile(`\s+`)
+
+// characters which start a block when they begin a line, e.g. "# not a heading"
+var markdownLineStartRegexp = regexp.MustCompile(`^(#|>|[-+*] |\d+[.)] )`)
+
+// brackets are not escaped, so that wiki links such as "[[Note Title]]" survive
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "<", `\<`)
+
+// elements without a markdown equivalent, kept as html which markdown allows
+var markdownRawBlockTags = map[string]bool{
+	"audio": true, "details": true, "dl": true, "iframe": true, "video": true,
+}
+
+var markdownRawInlineTags = map[string]bool{
+	"kbd": true, "mark": true, "sub": true, "sup": true, "u": true,
+}
+
+// ------------------------------------------------------------------
+
+// htmlToMarkdown converts the html content of a note to CommonMark with GFM tables and strikethrough
+func htmlToMarkdown(content string) (string, error) {
+	var body *html.Node
+	_, err := transformFragment(content, func(sel *goquery.Selection) {
+		body = sel.Nodes[0]
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(markdownBlocks(body), "\n\n") + "\n", nil
+}
+
+// markdownBlocks converts the children of node to markdown blocks, runs of inline children become paragraphs
+func markdownBlocks(node *html.Node) []string {
+	blocks := make([]string, 0)
+	var inline strings.Builder
+	flush := func() {
+		if paragraph := markdownParagraph(inline.String()); paragraph != "" {
+			blocks = append(blocks, paragraph)
+		}
+		inline.Reset()
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.CommentNode {
+			// the excerpt marker
+			if moreMarkerRegexp.MatchString("<!--" + child.Data + "-->") {
+				flush()
+				blocks = append(blocks, "<!--more-->")
+			}
+			continue
+		}
+		// a line break stays in its paragraph
+		if child.Type != html.ElementNode || child.Data == "br" || !blockTags[child.Data] && !markdownRawBlockTags[child.Data] {
+			inline.WriteString(markdownInline(child))
+			continue
+		}
+		flush()
+		if block := markdownBlock(child); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	flush()
+	return blocks
+}
+
+func markdownBlock(node *html.Node) string {
+	if markdownRawBlockTags[node.Data] {
+		return renderHTML(node)
+	}
+
+	switch node.Data {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level, _ := strconv.Atoi(node.Data[1:])
+		text := markdownParagraph(markdownInlineChildren(node))
+		if text == "" {
+			return ""
+		}
+		return strings.Repeat("#", level) + " " + strings.Replace(text, "\\\n", " ", -1)
+	case "p":
+		return markdownParagraph(markdownInlineChildren(node))
+	case "hr":
+		return "---"
+	case "pre":
+		return markdownCodeBlock(node)
+	case "blockquote":
+		return prefixLines(strings.Join(markdownBlocks(node), "\n\n"), "> ", ">")
+	case "ul", "ol":
+		return markdownList(node)
+	case "table":
+		return markdownTable(node)
+	default:
+		// div, section, figure and the like only group their children
+		return strings.Join(markdownBlocks(node), "\n\n")
+	}
+}
+
+// markdownParagraph tidies the inline markdown of a paragraph, so that it does not start another kind of block
+func markdownParagraph(inline string) string {
+	lines := strings.Split(inline, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line == `\` {
+			continue
+		}
+		if loc := markdownLineStartRegexp.FindStringIndex(line); loc != nil {
+			if line[0] >= '0' && line[0] <= '9' {
+				line = line[:loc[1]-2] + `\` + line[loc[1]-2:]
+			} else {
+				line = `\` + line
+			}
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSuffix(strings.Join(kept, "\n"), `\`)
+}
+
+func markdownInlineChildren(node *html.Node) string {
+	var sb strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		sb.WriteString(markdownInline(child))
+	}
+	return sb.String()
+}
+
+// markdownInline converts an inline node, block elements nested in inline ones are flattened
+func markdownInline(node *html.Node) string {
+	switch node.Type {
+	case html.TextNode:
+		return markdownEscaper.Replace(whitespaceRegexp.ReplaceAllString(node.Data, " "))
+	case html.ElementNode:
+	default:
+		return ""
+	}
+	if excerptDroppedTags[node.Data] {
+		return ""
+	}
+	if markdownRawInlineTags[node.Data] || markdownRawBlockTags[node.Data] {
+		return renderHTML(node)
+	}
+
+	switch node.Data {
+	case "br":
+		// a backslash at the end of a line is a hard line break
+		return "\\\n"
+	case "strong", "b":
+		return wrapInline(markdownInlineChildren(node), "**")
+	case "em", "i":
+		return wrapInline(markdownInlineChildren(node), "*")
+	case "del", "s", "strike":
+		return wrapInline(markdownInlineChildren(node), "~~")
+	case "code":
+		return markdownCodeSpan(nodeText(node))
+	case "img":
+		return "![" + markdownEscaper.Replace(attrValue(node, "alt")) + "](" + markdownURL(attrValue(node, "src"), attrValue(node, "title")) + ")"
+	case "a":
+		text := markdownInlineChildren(node)
+		href := attrValue(node, "href")
+		if href == "" || strings.TrimSpace(text) == "" {
+			return text
+		}
+		return "[" + strings.TrimSpace(text) + "](" + markdownURL(href, attrValue(node, "title")) + ")"
+	default:
+		text := markdownInlineChildren(node)
+		if blockTags[node.Data] {
+			return " " + text + " "
+		}
+		return text
+	}
+}
+
+// wrapInline puts the delimiter around text, spaces are moved outside since "** bold**" is not bold
+func wrapInline(text string, delimiter string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	prefix := text[:strings.Index(text, trimmed)]
+	suffix := text[len(prefix)+len(trimmed):]
+	return prefix + delimiter + trimmed + delimiter + suffix
+}
+
+func markdownCodeSpan(code string) string {
+	fence := "`"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+		code = " " + code + " "
+	}
+	return fence + code + fence
+}
+
+func markdownURL(url string, title string) string {
+	url = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(url)
+	if title == "" {
+		return url
+	}
+	return url + ` "` + strings.Replace(title, `"`, `\"`, -1) + `"`
+}
+
+// markdownCodeBlock converts "<pre><code class="language-go">" to a fenced code block
+func markdownCodeBlock(node *html.Node) string {
+	code := strings.TrimSuffix(nodeText(node), "\n")
+	language := ""
+	if child := node.FirstChild; child != nil && child.Type == html.ElementNode && child.Data == "code" {
+		for _, class := range strings.Fields(attrValue(child, "class")) {
+			if strings.HasPrefix(class, "language-") {
+				language = strings.TrimPrefix(class, "language-")
+				break
+			}
+		}
+	}
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + language + "\n" + code + "\n" + fence
+}
+
+func markdownList(node *html.Node) string {
+	items := make([]string, 0)
+	number := 1
+	if start, err := strconv.Atoi(attrValue(node, "start")); err == nil {
+		number = start
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || child.Data != "li" {
+			continue
+		}
+		marker := "- "
+		if node.Data == "ol" {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		item := strings.Join(markdownBlocks(child), "\n\n")
+		indent := strings.Repeat(" ", len(marker))
+		items = append(items, marker+strings.TrimPrefix(prefixLines(item, indent, ""), indent))
+	}
+	return strings.Join(items, "\n")
+}
+
+func markdownTable(node *html.Node) string {
+	var rows [][]string
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			if child.Data != "tr" {
+				walk(child)
+				continue
+			}
+			var cells []string
+			for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.Data == "td" || cell.Data == "th") {
+					text := strings.Replace(markdownParagraph(markdownInlineChildren(cell)), "\\\n", " ", -1)
+					cells = append(cells, strings.Replace(strings.Replace(text, "\n", " ", -1), "|", `\|`, -1))
+				}
+			}
+			rows = append(rows, cells)
+		}
+	}
+	walk(node)
+	if len(rows) <= 0 {
+		return ""
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	lines := make([]string, 0, len(rows)+1)
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		// the first row is always the header in gfm
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", columns))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// prefixLines prefixes every line of text, empty lines get emptyPrefix instead
+func prefixLines(text string, prefix string, emptyPrefix string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line == "" {
+			lines[i] = emptyPrefix
+		} else {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func nodeText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	var sb strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		sb.WriteString(nodeText(child))
+	}
+	return sb.String()
+}
+
+func renderHTML(node *html.Node) string {
+	var sb strings.Builder
+	if err := html.Render(&sb, node); err != nil {
+		return ""
+	}
+	return sb.String()
+}
@@ -2,50 +2,136 @@ package server
 
 import (
 	"database/sql"
+	"io"
 	"net/http"
+	"time"
 )
 
 type apiFunc func(resp http.ResponseWriter, req *http.Request) (interface{}, int, error)
 
 type txFunc func(cursor cursorObj) (interface{}, error)
 
+type transformFunc func(ctx *transformCtxObj, content string) (string, error)
+
+type shortcodeFunc func(ctx *transformCtxObj, args []string) (string, error)
+
 type cursorObj interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
 	Query(query string, args ...interface{}) (*sql.Rows, error)
 	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
+type transformCtxObj struct {
+	Cursor cursorObj
+	NoteID uint32
+	Stage  string
+	IsAuth bool
+}
+
+type linkRewriteRuleObj struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+// cacheableObj is implemented by responses which can be validated by ETag and Last-Modified
+type cacheableObj interface {
+	lastModified() time.Time
+	hasPrivateNote() bool
+}
+
+// fileObj is a response sent as a file download instead of json, Write streams the body to the client
+// after the headers are sent
+type fileObj struct {
+	Name        string
+	ContentType string
+	Write       func(w io.Writer) error
+}
+
 type noteObj struct {
 	ID        uint32   `json:"id"`
 	Title     string   `json:"title"`
 	Author    string   `json:"author"`
 	Content   string   `json:"content"`
 	PlainText string   `json:"plain_text"`
+	Excerpt   string   `json:"excerpt"`
 	Private   bool     `json:"private"`
 	Words     uint32   `json:"words"`
+	Slug      string   `json:"slug"`
 	Tags      []tagObj `json:"tags"`
 	CreatedAt string   `json:"created_at"`
 	UpdateAt  string   `json:"update_at"`
 }
 
-type notesInsPtrSlice []*noteObj
+type tagObj struct {
+	ID          uint32    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Color       string    `json:"color,omitempty"`
+	Slug        string    `json:"slug,omitempty"`
+	Tagged      uint32    `json:"tagged"`
+	Children    []*tagObj `json:"children,omitempty"`
+}
 
-func (ns notesInsPtrSlice) Len() int {
-	return len(ns)
+type noteLinkObj struct {
+	Target  string `json:"-"`
+	NoteID  uint32 `json:"id"`
+	Title   string `json:"title"`
+	Private bool   `json:"private"`
 }
 
-func (ns notesInsPtrSlice) Less(i int, j int) bool {
-	return ns[i].UpdateAt > ns[j].UpdateAt
+type attachmentObj struct {
+	ID        uint32        `json:"id"`
+	SHA256    string        `json:"sha256"`
+	Name      string        `json:"name"`
+	MIME      string        `json:"mime"`
+	Size      int64         `json:"size"`
+	Width     int           `json:"width,omitempty"`
+	Height    int           `json:"height,omitempty"`
+	URL       string        `json:"url"`
+	CreatedAt string        `json:"created_at"`
+	Notes     []noteLinkObj `json:"notes,omitempty"`
 }
 
-func (ns notesInsPtrSlice) Swap(i int, j int) {
-	ns[i], ns[j] = ns[j], ns[i]
+type seriesObj struct {
+	ID          uint32        `json:"id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Count       uint32        `json:"count"`
+	Notes       []noteLinkObj `json:"notes"`
+	CreatedAt   string        `json:"created_at"`
+	UpdateAt    string        `json:"update_at"`
 }
 
-type tagObj struct {
-	ID     uint32 `json:"id"`
-	Name   string `json:"name"`
-	Tagged uint32 `json:"tagged"`
+type seriesNavObj struct {
+	ID       uint32       `json:"id"`
+	Title    string       `json:"title"`
+	Position uint32       `json:"position"`
+	Total    uint32       `json:"total"`
+	Prev     *noteLinkObj `json:"prev"`
+	Next     *noteLinkObj `json:"next"`
+}
+
+type archiveObj struct {
+	Year  uint32 `json:"year"`
+	Month uint32 `json:"month"`
+	Count uint32 `json:"count"`
+}
+
+type calendarDayObj struct {
+	Date  string `json:"date"`
+	Count uint32 `json:"count"`
+	Words uint32 `json:"words"`
+}
+
+type graphNodeObj struct {
+	ID      uint32 `json:"id"`
+	Title   string `json:"title"`
+	Private bool   `json:"private"`
+}
+
+type graphEdgeObj struct {
+	Source uint32 `json:"source"`
+	Target uint32 `json:"target"`
 }
 
 type pageObj struct {
@@ -63,6 +149,7 @@ type noteSqlObj struct {
 	PlainText string
 	Auth      bool
 	Words     uint32
+	Slug      string
 	CreatedAt string
 	UpdatedAt string
 	TagID     sql.NullInt64
@@ -84,19 +171,103 @@ type noteUpdateReqObj struct {
 	Private bool     `json:"private"`
 }
 
+// notes are paged by "page_no" unless "cursor" is given or "mode" is "cursor",
+// an empty cursor in cursor mode returns the first page
 type notesReqObj struct {
-	PageNo uint32 `json:"page_no"`
-	Tag    uint32 `json:"tag"`
+	PageNo     uint32   `json:"page_no"`
+	Tag        uint32   `json:"tag"`
+	Tags       []uint32 `json:"tags"`
+	TagMode    string   `json:"tag_mode"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Visibility string   `json:"visibility"`
+	Author     string   `json:"author"`
+	Sort       string   `json:"sort"`
+	Order      string   `json:"order"`
+	Mode       string   `json:"mode"`
+	Cursor     string   `json:"cursor"`
+}
+
+// notesFilterObj is normalized by "normalizeNotesFilter", From and To are then the bounds of created_at
+type notesFilterObj struct {
+	Tags       []uint32 `json:"tags"`
+	TagMode    string   `json:"tag_mode"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Visibility string   `json:"visibility"`
+	Author     string   `json:"author"`
+	Sort       string   `json:"sort"`
+	Order      string   `json:"order"`
+}
+
+// notesCursorObj is the sort value and id of the last note of a page, encoded into the opaque cursor
+type notesCursorObj struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    uint32 `json:"i"`
 }
 
 type noteReqObj struct {
 	NoteID uint32 `json:"note_id"`
+	Slug   string `json:"slug"`
 }
 
 type noteDeleteReqObj struct {
 	NoteID uint32 `json:"note_id"`
 }
 
+type tagRenameReqObj struct {
+	TagID uint32 `json:"tag_id"`
+	Name  string `json:"name"`
+}
+
+type tagMergeReqObj struct {
+	TagIDs   []uint32 `json:"tag_ids"`
+	TargetID uint32   `json:"target_id"`
+}
+
+type tagUpdateReqObj struct {
+	TagID       uint32 `json:"tag_id"`
+	Description string `json:"description"`
+	Color       string `json:"color"`
+	Slug        string `json:"slug"`
+}
+
+type seriesReqObj struct {
+	SeriesID uint32 `json:"series_id"`
+}
+
+type attachmentReqObj struct {
+	AttachmentID uint32 `json:"attachment_id"`
+}
+
+type archiveMonthReqObj struct {
+	Year   uint32 `json:"year"`
+	Month  uint32 `json:"month"`
+	PageNo uint32 `json:"page_no"`
+}
+
+type calendarReqObj struct {
+	Year uint32 `json:"year"`
+}
+
+type seriesCreateReqObj struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	NoteIDs     []uint32 `json:"note_ids"`
+}
+
+type seriesUpdateReqObj struct {
+	SeriesID    uint32   `json:"series_id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	NoteIDs     []uint32 `json:"note_ids"`
+}
+
+type seriesDeleteReqObj struct {
+	SeriesID uint32 `json:"series_id"`
+}
+
 type authReqObj struct {
 	Password string `json:"password"`
 }
@@ -112,6 +283,7 @@ type RespObj struct {
 
 type notePublishRespObj struct {
 	NoteID uint32 `json:"note_id"`
+	Slug   string `json:"slug"`
 }
 
 type noteUpdateRespObj struct {
@@ -123,16 +295,75 @@ type noteDeleteRespObj struct {
 }
 
 type notesRespObj struct {
-	Notes []*noteObj `json:"notes"`
-	Page  pageObj    `json:"page"`
+	Notes      []*noteObj `json:"notes"`
+	Page       pageObj    `json:"page"`
+	NextCursor string     `json:"next_cursor,omitempty"`
 }
 
 type noteRespObj struct {
-	Note *noteObj `json:"note"`
+	Note      *noteObj      `json:"note"`
+	Backlinks []noteLinkObj `json:"backlinks"`
+	Series    *seriesNavObj `json:"series"`
+	Redirect  string        `json:"redirect,omitempty"`
+	// the Last-Modified of the response, see selectNoteModifiedAt
+	ModifiedAt time.Time `json:"-"`
+}
+
+type noteGraphRespObj struct {
+	Nodes []graphNodeObj `json:"nodes"`
+	Edges []graphEdgeObj `json:"edges"`
 }
 
 type tagsRespObj struct {
-	Tags []tagObj `json:"tags"`
+	Tags []*tagObj `json:"tags"`
+}
+
+type archiveRespObj struct {
+	Archive []archiveObj `json:"archive"`
+}
+
+type onThisDayRespObj struct {
+	Date  string     `json:"date"`
+	Notes []*noteObj `json:"notes"`
+}
+
+type calendarRespObj struct {
+	Year  uint32           `json:"year"`
+	Days  []calendarDayObj `json:"days"`
+	Count uint32           `json:"count"`
+	Words uint32           `json:"words"`
+}
+
+type tagRenameRespObj struct {
+	TagID uint32 `json:"tag_id"`
+}
+
+type tagMergeRespObj struct {
+	TagID uint32 `json:"tag_id"`
+}
+
+type tagUpdateRespObj struct {
+	TagID uint32 `json:"tag_id"`
+}
+
+type seriesRespObj struct {
+	Series *seriesObj `json:"series"`
+}
+
+type seriesListRespObj struct {
+	Series []seriesObj `json:"series"`
+}
+
+type seriesCreateRespObj struct {
+	SeriesID uint32 `json:"series_id"`
+}
+
+type seriesUpdateRespObj struct {
+	SeriesID uint32 `json:"series_id"`
+}
+
+type seriesDeleteRespObj struct {
+	SeriesID uint32 `json:"series_id"`
 }
 
 type authRespObj struct {
@@ -142,3 +373,64 @@ type authRespObj struct {
 type isAuthRespObj struct {
 	IsAuth bool `json:"is_auth"`
 }
+
+// ------------------------------------------------------------------
+
+func (r noteRespObj) lastModified() time.Time {
+	return r.ModifiedAt
+}
+
+func (r noteRespObj) hasPrivateNote() bool {
+	return r.Note != nil && r.Note.Private
+}
+
+// the listing also changes when notes are deleted, which leaves no update time behind
+func (r notesRespObj) lastModified() time.Time {
+	return time.Time{}
+}
+
+func (r notesRespObj) hasPrivateNote() bool {
+	for _, noteInsPtr := range r.Notes {
+		if noteInsPtr.Private {
+			return true
+		}
+	}
+	return false
+}
+
+func (r tagsRespObj) lastModified() time.Time {
+	return time.Time{}
+}
+
+func (r tagsRespObj) hasPrivateNote() bool {
+	return false
+}
+
+func (r archiveRespObj) lastModified() time.Time {
+	return time.Time{}
+}
+
+func (r archiveRespObj) hasPrivateNote() bool {
+	return false
+}
+
+func (r onThisDayRespObj) lastModified() time.Time {
+	return time.Time{}
+}
+
+func (r onThisDayRespObj) hasPrivateNote() bool {
+	for _, noteInsPtr := range r.Notes {
+		if noteInsPtr.Private {
+			return true
+		}
+	}
+	return false
+}
+
+func (r calendarRespObj) lastModified() time.Time {
+	return time.Time{}
+}
+
+func (r calendarRespObj) hasPrivateNote() bool {
+	return false
+}
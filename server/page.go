@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gorilla/mux"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every page template is parsed together with "base.html" of the theme in "page.template_dir"
+var pageTemplateNames = []string{"note.html", "notes.html", "archive.html"}
+
+var pageTemplates map[string]*template.Template
+
+var pageTemplatesLock sync.Mutex
+
+var pageFuncs = template.FuncMap{
+	"noteLink": noteLink,
+	"tagLink":  tagLink,
+	"pageLink": pageLink,
+	"absURL":   absoluteURL,
+	"safeHTML": func(s string) template.HTML { return template.HTML(s) },
+	"pages": func(pageIns pageObj) []uint32 {
+		var pages []uint32
+		for i := pageIns.Left; i <= pageIns.Right && i > 0; i++ {
+			pages = append(pages, i)
+		}
+		return pages
+	},
+	"prevPage": func(pageIns pageObj) uint32 { return pageIns.Cur - 1 },
+	"nextPage": func(pageIns pageObj) uint32 { return pageIns.Cur + 1 },
+	"date": func(value string) string {
+		return parseDBTime(value).Format(dateLayout)
+	},
+	"isoTime": func(value string) string {
+		return parseDBTime(value).Format(time.RFC3339)
+	},
+}
+
+// ------------------------------------------------------------------
+
+// metaObj is rendered as the title, description and Open Graph / Twitter card tags of the page
+type metaObj struct {
+	Title       string
+	Description string
+	URL         string
+	Image       string
+	Type        string
+	NoIndex     bool
+}
+
+type pageDataObj struct {
+	SiteTitle string
+	Static    bool
+	Meta      metaObj
+	IsAuth    bool
+	Note      *noteObj
+	Backlinks []noteLinkObj
+	Series    *seriesNavObj
+	Notes     []*noteObj
+	Page      pageObj
+	BasePath  string
+	Tag       *tagObj
+	Archive   []archiveObj
+	Year      uint32
+	Month     uint32
+}
+
+// a note page shows backlinks, series and link titles of other notes, which may change without touching the note
+func (d pageDataObj) lastModified() time.Time {
+	return time.Time{}
+}
+
+func (d pageDataObj) hasPrivateNote() bool {
+	if d.Note != nil && d.Note.Private {
+		return true
+	}
+	for _, noteInsPtr := range d.Notes {
+		if noteInsPtr.Private {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------
+
+func tagLink(tagIns tagObj) string {
+	if tagIns.Slug != "" {
+		return "/tag/" + tagIns.Slug
+	}
+	return fmt.Sprintf("/tag/%d", tagIns.ID)
+}
+
+// firstImageSrc returns the absolute url of the first image of the content, for link previews
+func firstImageSrc(content string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return ""
+	}
+	src, ok := doc.Find("img[src]").First().Attr("src")
+	if !ok || !isSafeURL(src) {
+		return ""
+	}
+	if strings.HasPrefix(src, "/") && !strings.HasPrefix(src, "//") {
+		return absoluteURL(src)
+	}
+	return src
+}
+
+// pageLink returns the path of the page of a listing, e.g. "/tag/3/page/2", the first page is the listing itself
+func pageLink(basePath string, pageNo uint32) string {
+	if pageNo <= 1 {
+		return basePath
+	}
+	if basePath == "/" {
+		return fmt.Sprintf("/page/%d", pageNo)
+	}
+	return fmt.Sprintf("%s/page/%d", basePath, pageNo)
+}
+
+// loadPageTemplates parses the templates of the theme once, or on every call if "page.reload" is set
+// so that themes can be edited without restarting
+func loadPageTemplates() (map[string]*template.Template, error) {
+	pageTemplatesLock.Lock()
+	defer pageTemplatesLock.Unlock()
+	if pageTemplates != nil && !viper.GetBool("page.reload") {
+		return pageTemplates, nil
+	}
+
+	dir := viper.GetString("page.template_dir")
+	templates := map[string]*template.Template{}
+	for _, name := range pageTemplateNames {
+		tmpl, err := template.New(name).Funcs(pageFuncs).ParseFiles(filepath.Join(dir, "base.html"), filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = tmpl
+	}
+	pageTemplates = templates
+	return pageTemplates, nil
+}
+
+func renderPage(name string, dataIns *pageDataObj) ([]byte, error) {
+	templates, err := loadPageTemplates()
+	if err != nil {
+		return nil, err
+	}
+	dataIns.SiteTitle = viper.GetString("page.site_title")
+	if dataIns.Meta.Image == "" {
+		dataIns.Meta.Image = viper.GetString("page.image")
+	}
+
+	var buf bytes.Buffer
+	if err := templates[name].ExecuteTemplate(&buf, "base.html", dataIns); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ------------------------------------------------------------------
+
+// notePageData looks up the note by id or slug, the current slug is returned if an old one is used
+func notePageData(idOrSlug string, token string) (*pageDataObj, string, error) {
+	var noteInsPtr *noteObj
+	var redirect string
+	var err error
+	if noteID, parseErr := strconv.ParseUint(idOrSlug, 10, 32); parseErr == nil {
+		noteInsPtr, err = getNote(uint32(noteID), token)
+	} else {
+		noteInsPtr, redirect, err = getNoteBySlug(idOrSlug, token)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if redirect != "" {
+		return nil, redirect, nil
+	}
+
+	backlinksIns, err := getBacklinks(noteInsPtr.ID, token)
+	if err != nil {
+		return nil, "", err
+	}
+	seriesNavInsPtr, err := getSeriesNav(noteInsPtr.ID, token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	description := noteInsPtr.PlainText
+	if description != "" {
+		description = cutPlainText(description, viper.GetInt("note.digest_length"))
+	}
+	return &pageDataObj{
+		IsAuth: isAuth(token), Note: noteInsPtr, Backlinks: backlinksIns, Series: seriesNavInsPtr,
+		Meta: metaObj{
+			Title: noteInsPtr.Title, Description: description, URL: absoluteURL(noteLink(noteInsPtr.ID)),
+			Image: firstImageSrc(noteInsPtr.Content), Type: "article", NoIndex: noteInsPtr.Private,
+		},
+	}, "", nil
+}
+
+// notesPageData returns a page of all notes, or of the notes of the tag if tagID is not 0,
+// private notes are left out instead of hidden if publicOnly is set
+func notesPageData(pageNo uint32, tagID uint32, publicOnly bool, token string) (*pageDataObj, error) {
+	dataIns := &pageDataObj{
+		IsAuth: isAuth(token), BasePath: "/",
+		Meta: metaObj{Title: viper.GetString("page.site_title"), Description: viper.GetString("page.site_description"), Type: "website"},
+	}
+
+	filterIns := notesFilterObj{}
+	if publicOnly {
+		filterIns.Visibility = visibilityPublic
+	}
+	if tagID != 0 {
+		tagsIns, err := selectTagsByID(DB, true, false, tagID)
+		if err != nil {
+			return nil, err
+		}
+		if len(tagsIns) <= 0 {
+			return nil, tagNotExistsErr
+		}
+		dataIns.Tag = &tagsIns[0]
+		dataIns.BasePath = tagLink(tagsIns[0])
+		dataIns.Meta.Title = tagsIns[0].Name
+		filterIns.Tags = []uint32{tagID}
+	}
+	if err := normalizeNotesFilter(&filterIns); err != nil {
+		return nil, err
+	}
+
+	notesInsPtr, pageIns, err := getNotes(pageNo, &filterIns, token)
+	if err != nil {
+		return nil, err
+	}
+	// pages out of range are not found, except the first one of an empty listing
+	if pageNo > 1 && len(notesInsPtr) <= 0 {
+		return nil, paramsErr
+	}
+	dataIns.Notes, dataIns.Page = notesInsPtr, pageIns
+	dataIns.Meta.URL = absoluteURL(pageLink(dataIns.BasePath, pageNo))
+	return dataIns, nil
+}
+
+func archivePageData(token string) (*pageDataObj, error) {
+	archiveIns, err := getArchive()
+	if err != nil {
+		return nil, err
+	}
+	return &pageDataObj{
+		IsAuth: isAuth(token), Archive: archiveIns,
+		Meta: metaObj{Title: "Archive", URL: absoluteURL("/archive"), Type: "website"},
+	}, nil
+}
+
+func archiveMonthPageData(year uint32, month uint32, pageNo uint32, token string) (*pageDataObj, error) {
+	if year < 1970 || year > 9999 || month < 1 || month > 12 {
+		return nil, paramsErr
+	}
+	notesInsPtr, pageIns, err := getArchiveMonth(year, month, pageNo, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(notesInsPtr) <= 0 {
+		return nil, paramsErr
+	}
+	basePath := fmt.Sprintf("/archive/%d/%d", year, month)
+	return &pageDataObj{
+		IsAuth: isAuth(token), Notes: notesInsPtr, Page: pageIns, BasePath: basePath, Year: year, Month: month,
+		Meta: metaObj{Title: fmt.Sprintf("%d-%02d", year, month), URL: absoluteURL(pageLink(basePath, pageNo)), Type: "website"},
+	}, nil
+}
+
+// ------------------------------------------------------------------
+
+// pageFunc returns the template and its data, or a path to redirect to
+type pageFunc func(req *http.Request) (string, *pageDataObj, string, error)
+
+func makePageHandler(page pageFunc) func(resp http.ResponseWriter, req *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		log.Logger.WithField("url", req.URL).Info("incoming request")
+
+		name, dataIns, redirect, err := page(req)
+		if err == paramsErr || err == noteNotExistsErr || err == tagNotExistsErr {
+			http.NotFound(resp, req)
+			return
+		}
+		if err != nil {
+			log.Logger.WithField("err", err).Error("get page data failed")
+			http.Error(resp, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if redirect != "" {
+			http.Redirect(resp, req, redirect, http.StatusMovedPermanently)
+			return
+		}
+
+		body, err := renderPage(name, dataIns)
+		if err != nil {
+			log.Logger.WithField("err", err).Error("render page failed")
+			http.Error(resp, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if notModified := setCacheHeaders(resp, req, dataIns, body); notModified {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = resp.Write(body)
+		log.Logger.WithField("url", req.URL).Info("done processing request")
+	}
+}
+
+// pageTagID accepts both the id and the slug of a tag
+func pageTagID(idOrSlug string) (uint32, error) {
+	if tagID, err := strconv.ParseUint(idOrSlug, 10, 32); err == nil {
+		return uint32(tagID), nil
+	}
+	tagID, err := selectTagIDBySlug(DB, idOrSlug)
+	if err != nil {
+		return 0, err
+	}
+	if tagID == 0 {
+		return 0, tagNotExistsErr
+	}
+	return tagID, nil
+}
+
+func pathPageNo(req *http.Request) (uint32, error) {
+	if _, ok := mux.Vars(req)["page"]; !ok {
+		return 1, nil
+	}
+	return pathUint32(req, "page")
+}
+
+func notesPage(req *http.Request) (string, *pageDataObj, string, error) {
+	pageNo, err := pathPageNo(req)
+	if err != nil {
+		return "", nil, "", err
+	}
+	dataIns, err := notesPageData(pageNo, 0, false, reqToken(req))
+	return "notes.html", dataIns, "", err
+}
+
+func tagPage(req *http.Request) (string, *pageDataObj, string, error) {
+	pageNo, err := pathPageNo(req)
+	if err != nil {
+		return "", nil, "", err
+	}
+	tagID, err := pageTagID(mux.Vars(req)["tag"])
+	if err != nil {
+		return "", nil, "", err
+	}
+	dataIns, err := notesPageData(pageNo, tagID, false, reqToken(req))
+	return "notes.html", dataIns, "", err
+}
+
+func notePage(req *http.Request) (string, *pageDataObj, string, error) {
+	dataIns, redirect, err := notePageData(mux.Vars(req)["id"], reqToken(req))
+	if redirect != "" {
+		redirect = "/note/" + redirect
+	}
+	return "note.html", dataIns, redirect, err
+}
+
+func archivePage(req *http.Request) (string, *pageDataObj, string, error) {
+	dataIns, err := archivePageData(reqToken(req))
+	return "archive.html", dataIns, "", err
+}
+
+func archiveMonthPage(req *http.Request) (string, *pageDataObj, string, error) {
+	year, err := pathUint32(req, "year")
+	if err != nil {
+		return "", nil, "", err
+	}
+	month, err := pathUint32(req, "month")
+	if err != nil {
+		return "", nil, "", err
+	}
+	pageNo, err := pathPageNo(req)
+	if err != nil {
+		return "", nil, "", err
+	}
+	dataIns, err := archiveMonthPageData(year, month, pageNo, reqToken(req))
+	return "notes.html", dataIns, "", err
+}
+
+// NewPageRouter routes the server rendered html pages, for crawlers, link previews and readers without javascript
+func NewPageRouter() http.Handler {
+	router := mux.NewRouter()
+	methods := []string{http.MethodGet, http.MethodHead}
+
+	router.HandleFunc("/", makePageHandler(notesPage)).Methods(methods...)
+	router.HandleFunc("/page/{page:[0-9]+}", makePageHandler(notesPage)).Methods(methods...)
+	router.HandleFunc("/note/{id}", makePageHandler(notePage)).Methods(methods...)
+	router.HandleFunc("/tag/{tag}", makePageHandler(tagPage)).Methods(methods...)
+	router.HandleFunc("/tag/{tag}/page/{page:[0-9]+}", makePageHandler(tagPage)).Methods(methods...)
+	router.HandleFunc("/archive", makePageHandler(archivePage)).Methods(methods...)
+	router.HandleFunc("/archive/{year:[0-9]+}/{month:[0-9]+}", makePageHandler(archiveMonthPage)).Methods(methods...)
+	router.HandleFunc("/archive/{year:[0-9]+}/{month:[0-9]+}/page/{page:[0-9]+}", makePageHandler(archiveMonthPage)).Methods(methods...)
+
+	return router
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// transformers are run in the order configured in "plugin.on_save" and "plugin.on_read",
+// names not found here are skipped with a warning
+var transformers = map[string]transformFunc{
+	"emoji":            emojiTransformer,
+	"lazy_image":       lazyImageTransformer,
+	"link_rewrite":     linkRewriteTransformer,
+	"responsive_image": responsiveImageTransformer,
+	"shortcode":        shortcodeTransformer,
+	"wiki_link":        wikiLinkTransformer,
+}
+
+var emojiRegexp = regexp.MustCompile(`:([a-z0-9_+\-]+):`)
+
+var emojis = map[string]string{
+	"+1": "👍", "-1": "👎", "book": "📖", "bulb": "💡", "coffee": "☕", "cry": "😢", "fire": "🔥",
+	"heart": "❤️", "joy": "😂", "memo": "📝", "ok": "🆗", "rocket": "🚀", "smile": "😄", "star": "⭐",
+	"sunny": "☀️", "tada": "🎉", "thinking": "🤔", "warning": "⚠️", "wink": "😉", "x": "❌",
+}
+
+// ------------------------------------------------------------------
+
+func runTransformers(ctx *transformCtxObj, content string) (string, error) {
+	for _, name := range viper.GetStringSlice("plugin." + ctx.Stage) {
+		transformer, ok := transformers[name]
+		if !ok {
+			log.Logger.WithField("transformer", name).Warn("unknown content transformer, skip")
+			continue
+		}
+
+		var err error
+		content, err = transformer(ctx, content)
+		if err != nil {
+			log.Logger.WithField("transformer", name).WithField("err", err).Warn("content transformer failed")
+			return "", err
+		}
+	}
+	return content, nil
+}
+
+func isTransformerEnabled(name string) bool {
+	return containsString(viper.GetStringSlice("plugin."+saveStage), name) ||
+		containsString(viper.GetStringSlice("plugin."+readStage), name)
+}
+
+// transformFragment parses content as the children of <body>, so that no <html> or <head> is added when rendering back
+func transformFragment(content string, fn func(sel *goquery.Selection)) (string, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(content), body)
+	if err != nil {
+		return "", err
+	}
+	for _, node := range nodes {
+		body.AppendChild(node)
+	}
+
+	sel := goquery.NewDocumentFromNode(body).Selection
+	fn(sel)
+	return sel.Html()
+}
+
+// walkTextNodes calls fn with every text node under node, the elements named in skippedTags are not entered
+func walkTextNodes(node *html.Node, skippedTags []string, fn func(text *html.Node)) {
+	if node.Type == html.ElementNode && containsString(skippedTags, node.Data) {
+		return
+	}
+	if node.Type == html.TextNode {
+		fn(node)
+		return
+	}
+	for child := node.FirstChild; child != nil; {
+		// fn may replace the text node, so get the next sibling first
+		next := child.NextSibling
+		walkTextNodes(child, skippedTags, fn)
+		child = next
+	}
+}
+
+// replaceTextNode parses content as html and puts the nodes in place of the text node
+func replaceTextNode(text *html.Node, content string) {
+	nodes, err := html.ParseFragment(strings.NewReader(content), text.Parent)
+	if err != nil {
+		return
+	}
+	for _, node := range nodes {
+		text.Parent.InsertBefore(node, text)
+	}
+	text.Parent.RemoveChild(text)
+}
+
+// ------------------------------------------------------------------
+
+func emojiTransformer(ctx *transformCtxObj, content string) (string, error) {
+	return transformFragment(content, func(sel *goquery.Selection) {
+		var replaceText func(node *html.Node)
+		replaceText = func(node *html.Node) {
+			if node.Type == html.ElementNode && (node.Data == "code" || node.Data == "pre") {
+				return
+			}
+			if node.Type == html.TextNode {
+				node.Data = emojiRegexp.ReplaceAllStringFunc(node.Data, func(match string) string {
+					if emoji, ok := emojis[strings.Trim(match, ":")]; ok {
+						return emoji
+					}
+					return match
+				})
+				return
+			}
+			for child := node.FirstChild; child != nil; child = child.NextSibling {
+				replaceText(child)
+			}
+		}
+		for _, node := range sel.Nodes {
+			replaceText(node)
+		}
+	})
+}
+
+func lazyImageTransformer(ctx *transformCtxObj, content string) (string, error) {
+	return transformFragment(content, func(sel *goquery.Selection) {
+		sel.Find("img:not([loading])").SetAttr("loading", "lazy")
+		sel.Find("iframe:not([loading])").SetAttr("loading", "lazy")
+	})
+}
+
+// linkRewriteTransformer replaces url prefixes of links, images and srcset candidates configured in
+// "plugin.link_rewrite.rules" (first match wins), and opens links to other hosts in a new tab
+// if "plugin.link_rewrite.external_blank" is set
+func linkRewriteTransformer(ctx *transformCtxObj, content string) (string, error) {
+	var rules []linkRewriteRuleObj
+	if err := viper.UnmarshalKey("plugin.link_rewrite.rules", &rules); err != nil {
+		return "", err
+	}
+	externalBlank := viper.GetBool("plugin.link_rewrite.external_blank")
+	var host string
+	if baseURL, err := url.Parse(viper.GetString("server.base_url")); err == nil {
+		host = baseURL.Host
+	}
+
+	rewrite := func(link string) string {
+		for _, rule := range rules {
+			if rule.From != "" && strings.HasPrefix(link, rule.From) {
+				return rule.To + strings.TrimPrefix(link, rule.From)
+			}
+		}
+		return link
+	}
+
+	return transformFragment(content, func(sel *goquery.Selection) {
+		sel.Find("img[src]").Each(func(i int, img *goquery.Selection) {
+			src, _ := img.Attr("src")
+			img.SetAttr("src", rewrite(src))
+		})
+		// "url 640w, url 2x", descriptors are kept as they are
+		sel.Find("img[srcset], source[srcset]").Each(func(i int, img *goquery.Selection) {
+			srcset, _ := img.Attr("srcset")
+			candidates := strings.Split(srcset, ",")
+			for j, candidate := range candidates {
+				if fields := strings.Fields(candidate); len(fields) > 0 {
+					fields[0] = rewrite(fields[0])
+					candidates[j] = strings.Join(fields, " ")
+				}
+			}
+			img.SetAttr("srcset", strings.Join(candidates, ", "))
+		})
+		sel.Find("a[href]").Each(func(i int, a *goquery.Selection) {
+			href, _ := a.Attr("href")
+			href = rewrite(href)
+			a.SetAttr("href", href)
+
+			u, err := url.Parse(href)
+			if !externalBlank || err != nil || u.Host == "" || u.Host == host {
+				return
+			}
+			a.SetAttr("target", "_blank")
+			a.SetAttr("rel", "noopener noreferrer")
+		})
+	})
+}
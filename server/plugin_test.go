@@ -0,0 +1,228 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+type transformerCaseObj struct {
+	name    string
+	content string
+	want    string
+}
+
+func runTransformerCases(t *testing.T, transformer transformFunc, ctx *transformCtxObj, cases []transformerCaseObj) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := transformer(ctx, c.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got\n%s\nwant\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestEmojiTransformer(t *testing.T) {
+	runTransformerCases(t, emojiTransformer, &transformCtxObj{Stage: readStage}, []transformerCaseObj{
+		{"known", "<p>done :tada:</p>", "<p>done 🎉</p>"},
+		{"unknown kept", "<p>:nope: and :+1:</p>", "<p>:nope: and 👍</p>"},
+		{"code skipped", "<p>:fire:</p><pre><code>:fire:</code></pre><code>:fire:</code>",
+			"<p>🔥</p><pre><code>:fire:</code></pre><code>:fire:</code>"},
+		{"attributes kept", `<a href="/" title=":x:">:x:</a>`, `<a href="/" title=":x:">❌</a>`},
+	})
+}
+
+func TestLazyImageTransformer(t *testing.T) {
+	runTransformerCases(t, lazyImageTransformer, &transformCtxObj{Stage: readStage}, []transformerCaseObj{
+		{"image", `<img src="/a.png"/>`, `<img src="/a.png" loading="lazy"/>`},
+		{"iframe", `<iframe src="/v"></iframe>`, `<iframe src="/v" loading="lazy"></iframe>`},
+		{"loading kept", `<img src="/a.png" loading="eager"/>`, `<img src="/a.png" loading="eager"/>`},
+		{"no media", "<p>text</p>", "<p>text</p>"},
+	})
+}
+
+func TestLinkRewriteTransformer(t *testing.T) {
+	setTestConfig(t, map[string]interface{}{
+		"server.base_url": "https://notes.example.com",
+		"plugin.link_rewrite.rules": []map[string]interface{}{
+			{"from": "http://img.example.com/", "to": "https://cdn.example.com/"},
+			{"from": "http://img.example.com/old/", "to": "https://never.example.com/"},
+		},
+		"plugin.link_rewrite.external_blank": true,
+	})
+	runTransformerCases(t, linkRewriteTransformer, &transformCtxObj{Stage: readStage}, []transformerCaseObj{
+		{"image", `<img src="http://img.example.com/old/a.png"/>`, `<img src="https://cdn.example.com/old/a.png"/>`},
+		{"srcset", `<img src="/a.png" srcset="http://img.example.com/a-640.png 640w,http://img.example.com/a.png  1280w, /a-2x.png 2x"/>`,
+			`<img src="/a.png" srcset="https://cdn.example.com/a-640.png 640w, https://cdn.example.com/a.png 1280w, /a-2x.png 2x"/>`},
+		{"picture source", `<picture><source srcset="http://img.example.com/a.webp" type="image/webp"/></picture>`,
+			`<picture><source srcset="https://cdn.example.com/a.webp" type="image/webp"/></picture>`},
+		{"link", `<a href="http://img.example.com/b.png">b</a>`,
+			`<a href="https://cdn.example.com/b.png" target="_blank" rel="noopener noreferrer">b</a>`},
+		{"same host", `<a href="https://notes.example.com/note/1">1</a>`, `<a href="https://notes.example.com/note/1">1</a>`},
+		{"relative", `<a href="/note/1">1</a>`, `<a href="/note/1">1</a>`},
+		{"external", `<a href="https://go.dev/">go</a>`, `<a href="https://go.dev/" target="_blank" rel="noopener noreferrer">go</a>`},
+	})
+
+	setTestConfig(t, map[string]interface{}{"plugin.link_rewrite.external_blank": false})
+	runTransformerCases(t, linkRewriteTransformer, &transformCtxObj{Stage: readStage}, []transformerCaseObj{
+		{"external not blank", `<a href="https://go.dev/">go</a>`, `<a href="https://go.dev/">go</a>`},
+	})
+}
+
+func TestShortcodeTransformer(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"note.link_format": "/note/%d", "note.private_title": "private note"})
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text, private)
+					values (1, 'Public <One>', 'me', '', '', 0), (2, 'Secret', 'me', '', '', 1)`)
+
+	cases := []transformerCaseObj{
+		{"gist", `<p>{{< gist user/abc a.go >}}</p>`,
+			`<p><script src="https://gist.github.com/user/abc.js?file=a.go"></script></p>`},
+		{"entities", `<p>{{&lt; video "https://example.com/a.mp4" &gt;}}</p>`,
+			`<p><video src="https://example.com/a.mp4" controls="" preload="metadata"></video></p>`},
+		{"escaped", `<p>{{&lt;/* note 1 */&gt;}}</p>`, `<p>{{&lt; note 1 &gt;}}</p>`},
+		{"unknown kept", `<p>{{< nope >}} &amp; text</p>`, `<p>{{&lt; nope &gt;}} &amp; text</p>`},
+		{"code skipped", `<pre><code>{{< note 1 >}}</code></pre><p><code>{{&lt; note 1 &gt;}}</code></p>`,
+			`<pre><code>{{&lt; note 1 &gt;}}</code></pre><p><code>{{&lt; note 1 &gt;}}</code></p>`},
+		{"attribute skipped", `<a href="/" title="{{< note 1 >}}">x</a>`, `<a href="/" title="{{&lt; note 1 &gt;}}">x</a>`},
+		{"several", `<p>a {{< note 1 >}} b {{< note 1 >}}</p>`,
+			`<p>a <a class="note-ref" href="/note/1">Public &lt;One&gt;</a> b <a class="note-ref" href="/note/1">Public &lt;One&gt;</a></p>`},
+		{"note", `<p>{{< note 1 >}}</p>`, `<p><a class="note-ref" href="/note/1">Public &lt;One&gt;</a></p>`},
+		{"private note", `<p>{{< note 2 >}}</p>`, `<p><a class="note-ref" href="/note/2">private note</a></p>`},
+		{"missing note", `<p>{{< note 3 >}}</p>`, `<p><span class="shortcode-error">{{&lt; note 3 &gt;}}</span></p>`},
+		{"bad arguments", `<p>{{< video javascript:alert(1) >}}</p>`,
+			`<p><span class="shortcode-error">{{&lt; video javascript:alert(1) &gt;}}</span></p>`},
+	}
+	runTransformerCases(t, shortcodeTransformer, &transformCtxObj{Cursor: db, Stage: readStage}, cases)
+
+	runTransformerCases(t, shortcodeTransformer, &transformCtxObj{Cursor: db, Stage: readStage, IsAuth: true}, []transformerCaseObj{
+		{"private note authenticated", `<p>{{< note 2 >}}</p>`, `<p><a class="note-ref" href="/note/2">Secret</a></p>`},
+	})
+}
+
+func TestWikiLinkTransformer(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"note.link_format": "/note/%d", "note.private_title": "private note"})
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text, private)
+					values (1, 'Source', 'me', '', '', 0), (2, 'Go', 'me', '', '', 0), (3, 'Diary', 'me', '', '', 1)`)
+	mustExec(t, db, `insert into notebook.note_link (src_note_id, dst_note_id, target)
+					values (1, 2, 'Go'), (1, 2, '#2'), (1, 3, 'Diary'), (1, 0, 'Someday')`)
+
+	ctx := &transformCtxObj{Cursor: db, NoteID: 1, Stage: readStage}
+	runTransformerCases(t, wikiLinkTransformer, ctx, []transformerCaseObj{
+		{"title", `<p>see [[Go]]</p>`, `<p>see <a class="wiki-link" href="/note/2">Go</a></p>`},
+		{"id shows title", `<p>[[#2]]</p>`, `<p><a class="wiki-link" href="/note/2">Go</a></p>`},
+		{"missing", `<p>[[Someday]] &amp; more</p>`, `<p><span class="wiki-link missing">Someday</span> &amp; more</p>`},
+		{"private", `<p>[[Diary]]</p>`, `<p><a class="wiki-link" href="/note/3">private note</a></p>`},
+		{"code skipped", `<pre>[[Go]]</pre><a href="/">[[Go]]</a>`, `<pre>[[Go]]</pre><a href="/">[[Go]]</a>`},
+		{"no links", `<p>plain</p>`, `<p>plain</p>`},
+	})
+
+	ctx.IsAuth = true
+	runTransformerCases(t, wikiLinkTransformer, ctx, []transformerCaseObj{
+		{"private authenticated", `<p>[[Diary]]</p>`, `<p><a class="wiki-link" href="/note/3">Diary</a></p>`},
+	})
+}
+
+func TestResponsiveImageTransformer(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{
+		"server.base_url":           "https://notes.example.com",
+		"attachment.variant_widths": []int{1280, 320, 640},
+		"attachment.sizes":          "100vw",
+	})
+	large := strings.Repeat("a", 64)
+	small := strings.Repeat("b", 64)
+	gif := strings.Repeat("c", 64)
+	mustExec(t, db, `insert into notebook.attachment (sha256, name, mime, size, width, height)
+					values (?, 'a.jpg', 'image/jpeg', 1, 1000, 500), (?, 'b.png', 'image/png', 1, 300, 300),
+					(?, 'c.gif', 'image/gif', 1, 1000, 500)`, large, small, gif)
+
+	runTransformerCases(t, responsiveImageTransformer, &transformCtxObj{Cursor: db, Stage: readStage}, []transformerCaseObj{
+		{"variants", `<img src="/attachment/` + large + `"/>`,
+			`<img src="/attachment/` + large + `" srcset="/attachment/` + large + `?w=320 320w, /attachment/` + large +
+				`?w=640 640w, /attachment/` + large + ` 1000w" sizes="100vw" width="1000" height="500"/>`},
+		{"base url", `<img src="https://notes.example.com/attachment/` + large + `" width="10"/>`,
+			`<img src="https://notes.example.com/attachment/` + large + `" width="10" srcset="https://notes.example.com/attachment/` +
+				large + `?w=320 320w, https://notes.example.com/attachment/` + large + `?w=640 640w, https://notes.example.com/attachment/` +
+				large + ` 1000w" sizes="100vw"/>`},
+		{"smaller than variants", `<img src="/attachment/` + small + `"/>`, `<img src="/attachment/` + small + `"/>`},
+		{"no variants of gif", `<img src="/attachment/` + gif + `"/>`, `<img src="/attachment/` + gif + `"/>`},
+		{"srcset kept", `<img src="/attachment/` + large + `" srcset="x.png 1x"/>`, `<img src="/attachment/` + large + `" srcset="x.png 1x"/>`},
+		{"other host", `<img src="https://other.example.com/attachment/` + large + `"/>`,
+			`<img src="https://other.example.com/attachment/` + large + `"/>`},
+	})
+}
+
+func TestRunTransformers(t *testing.T) {
+	appendTransformer := func(s string) transformFunc {
+		return func(ctx *transformCtxObj, content string) (string, error) {
+			return content + s, nil
+		}
+	}
+	transformers["test_a"] = appendTransformer("a")
+	transformers["test_b"] = appendTransformer("b")
+	t.Cleanup(func() {
+		delete(transformers, "test_a")
+		delete(transformers, "test_b")
+	})
+
+	cases := []struct {
+		name   string
+		onRead []string
+		onSave []string
+		stage  string
+		want   string
+	}{
+		{"configured order", []string{"test_b", "test_a"}, nil, readStage, "xba"},
+		{"unknown skipped", []string{"test_a", "nope", "test_b", "test_a"}, nil, readStage, "xaba"},
+		{"stage", []string{"test_a"}, []string{"test_b"}, saveStage, "xb"},
+		{"none", nil, nil, readStage, "x"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setTestConfig(t, map[string]interface{}{"plugin.on_read": c.onRead, "plugin.on_save": c.onSave})
+			got, err := runTransformers(&transformCtxObj{Stage: c.stage}, "x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+
+	setTestConfig(t, map[string]interface{}{"plugin.on_read": []string{"test_a"}, "plugin.on_save": []string{}})
+	if !isTransformerEnabled("test_a") || isTransformerEnabled("test_b") {
+		t.Error("only test_a should be enabled")
+	}
+}
+
+func TestValidateShortcodes(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"plugin.on_read": []string{"shortcode"}})
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text) values (1, 'One', 'me', '', '')`)
+
+	cases := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"valid", `<p>{{< note 1 >}}</p>`, true},
+		{"unknown", `<p>{{< nope >}}</p>`, false},
+		{"missing note", `<p>{{< note 2 >}}</p>`, false},
+		{"escaped", `<p>{{&lt;/* nope */&gt;}}</p>`, true},
+		{"in code", `<pre>{{< nope >}}</pre>`, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := validateShortcodes(c.content); (err == nil) != c.valid {
+				t.Errorf("got %v, want valid %v", err, c.valid)
+			}
+		})
+	}
+}
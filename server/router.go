@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// NewV2Router routes "/api/v2/..." by method and path, failures are answered with 4xx and 5xx statuses.
+// The POST only apis are kept for compatibility
+func NewV2Router() http.Handler {
+	router := mux.NewRouter()
+	v2 := router.PathPrefix("/api/v2").Subrouter()
+
+	v2.HandleFunc("/notes", makeHandler(withHTTPStatus(afterReq(beforeReq(notesV2API))))).Methods(http.MethodGet)
+	v2.HandleFunc("/notes", makeHandler(withHTTPStatus(afterReq(beforeReq(checkAuth(notePublishAPI)))))).Methods(http.MethodPost)
+	v2.HandleFunc("/notes/graph", makeHandler(withHTTPStatus(afterReq(beforeReq(noteGraphAPI))))).Methods(http.MethodGet)
+	v2.HandleFunc("/notes/{id}", makeHandler(withHTTPStatus(afterReq(beforeReq(noteV2API))))).Methods(http.MethodGet)
+	v2.HandleFunc("/notes/{id:[0-9]+}", makeHandler(withHTTPStatus(afterReq(beforeReq(checkAuth(noteUpdateV2API)))))).Methods(http.MethodPut)
+	v2.HandleFunc("/notes/{id:[0-9]+}", makeHandler(withHTTPStatus(afterReq(beforeReq(checkAuth(noteDeleteV2API)))))).Methods(http.MethodDelete)
+	v2.HandleFunc("/tags", makeHandler(withHTTPStatus(afterReq(beforeReq(tagsAPI))))).Methods(http.MethodGet)
+	v2.HandleFunc("/series", makeHandler(withHTTPStatus(afterReq(beforeReq(seriesListAPI))))).Methods(http.MethodGet)
+	v2.HandleFunc("/series/{id:[0-9]+}", makeHandler(withHTTPStatus(afterReq(beforeReq(seriesV2API))))).Methods(http.MethodGet)
+	v2.HandleFunc("/archive", makeHandler(withHTTPStatus(afterReq(beforeReq(archiveAPI))))).Methods(http.MethodGet)
+	v2.HandleFunc("/archive/{year:[0-9]+}/{month:[0-9]+}", makeHandler(withHTTPStatus(afterReq(beforeReq(archiveMonthV2API))))).Methods(http.MethodGet)
+	v2.HandleFunc("/on_this_day", makeHandler(withHTTPStatus(afterReq(beforeReq(onThisDayAPI))))).Methods(http.MethodGet)
+	v2.HandleFunc("/attachments", makeHandler(withHTTPStatus(afterReq(beforeReq(checkAuth(attachmentUploadAPI)))))).Methods(http.MethodPost)
+	v2.HandleFunc("/attachments/{id:[0-9]+}", makeHandler(withHTTPStatus(afterReq(beforeReq(checkAuth(attachmentV2API)))))).Methods(http.MethodGet)
+	v2.HandleFunc("/export/markdown", makeHandler(withHTTPStatus(afterReq(beforeReq(checkAuth(exportMarkdownAPI)))))).Methods(http.MethodGet)
+	v2.HandleFunc("/calendar/{year:[0-9]+}", makeHandler(withHTTPStatus(afterReq(beforeReq(calendarV2API))))).Methods(http.MethodGet)
+
+	return router
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"golang.org/x/net/html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the rich text editor stores "<" and ">" as entities, so both forms are accepted.
+// "{{</* note 42 */>}}" is an escaped shortcode and renders as "{{< note 42 >}}"
+var shortcodeRegexp = regexp.MustCompile(`\{\{(?:<|&lt;)(/\*)?\s*([a-zA-Z][\w-]*)((?:[^}]|\}[^}])*?)\s*(\*/)?(?:>|&gt;)\}\}`)
+
+var shortcodeArgRegexp = regexp.MustCompile(`"[^"]*"|\S+`)
+
+var gistIDRegexp = regexp.MustCompile(`^[\w-]+(/[\w-]+)?$`)
+
+var shortcodes = map[string]shortcodeFunc{
+	"gist":  gistShortcode,
+	"video": videoShortcode,
+	"note":  noteShortcode,
+}
+
+// shortcodes in code blocks are shown as they are, e.g. in notes documenting them
+var shortcodeSkippedTags = []string{"code", "pre", "script", "style"}
+
+var shortcodeArgsErr = errors.New("wrong shortcode arguments")
+
+// ------------------------------------------------------------------
+
+type shortcodeMatchObj struct {
+	Raw     string
+	Name    string
+	Args    []string
+	Escaped bool
+}
+
+func parseShortcode(submatch []string) shortcodeMatchObj {
+	var args []string
+	for _, arg := range shortcodeArgRegexp.FindAllString(html.UnescapeString(submatch[3]), -1) {
+		args = append(args, strings.Trim(arg, `"`))
+	}
+	return shortcodeMatchObj{
+		Raw:     submatch[0],
+		Name:    submatch[2],
+		Args:    args,
+		Escaped: submatch[1] != "" && submatch[4] != "",
+	}
+}
+
+// walkShortcodes calls fn with every text node of content and the shortcodes in it, attribute values and
+// code blocks are skipped. The locations are the ones of shortcodeRegexp in the text of the node
+func walkShortcodes(content string, fn func(text *html.Node, locs [][]int, matches []shortcodeMatchObj)) (string, error) {
+	if !shortcodeRegexp.MatchString(content) {
+		return content, nil
+	}
+	return transformFragment(content, func(sel *goquery.Selection) {
+		for _, node := range sel.Nodes {
+			walkTextNodes(node, shortcodeSkippedTags, func(text *html.Node) {
+				locs := shortcodeRegexp.FindAllStringSubmatchIndex(text.Data, -1)
+				if len(locs) <= 0 {
+					return
+				}
+				matches := make([]shortcodeMatchObj, len(locs))
+				for i, loc := range locs {
+					submatch := make([]string, len(loc)/2)
+					for j := range submatch {
+						if loc[2*j] >= 0 {
+							submatch[j] = text.Data[loc[2*j]:loc[2*j+1]]
+						}
+					}
+					matches[i] = parseShortcode(submatch)
+				}
+				fn(text, locs, matches)
+			})
+		}
+	})
+}
+
+// extractShortcodeNoteRefs returns the notes referenced by "note" shortcodes as wiki link targets like "#42",
+// so that they are tracked as links. Nothing is returned if the "shortcode" transformer is not configured
+func extractShortcodeNoteRefs(content string) ([]string, error) {
+	refs := make([]string, 0)
+	if !isTransformerEnabled("shortcode") {
+		return refs, nil
+	}
+	_, err := walkShortcodes(content, func(text *html.Node, locs [][]int, matches []shortcodeMatchObj) {
+		for _, match := range matches {
+			if match.Escaped || match.Name != "note" || len(match.Args) != 1 {
+				continue
+			}
+			if noteID, err := strconv.ParseUint(match.Args[0], 10, 32); err == nil {
+				if ref := fmt.Sprintf("#%d", noteID); !containsString(refs, ref) {
+					refs = append(refs, ref)
+				}
+			}
+		}
+	})
+	return refs, err
+}
+
+// expandShortcode returns the html of a shortcode
+func expandShortcode(ctx *transformCtxObj, match shortcodeMatchObj) string {
+	if match.Escaped {
+		return html.EscapeString(fmt.Sprintf("{{< %s >}}", strings.Join(append([]string{match.Name}, match.Args...), " ")))
+	}
+
+	shortcode, ok := shortcodes[match.Name]
+	if !ok {
+		// unknown shortcodes are rejected on save, keep old notes readable anyway
+		return html.EscapeString(match.Raw)
+	}
+	expanded, err := shortcode(ctx, match.Args)
+	if err != nil {
+		// e.g. the referenced note has been deleted since the note was saved
+		log.Logger.WithField("shortcode", match.Raw).WithField("err", err).Warn("expand shortcode failed")
+		return `<span class="shortcode-error">` + html.EscapeString(match.Raw) + `</span>`
+	}
+	return expanded
+}
+
+func shortcodeTransformer(ctx *transformCtxObj, content string) (string, error) {
+	return walkShortcodes(content, func(text *html.Node, locs [][]int, matches []shortcodeMatchObj) {
+		var sb strings.Builder
+		last := 0
+		for i, loc := range locs {
+			sb.WriteString(html.EscapeString(text.Data[last:loc[0]]))
+			sb.WriteString(expandShortcode(ctx, matches[i]))
+			last = loc[1]
+		}
+		sb.WriteString(html.EscapeString(text.Data[last:]))
+		replaceTextNode(text, sb.String())
+	})
+}
+
+// validateShortcodes reports unknown shortcodes and shortcodes with wrong arguments,
+// it is a no-op if the "shortcode" transformer is not configured
+func validateShortcodes(content string) error {
+	if !isTransformerEnabled("shortcode") {
+		return nil
+	}
+
+	var problems []string
+	_, err := walkShortcodes(content, func(text *html.Node, locs [][]int, matches []shortcodeMatchObj) {
+		for _, match := range matches {
+			if match.Escaped {
+				continue
+			}
+			shortcode, ok := shortcodes[match.Name]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("unknown shortcode %q", match.Name))
+				continue
+			}
+			ctx := &transformCtxObj{Cursor: DB, Stage: saveStage, IsAuth: true}
+			if _, err := shortcode(ctx, match.Args); err != nil {
+				problems = append(problems, fmt.Sprintf("shortcode %q: %s", match.Name, err.Error()))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+
+func gistShortcode(ctx *transformCtxObj, args []string) (string, error) {
+	if len(args) < 1 || len(args) > 2 || !gistIDRegexp.MatchString(args[0]) {
+		return "", shortcodeArgsErr
+	}
+	src := "https://gist.github.com/" + args[0] + ".js"
+	if len(args) == 2 {
+		src += "?file=" + url.QueryEscape(args[1])
+	}
+	return fmt.Sprintf(`<script src="%s"></script>`, html.EscapeString(src)), nil
+}
+
+func videoShortcode(ctx *transformCtxObj, args []string) (string, error) {
+	if len(args) != 1 || !isSafeURL(args[0]) {
+		return "", shortcodeArgsErr
+	}
+	return fmt.Sprintf(`<video src="%s" controls preload="metadata"></video>`, html.EscapeString(args[0])), nil
+}
+
+func noteShortcode(ctx *transformCtxObj, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", shortcodeArgsErr
+	}
+	noteID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return "", shortcodeArgsErr
+	}
+
+	noteInsPtr, err := selectNoteBriefByNoteID(ctx.Cursor, uint32(noteID))
+	if err != nil {
+		return "", err
+	}
+	if noteInsPtr == nil {
+		return "", noteNotExistsErr
+	}
+
+	title := noteInsPtr.Title
+	if noteInsPtr.Private && !ctx.IsAuth {
+		title = viper.GetString("note.private_title")
+	}
+	return fmt.Sprintf(`<a class="note-ref" href="%s">%s</a>`,
+		html.EscapeString(noteLink(noteInsPtr.ID)), html.EscapeString(title)), nil
+}
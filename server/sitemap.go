@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a sitemap holds at most 50,000 urls, more are split into several sitemaps listed by a sitemap index
+const sitemapMaxURLs = 50000
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// ------------------------------------------------------------------
+
+type sitemapURLSetObj struct {
+	XMLName xml.Name        `xml:"urlset"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	URLs    []sitemapURLObj `xml:"url"`
+}
+
+type sitemapURLObj struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndexObj struct {
+	XMLName  xml.Name        `xml:"sitemapindex"`
+	Xmlns    string          `xml:"xmlns,attr"`
+	Sitemaps []sitemapURLObj `xml:"sitemap"`
+}
+
+// generatedDocObj is a generated public document, validated by ETag only
+type generatedDocObj struct{}
+
+func (d generatedDocObj) lastModified() time.Time {
+	return time.Time{}
+}
+
+func (d generatedDocObj) hasPrivateNote() bool {
+	return false
+}
+
+// ------------------------------------------------------------------
+
+// makeSitemap returns the sitemap of public notes not tagged by "sitemap.exclude_tags" or their descendants, e.g. drafts.
+// If there are too many notes, page 0 is the sitemap index and the notes are listed by page 1, 2...
+// whose paths are made by pathFormat
+func makeSitemap(page uint32, pathFormat string) ([]byte, error) {
+	excludedTags := viper.GetStringSlice("sitemap.exclude_tags")
+	pagesCount, err := sitemapPagesCount()
+	if err != nil {
+		return nil, err
+	}
+	if page == 0 && pagesCount > 1 {
+		indexIns := sitemapIndexObj{Xmlns: sitemapNamespace}
+		for i := uint32(1); i <= pagesCount; i++ {
+			indexIns.Sitemaps = append(indexIns.Sitemaps, sitemapURLObj{Loc: absoluteURL(fmt.Sprintf(pathFormat, i))})
+		}
+		return marshalXML(indexIns)
+	}
+	if page > pagesCount {
+		return nil, paramsErr
+	}
+
+	urlSetIns := sitemapURLSetObj{Xmlns: sitemapNamespace}
+	offset := uint32(0)
+	limit := uint32(sitemapMaxURLs - 1)
+	if page <= 1 {
+		urlSetIns.URLs = append(urlSetIns.URLs, sitemapURLObj{Loc: absoluteURL("/")})
+	} else {
+		offset = (page-1)*sitemapMaxURLs - 1
+		limit = sitemapMaxURLs
+	}
+
+	notesIns, err := selectSitemapNotes(DB, excludedTags, offset, limit, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, noteIns := range notesIns {
+		urlIns := sitemapURLObj{Loc: absoluteURL(noteLink(noteIns.ID))}
+		if lastMod := parseDBTime(noteIns.UpdateAt); !lastMod.IsZero() {
+			urlIns.LastMod = lastMod.Format(time.RFC3339)
+		}
+		urlSetIns.URLs = append(urlSetIns.URLs, urlIns)
+	}
+	return marshalXML(urlSetIns)
+}
+
+func sitemapPagesCount() (uint32, error) {
+	notesCount, err := selectSitemapNotesCount(DB, viper.GetStringSlice("sitemap.exclude_tags"))
+	if err != nil {
+		return 0, err
+	}
+	// the home page takes one url of the first sitemap
+	return (notesCount + sitemapMaxURLs) / sitemapMaxURLs, nil
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// makeRobots disallows the paths in "robots.disallow" for all crawlers and points them to the sitemap
+func makeRobots() []byte {
+	var sb strings.Builder
+	sb.WriteString("User-agent: *\n")
+	disallows := viper.GetStringSlice("robots.disallow")
+	if len(disallows) <= 0 {
+		sb.WriteString("Disallow:\n")
+	}
+	for _, path := range disallows {
+		sb.WriteString("Disallow: " + path + "\n")
+	}
+	for _, path := range viper.GetStringSlice("robots.allow") {
+		sb.WriteString("Allow: " + path + "\n")
+	}
+	sb.WriteString("\nSitemap: " + absoluteURL("/sitemap.xml") + "\n")
+	return []byte(sb.String())
+}
+
+func writeGeneratedDoc(resp http.ResponseWriter, req *http.Request, contentType string, body []byte) {
+	resp.Header().Set("Content-Type", contentType)
+	if notModified := setCacheHeaders(resp, req, generatedDocObj{}, body); notModified {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = resp.Write(body)
+}
+
+// ------------------------------------------------------------------
+
+func SitemapHandler(resp http.ResponseWriter, req *http.Request) {
+	log.Logger.WithField("url", req.URL).Info("incoming request")
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(resp, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var page uint64
+	if value := req.URL.Query().Get("page"); value != "" {
+		var err error
+		if page, err = strconv.ParseUint(value, 10, 32); err != nil {
+			http.NotFound(resp, req)
+			return
+		}
+	}
+
+	body, err := makeSitemap(uint32(page), "/sitemap.xml?page=%d")
+	if err == paramsErr {
+		http.NotFound(resp, req)
+		return
+	}
+	if err != nil {
+		log.Logger.WithField("err", err).Error("make sitemap failed")
+		http.Error(resp, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeGeneratedDoc(resp, req, "application/xml; charset=utf-8", body)
+}
+
+func RobotsHandler(resp http.ResponseWriter, req *http.Request) {
+	log.Logger.WithField("url", req.URL).Info("incoming request")
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(resp, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeGeneratedDoc(resp, req, "text/plain; charset=utf-8", makeRobots())
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSitemapExcludedTagSubtree(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text, private)
+					values (1, 'a', 'me', '', '', 0), (2, 'b', 'me', '', '', 0), (3, 'c', 'me', '', '', 0),
+					(4, 'd', 'me', '', '', 0), (5, 'e', 'me', '', '', 1)`)
+	mustExec(t, db, `insert into notebook.tag (id, name) values (1, 'draft'), (2, 'draft/wip'), (3, 'drafts')`)
+	mustExec(t, db, `insert into notebook.note_tag (note_id, tag_id, tag_name)
+					values (1, 1, 'draft'), (2, 2, 'draft/wip'), (3, 3, 'drafts')`)
+
+	notesIns, err := selectSitemapNotes(db, []string{"draft"}, 0, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var noteIDs []uint32
+	for _, noteIns := range notesIns {
+		noteIDs = append(noteIDs, noteIns.ID)
+	}
+	if len(noteIDs) != 2 || noteIDs[0] != 3 || noteIDs[1] != 4 {
+		t.Errorf("sitemap notes %v, want [3 4]", noteIDs)
+	}
+
+	cnt, err := selectSitemapNotesCount(db, []string{"draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 2 {
+		t.Errorf("sitemap notes count %d, want 2", cnt)
+	}
+}
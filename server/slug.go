@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"github.com/mozillazg/go-pinyin"
+	"strings"
+	"unicode"
+)
+
+const slugMaxLength = 64
+
+const defaultSlug = "note"
+
+var pinyinArgs = pinyin.NewArgs()
+
+// ------------------------------------------------------------------
+
+// slugify turns a title into lower case latin words joined by "-",
+// chinese characters are transliterated into pinyin, e.g. "Go 并发" gives "go-bing-fa"
+func slugify(title string) string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+
+	for _, r := range title {
+		if unicode.Is(unicode.Han, r) {
+			flush()
+			if pys := pinyin.SinglePinyin(r, pinyinArgs); len(pys) > 0 {
+				words = append(words, pys[0])
+			}
+		} else if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			word.WriteRune(unicode.ToLower(r))
+		} else {
+			flush()
+		}
+	}
+	flush()
+
+	var slug string
+	for _, w := range words {
+		if slug != "" && len(slug)+1+len(w) > slugMaxLength {
+			break
+		}
+		if slug != "" {
+			slug += "-"
+		}
+		slug += w
+	}
+	if len(slug) > slugMaxLength {
+		slug = slug[:slugMaxLength]
+	}
+	if slug == "" {
+		return defaultSlug
+	}
+	if isNumericSlug(slug) {
+		// "2024" would be taken for the id of a note or tag
+		slug = defaultSlug + "-" + slug
+		if len(slug) > slugMaxLength {
+			slug = slug[:slugMaxLength]
+		}
+	}
+	return slug
+}
+
+// isNumericSlug tells slugs which urls can not tell from ids, they are tried as ids first
+func isNumericSlug(slug string) bool {
+	if slug == "" {
+		return false
+	}
+	for _, r := range slug {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// assignNoteSlug gives the note a unique slug generated from title, "-2", "-3"... are appended on collision.
+// Old slugs are kept pointing to the note so that they can be redirected to the current one
+func assignNoteSlug(cursor cursorObj, noteID uint32, title string) (string, error) {
+	base := slugify(title)
+	for i := 1; ; i++ {
+		slug := base
+		if i > 1 {
+			slug = fmt.Sprintf("%s-%d", base, i)
+		}
+
+		// lock is required in case another note takes the slug at the same time
+		ownerID, err := selectNoteIDBySlug(cursor, slug, true)
+		if err != nil {
+			return "", err
+		}
+		if ownerID != 0 && ownerID != noteID {
+			continue
+		}
+
+		// the title may be changed back, then the old slug is reused
+		if ownerID == 0 {
+			if _, err := insertNoteSlug(cursor, noteID, slug); err != nil {
+				return "", err
+			}
+		}
+		if _, err := updateNoteSlugByNoteID(cursor, noteID, slug); err != nil {
+			return "", err
+		}
+		return slug, nil
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	cases := []struct {
+		title string
+		want  string
+	}{
+		{"Hello, World!", "hello-world"},
+		{"Go 并发", "go-bing-fa"},
+		{"2024", "note-2024"},
+		{"1984 ", "note-1984"},
+		{"2024 review", "2024-review"},
+		{"2024-01", "2024-01"},
+		{"!!!", "note"},
+	}
+	for _, c := range cases {
+		if got := slugify(c.title); got != c.want {
+			t.Errorf("slugify(%q) = %q, want %q", c.title, got, c.want)
+		}
+		if isNumericSlug(slugify(c.title)) {
+			t.Errorf("slugify(%q) is numeric", c.title)
+		}
+	}
+}
@@ -1,12 +1,12 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/go-redis/redis"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/speed18/d18-notebook/log"
-	"sort"
 	"strings"
 )
 
@@ -14,8 +14,18 @@ var DB *sql.DB
 var RDS *redis.Client
 
 func withTransaction(tf txFunc) (interface{}, error) {
+	return withTxOptions(nil, tf)
+}
+
+// withSnapshot runs tf in a read only transaction seeing one snapshot of all the tables, for reads which must agree
+// with each other without locking writers out, e.g. backups
+func withSnapshot(tf txFunc) (interface{}, error) {
+	return withTxOptions(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}, tf)
+}
+
+func withTxOptions(opts *sql.TxOptions, tf txFunc) (interface{}, error) {
 	var err error
-	tx, err := DB.Begin()
+	tx, err := DB.BeginTx(context.Background(), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -73,12 +83,20 @@ func insertTags(cursor cursorObj, ignoreDuplicated bool, names ...string) (uint3
 	return uint32(tagID), nil
 }
 
+// selectTagsWithNotesCount counts the notes tagged with each tag or any of its descendants,
+// tags without notes are left out
 func selectTagsWithNotesCount(cursor cursorObj, closeRows bool) ([]tagObj, error) {
 	tagsIns := make([]tagObj, 0)
 
-	sqlStr := `select tag_id, tag_name, count(note_id) as cnt
-					from notebook.note_tag
-					group by tag_id, tag_name`
+	sqlStr := `select tag.id, tag.name, tag.description, tag.color, ifnull(tag.slug, ''),
+					count(distinct note_tag.note_id) as cnt
+					from notebook.tag tag
+					inner join notebook.tag descendant
+					on descendant.name = tag.name
+					or left(descendant.name, char_length(tag.name) + 1) = concat(tag.name, '/')
+					inner join notebook.note_tag note_tag
+					on note_tag.tag_id = descendant.id
+					group by tag.id, tag.name, tag.description, tag.color, tag.slug`
 	rows, err := cursor.Query(sqlStr)
 	if err != nil {
 		return tagsIns, err
@@ -89,7 +107,7 @@ func selectTagsWithNotesCount(cursor cursorObj, closeRows bool) ([]tagObj, error
 
 	for rows.Next() {
 		var tagIns tagObj
-		err := rows.Scan(&tagIns.ID, &tagIns.Name, &tagIns.Tagged)
+		err := rows.Scan(&tagIns.ID, &tagIns.Name, &tagIns.Description, &tagIns.Color, &tagIns.Slug, &tagIns.Tagged)
 		if err != nil {
 			return tagsIns, err
 		}
@@ -149,15 +167,21 @@ func selectTagsByName(cursor cursorObj, closeRows bool, forUpdate bool, names ..
 	return tagsIns, nil
 }
 
+// deleteUnusedTags deletes tags which neither they nor their descendants are used by any note
 func deleteUnusedTags(cursor cursorObj) (uint32, error) {
 	sqlStr := `delete from notebook.tag
 					where id in (
 					  select * from (
 					  select tag.id 
 					  from notebook.tag tag
-					  left outer join notebook.note_tag note_tag
-					  on tag.id = note_tag.tag_id
-					  where note_tag.id is null
+					  where not exists (
+					    select 1
+					    from notebook.note_tag note_tag
+					    inner join notebook.tag descendant
+					    on note_tag.tag_id = descendant.id
+					    where descendant.name = tag.name
+					    or left(descendant.name, char_length(tag.name) + 1) = concat(tag.name, '/')
+					  )
 					  ) as tmp
 					)`
 	result, err := cursor.Exec(sqlStr)
@@ -171,6 +195,272 @@ func deleteUnusedTags(cursor cursorObj) (uint32, error) {
 	return uint32(deletedRows), nil
 }
 
+func selectTagsByID(cursor cursorObj, closeRows bool, forUpdate bool, ids ...uint32) ([]tagObj, error) {
+	tagsIns := make([]tagObj, 0)
+
+	var params []string
+	for i := 0; i < len(ids); i++ {
+		params = append(params, "?")
+	}
+	var sqlStr string
+	if forUpdate {
+		sqlStr = fmt.Sprintf("select id, name from notebook.tag where id in (%s) for update", strings.Join(params, ","))
+	} else {
+		sqlStr = fmt.Sprintf("select id, name from notebook.tag where id in (%s)", strings.Join(params, ","))
+	}
+	log.Logger.WithField("sql", sqlStr).Debug()
+
+	var args []interface{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	rows, err := cursor.Query(sqlStr, args...)
+	if err != nil {
+		return tagsIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var tagIns tagObj
+		err := rows.Scan(&tagIns.ID, &tagIns.Name)
+		if err != nil {
+			return tagsIns, err
+		}
+		tagsIns = append(tagsIns, tagIns)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return tagsIns, err
+	}
+
+	return tagsIns, nil
+}
+
+// selectTagsCountInSubtree counts the tag named name and its descendants
+func selectTagsCountInSubtree(cursor cursorObj, name string, forUpdate bool) (uint32, error) {
+	var cnt uint32
+	sqlStr := `select count(id)
+					from notebook.tag
+					where name = ? or left(name, char_length(?) + 1) = concat(?, '/')`
+	if forUpdate {
+		sqlStr += " for update"
+	}
+	if err := cursor.QueryRow(sqlStr, name, name, name).Scan(&cnt); err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+// selectNotesCountInTagSubtree counts the distinct notes tagged with name or any of its descendants
+func selectNotesCountInTagSubtree(cursor cursorObj, name string) (uint32, error) {
+	var cnt uint32
+	sqlStr := `select count(distinct note_id)
+					from notebook.note_tag
+					where tag_name = ? or left(tag_name, char_length(?) + 1) = concat(?, '/')`
+	if err := cursor.QueryRow(sqlStr, name, name, name).Scan(&cnt); err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+func selectTagIDBySlug(cursor cursorObj, slug string) (uint32, error) {
+	var tagID uint32
+	sqlStr := "select id from notebook.tag where slug = ?"
+	err := cursor.QueryRow(sqlStr, slug).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return tagID, nil
+}
+
+// selectTagsInSubtree selects the tag named name and its descendants, parents before their children
+func selectTagsInSubtree(cursor cursorObj, name string, closeRows bool, forUpdate bool) ([]tagObj, error) {
+	tagsIns := make([]tagObj, 0)
+
+	sqlStr := `select id, name
+					from notebook.tag
+					where name = ? or left(name, char_length(?) + 1) = concat(?, '/')
+					order by name`
+	if forUpdate {
+		sqlStr += " for update"
+	}
+	rows, err := cursor.Query(sqlStr, name, name, name)
+	if err != nil {
+		return tagsIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var tagIns tagObj
+		if err := rows.Scan(&tagIns.ID, &tagIns.Name); err != nil {
+			return tagsIns, err
+		}
+		tagsIns = append(tagsIns, tagIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return tagsIns, err
+	}
+
+	return tagsIns, nil
+}
+
+// updateTagNameByTagID renames one tag, and the denormalized "tag_name" of its note_tag rows
+func updateTagNameByTagID(cursor cursorObj, tagID uint32, name string) (uint32, error) {
+	sqlStr := `update notebook.tag
+					set name = ?
+					where id = ?`
+	result, err := cursor.Exec(sqlStr, name, tagID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	sqlStr = `update notebook.note_tag
+					set tag_name = ?
+					where tag_id = ?`
+	if _, err := cursor.Exec(sqlStr, name, tagID); err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// renameTagsInSubtree renames the tag named oldName to newName, and its descendants accordingly
+func renameTagsInSubtree(cursor cursorObj, oldName string, newName string) (uint32, error) {
+	sqlStr := `update notebook.tag
+					set name = concat(?, substring(name, char_length(?) + 1))
+					where name = ? or left(name, char_length(?) + 1) = concat(?, '/')`
+	result, err := cursor.Exec(sqlStr, newName, oldName, oldName, oldName, oldName)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// renameNoteTagsInSubtree keeps the denormalized "tag_name" of note_tag in sync with renameTagsInSubtree
+func renameNoteTagsInSubtree(cursor cursorObj, oldName string, newName string) (uint32, error) {
+	sqlStr := `update notebook.note_tag
+					set tag_name = concat(?, substring(tag_name, char_length(?) + 1))
+					where tag_name = ? or left(tag_name, char_length(?) + 1) = concat(?, '/')`
+	result, err := cursor.Exec(sqlStr, newName, oldName, oldName, oldName, oldName)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// mergeNoteTags tags the notes of source tags with the target tag,
+// notes already tagged with the target are skipped by the unique key "note_tag_id"
+func mergeNoteTags(cursor cursorObj, targetIns tagObj, srcIDs ...uint32) (uint32, error) {
+	var params []string
+	for i := 0; i < len(srcIDs); i++ {
+		params = append(params, "?")
+	}
+	sqlStr := fmt.Sprintf(`insert ignore into notebook.note_tag (note_id, tag_id, tag_name)
+					select note_id, ?, ?
+					from notebook.note_tag
+					where tag_id in (%s)`, strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+
+	args := []interface{}{targetIns.ID, targetIns.Name}
+	for _, id := range srcIDs {
+		args = append(args, id)
+	}
+
+	result, err := cursor.Exec(sqlStr, args...)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func deleteNoteTagsByTagID(cursor cursorObj, ids ...uint32) (uint32, error) {
+	var params []string
+	for i := 0; i < len(ids); i++ {
+		params = append(params, "?")
+	}
+	sqlStr := fmt.Sprintf("delete from notebook.note_tag where tag_id in (%s)", strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+
+	var args []interface{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	result, err := cursor.Exec(sqlStr, args...)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func deleteTagsByID(cursor cursorObj, ids ...uint32) (uint32, error) {
+	var params []string
+	for i := 0; i < len(ids); i++ {
+		params = append(params, "?")
+	}
+	sqlStr := fmt.Sprintf("delete from notebook.tag where id in (%s)", strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+
+	var args []interface{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	result, err := cursor.Exec(sqlStr, args...)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func updateTagByTagID(cursor cursorObj, tagID uint32, description string, color string, slug sql.NullString) (uint32, error) {
+	sqlStr := `update notebook.tag
+					set description = ?, color = ?, slug = ?
+					where id = ?`
+	result, err := cursor.Exec(sqlStr, description, color, slug, tagID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
 func insertNote(cursor cursorObj, title string, author string, content string, plainText string, private bool, words uint32) (uint32, error) {
 	sqlStr := `insert into notebook.note 
   				  	  (title, author, content, plain_text, words, private) 
@@ -191,7 +481,7 @@ func insertNote(cursor cursorObj, title string, author string, content string, p
 
 func selectNoteByNoteID(cursor cursorObj, noteID uint32, closeRows bool) (*noteObj, error) {
 	noteSqlIns := &noteSqlObj{}
-	sqlStr := `select note.id, title, author, content, plain_text, words, private, 
+	sqlStr := `select note.id, title, author, content, plain_text, words, private, ifnull(slug, ''),
 					note.created_at, note.update_at, note_tag.tag_id, note_tag.tag_name
 					from notebook.note
 					left outer join notebook.note_tag note_tag
@@ -208,8 +498,8 @@ func selectNoteByNoteID(cursor cursorObj, noteID uint32, closeRows bool) (*noteO
 	var noteInsPtr *noteObj
 	for rows.Next() {
 		err := rows.Scan(&noteSqlIns.ID, &noteSqlIns.Title, &noteSqlIns.Author, &noteSqlIns.Content,
-			&noteSqlIns.PlainText, &noteSqlIns.Words, &noteSqlIns.Auth, &noteSqlIns.CreatedAt, &noteSqlIns.UpdatedAt,
-			&noteSqlIns.TagID, &noteSqlIns.TagName)
+			&noteSqlIns.PlainText, &noteSqlIns.Words, &noteSqlIns.Auth, &noteSqlIns.Slug,
+			&noteSqlIns.CreatedAt, &noteSqlIns.UpdatedAt, &noteSqlIns.TagID, &noteSqlIns.TagName)
 		if err != nil {
 			return nil, err
 		}
@@ -217,7 +507,7 @@ func selectNoteByNoteID(cursor cursorObj, noteID uint32, closeRows bool) (*noteO
 		if noteInsPtr == nil {
 			noteInsPtr = &noteObj{
 				ID: noteSqlIns.ID, Title: noteSqlIns.Title, Author: noteSqlIns.Author, Content: noteSqlIns.Content,
-				PlainText: noteSqlIns.PlainText, Private: noteSqlIns.Auth, Words: noteSqlIns.Words,
+				PlainText: noteSqlIns.PlainText, Private: noteSqlIns.Auth, Words: noteSqlIns.Words, Slug: noteSqlIns.Slug,
 				CreatedAt: noteSqlIns.CreatedAt, UpdateAt: noteSqlIns.UpdatedAt,
 				Tags: []tagObj{}}
 		}
@@ -231,66 +521,134 @@ func selectNoteByNoteID(cursor cursorObj, noteID uint32, closeRows bool) (*noteO
 	return noteInsPtr, nil
 }
 
-func selectNotesByTagID(cursor cursorObj, pageNo uint32, pageSize uint32, tagID uint32, autoSort bool, closeRows bool) ([]*noteObj, error) {
-	// return pointer to local variable is ok in golang, see https://stackoverflow.com/questions/13715237/return-pointer-to-local-struct
-	notesInsPtr := make([]*noteObj, 0)
+func selectNoteBriefByNoteID(cursor cursorObj, noteID uint32) (*noteObj, error) {
+	noteInsPtr := &noteObj{Tags: []tagObj{}}
+	sqlStr := `select id, title, author, private, words, ifnull(slug, ''), created_at, update_at
+					from notebook.note
+					where id = ?`
+	err := cursor.QueryRow(sqlStr, noteID).Scan(&noteInsPtr.ID, &noteInsPtr.Title, &noteInsPtr.Author,
+		&noteInsPtr.Private, &noteInsPtr.Words, &noteInsPtr.Slug, &noteInsPtr.CreatedAt, &noteInsPtr.UpdateAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return noteInsPtr, nil
+}
 
-	var sqlStr string
-	var sqlSort string
-	var rows *sql.Rows
-	var err error
+// notesFilterSQL composes the where clause of notes selected by the filter, values are always bound as parameters
+// and columns come from the "noteSortColumns" whitelist
+func notesFilterSQL(filterIns *notesFilterObj, afterIns *notesCursorObj) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
 
-	if autoSort {
-		sqlSort = "order by update_at desc"
-	} else {
-		sqlSort = ""
+	tagSubquery := `id in (
+					  select note_tag.note_id
+					  from notebook.note_tag note_tag
+					  inner join notebook.tag descendant
+					  on note_tag.tag_id = descendant.id
+					  inner join notebook.tag tag
+					  on descendant.name = tag.name
+					  or left(descendant.name, char_length(tag.name) + 1) = concat(tag.name, '/')
+					  where tag.id in (%s)
+					)`
+	if len(filterIns.Tags) > 0 && filterIns.TagMode == tagModeAnd {
+		for _, tagID := range filterIns.Tags {
+			conditions = append(conditions, fmt.Sprintf(tagSubquery, "?"))
+			args = append(args, tagID)
+		}
+	} else if len(filterIns.Tags) > 0 {
+		var params []string
+		for _, tagID := range filterIns.Tags {
+			params = append(params, "?")
+			args = append(args, tagID)
+		}
+		conditions = append(conditions, fmt.Sprintf(tagSubquery, strings.Join(params, ",")))
+	}
+
+	if filterIns.From != "" {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filterIns.From)
+	}
+	if filterIns.To != "" {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filterIns.To)
+	}
+	switch filterIns.Visibility {
+	case visibilityPublic:
+		conditions = append(conditions, "private = 0")
+	case visibilityPrivate:
+		conditions = append(conditions, "private = 1")
+	}
+	if filterIns.Author != "" {
+		conditions = append(conditions, "author = ?")
+		args = append(args, filterIns.Author)
 	}
 
-	if tagID > 0 {
-		sqlStr = `select note.id, title, author, content, plain_text, words, private, 
+	// keyset of the cursor, ties of the sort column are broken by id in the same direction
+	if afterIns != nil {
+		column := noteSortColumns[filterIns.Sort]
+		op := "<"
+		if filterIns.Order == orderAsc {
+			op = ">"
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s %s ? or (%s = ? and id %s ?))", column, op, column, op))
+		args = append(args, afterIns.Value, afterIns.Value, afterIns.ID)
+	}
+
+	if len(conditions) <= 0 {
+		return "", args
+	}
+	return "where " + strings.Join(conditions, " and "), args
+}
+
+// selectNotesByFilter selects a page of notes with their tags, paged by offset, or by keyset if afterIns is given
+func selectNotesByFilter(cursor cursorObj, filterIns *notesFilterObj, afterIns *notesCursorObj, offset uint32, limit uint32, closeRows bool) ([]*noteObj, error) {
+	// return pointer to local variable is ok in golang, see https://stackoverflow.com/questions/13715237/return-pointer-to-local-struct
+	notesInsPtr := make([]*noteObj, 0)
+
+	sqlWhere, args := notesFilterSQL(filterIns, afterIns)
+	column := noteSortColumns[filterIns.Sort]
+	sqlSort := fmt.Sprintf("order by %s %s, id %s", column, filterIns.Order, filterIns.Order)
+	// the order of the derived table is not kept by the join, so sort again
+	sqlOuterSort := fmt.Sprintf("order by note.%s %s, note.id %s", column, filterIns.Order, filterIns.Order)
+	args = append(args, offset, limit)
+
+	sqlStr := `select note.id, title, author, content, plain_text, words, private, slug,
        			note.created_at, note.update_at,
 					tag_id, tag_name from (
-					select note.id, title, author, content, plain_text, words, private, 
-       			note.created_at, note.update_at
-					from notebook.note note
-					inner join notebook.note_tag note_tag
-					on note.id = note_tag.note_id
-					and note_tag.tag_id = ?
+					select id, title, author, content, plain_text, words, private, ifnull(slug, '') as slug,
+       			created_at, update_at
+					from notebook.note
+					%s
 					%s
 					limit ?, ?) as note
-					inner join notebook.note_tag note_tag
+					left outer join notebook.note_tag note_tag
 					on note.id = note_tag.note_id
-					`
-		sqlStr = fmt.Sprintf(sqlStr, sqlSort)
-		rows, err = cursor.Query(sqlStr, tagID, (pageNo-1)*pageSize, pageSize)
-	} else {
-		sqlStr = `select note.id, title, author, content, plain_text, words, private, 
-       				note.created_at, note.update_at,
-						tag_id, tag_name from (
-						select id, title, author, content, plain_text, words, private, 
-       				created_at, update_at
-						from notebook.note 
-						%s
-						limit ?, ?) as note
-						left outer join notebook.note_tag note_tag
-						on note.id = note_tag.note_id`
-		sqlStr = fmt.Sprintf(sqlStr, sqlSort)
-		rows, err = cursor.Query(sqlStr, (pageNo-1)*pageSize, pageSize)
-	}
-
+					%s`
+	sqlStr = fmt.Sprintf(sqlStr, sqlWhere, sqlSort, sqlOuterSort)
+	log.Logger.WithField("sql", sqlStr).Debug()
+	rows, err := cursor.Query(sqlStr, args...)
 	if err != nil {
-		return notesInsPtr, nil
+		return notesInsPtr, err
 	}
-
 	if closeRows {
 		defer rows.Close()
 	}
 
+	return scanNotesWithTags(rows)
+}
+
+// scanNotesWithTags groups the rows of notes joined with their tags by note, keeping the order of rows
+func scanNotesWithTags(rows *sql.Rows) ([]*noteObj, error) {
+	notesInsPtr := make([]*noteObj, 0)
+
 	notesInsPtrMap := map[uint32]*noteObj{}
 	for rows.Next() {
 		var noteSqlIns noteSqlObj
 		err := rows.Scan(&noteSqlIns.ID, &noteSqlIns.Title, &noteSqlIns.Author, &noteSqlIns.Content,
-			&noteSqlIns.PlainText, &noteSqlIns.Words, &noteSqlIns.Auth,
+			&noteSqlIns.PlainText, &noteSqlIns.Words, &noteSqlIns.Auth, &noteSqlIns.Slug,
 			&noteSqlIns.CreatedAt, &noteSqlIns.UpdatedAt,
 			&noteSqlIns.TagID, &noteSqlIns.TagName)
 		if err != nil {
@@ -301,10 +659,11 @@ func selectNotesByTagID(cursor cursorObj, pageNo uint32, pageSize uint32, tagID
 		if _, ok := notesInsPtrMap[noteSqlIns.ID]; !ok {
 			noteInsPtr = &noteObj{
 				ID: noteSqlIns.ID, Title: noteSqlIns.Title, Author: noteSqlIns.Author, Content: noteSqlIns.Content,
-				PlainText: noteSqlIns.PlainText, Private: noteSqlIns.Auth, Words: noteSqlIns.Words,
+				PlainText: noteSqlIns.PlainText, Private: noteSqlIns.Auth, Words: noteSqlIns.Words, Slug: noteSqlIns.Slug,
 				CreatedAt: noteSqlIns.CreatedAt, UpdateAt: noteSqlIns.UpdatedAt,
 				Tags: []tagObj{}}
 			notesInsPtrMap[noteSqlIns.ID] = noteInsPtr
+			notesInsPtr = append(notesInsPtr, noteInsPtr)
 		} else {
 			noteInsPtr = notesInsPtrMap[noteSqlIns.ID]
 		}
@@ -318,42 +677,59 @@ func selectNotesByTagID(cursor cursorObj, pageNo uint32, pageSize uint32, tagID
 		return nil, err
 	}
 
-	for _, v := range notesInsPtrMap {
-		notesInsPtr = append(notesInsPtr, v)
-	}
-
-	if autoSort {
-		sort.Sort(notesInsPtrSlice(notesInsPtr))
-	}
-
 	return notesInsPtr, nil
 }
 
-func selectNotesCountByTagID(cursor cursorObj, tagID uint32) (uint32, error) {
-	var err error
-	var sqlStr string
+func selectNotesCountByFilter(cursor cursorObj, filterIns *notesFilterObj) (uint32, error) {
 	var cnt uint32
 
-	if tagID != 0 {
-		sqlStr = `select count(distinct note.id)
-						from notebook.note note
-						inner join notebook.note_tag note_tag
-						on note.id = note_tag.note_id
-						and note_tag.tag_id = ?`
-		err = cursor.QueryRow(sqlStr, tagID).Scan(&cnt)
-	} else {
-		sqlStr = "select count(id) from notebook.note"
-		err = cursor.QueryRow(sqlStr).Scan(&cnt)
-	}
-
-	if err != nil {
+	sqlWhere, args := notesFilterSQL(filterIns, nil)
+	sqlStr := fmt.Sprintf("select count(id) from notebook.note %s", sqlWhere)
+	log.Logger.WithField("sql", sqlStr).Debug()
+	if err := cursor.QueryRow(sqlStr, args...).Scan(&cnt); err != nil {
 		return 0, err
 	}
 	return cnt, nil
 }
 
-func updateNoteByNoteID(cursor cursorObj, noteID uint32, title string, content string, plainText string, words uint32, private bool) (uint32, error) {
-	sqlStr := `update notebook.note
+// selectAncestorTagIDsByNoteID returns the ids of the tags of a note and their ancestors,
+// i.e. the tags whose notes list contains the note
+func selectAncestorTagIDsByNoteID(cursor cursorObj, noteID uint32, closeRows bool) ([]uint32, error) {
+	tagIDs := make([]uint32, 0)
+
+	sqlStr := `select distinct tag.id
+					from notebook.note_tag note_tag
+					inner join notebook.tag descendant
+					on note_tag.tag_id = descendant.id
+					inner join notebook.tag tag
+					on descendant.name = tag.name
+					or left(descendant.name, char_length(tag.name) + 1) = concat(tag.name, '/')
+					where note_tag.note_id = ?`
+	rows, err := cursor.Query(sqlStr, noteID)
+	if err != nil {
+		return tagIDs, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var tagID uint32
+		if err := rows.Scan(&tagID); err != nil {
+			return tagIDs, err
+		}
+		tagIDs = append(tagIDs, tagID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return tagIDs, err
+	}
+
+	return tagIDs, nil
+}
+
+func updateNoteByNoteID(cursor cursorObj, noteID uint32, title string, content string, plainText string, words uint32, private bool) (uint32, error) {
+	sqlStr := `update notebook.note
 					set title = ?, content = ?, plain_text = ?, words = ?, private = ?
 					where id = ?`
 	result, err := cursor.Exec(sqlStr, title, content, plainText, words, private, noteID)
@@ -367,6 +743,21 @@ func updateNoteByNoteID(cursor cursorObj, noteID uint32, title string, content s
 	return uint32(rowsAffected), nil
 }
 
+func updateNoteTimesByNoteID(cursor cursorObj, noteID uint32, createdAt string, updateAt string) (uint32, error) {
+	sqlStr := `update notebook.note
+					set created_at = ?, update_at = ?
+					where id = ?`
+	result, err := cursor.Exec(sqlStr, createdAt, updateAt, noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
 func deleteNoteByNoteID(cursor cursorObj, noteID uint32) (uint32, error) {
 	sqlStr := "delete from notebook.note where id = ?"
 	result, err := cursor.Exec(sqlStr, noteID)
@@ -419,3 +810,1123 @@ func deleteNoteTagsByNoteID(cursor cursorObj, noteID uint32) (uint32, error) {
 	}
 	return uint32(rowsAffected), nil
 }
+
+func selectNoteIDByTitle(cursor cursorObj, title string) (uint32, error) {
+	var noteID uint32
+	sqlStr := "select id from notebook.note where title = ? order by id limit 1"
+	err := cursor.QueryRow(sqlStr, title).Scan(&noteID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return noteID, nil
+}
+
+func insertNoteLinks(cursor cursorObj, srcNoteID uint32, linksIns ...noteLinkObj) (uint32, error) {
+	if len(linksIns) <= 0 {
+		return 0, nil
+	}
+
+	var params []string
+	for i := 0; i < len(linksIns); i++ {
+		params = append(params, fmt.Sprintf("(%d, ?, ?)", srcNoteID))
+	}
+	sqlStr := fmt.Sprintf("insert into notebook.note_link (src_note_id, dst_note_id, target) values %s", strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+
+	var args []interface{}
+	for _, linkIns := range linksIns {
+		args = append(args, linkIns.NoteID, linkIns.Target)
+	}
+
+	result, err := cursor.Exec(sqlStr, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(rowsAffected), nil
+}
+
+func deleteNoteLinksBySrcNoteID(cursor cursorObj, noteID uint32) (uint32, error) {
+	sqlStr := `delete from notebook.note_link
+					where src_note_id = ?`
+	result, err := cursor.Exec(sqlStr, noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// unresolveNoteLinksByDstNoteID turns links to a deleted note into pending links
+func unresolveNoteLinksByDstNoteID(cursor cursorObj, noteID uint32) (uint32, error) {
+	sqlStr := `update notebook.note_link
+					set dst_note_id = 0
+					where dst_note_id = ?`
+	result, err := cursor.Exec(sqlStr, noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// resolvePendingNoteLinks points pending "[[title]]" and "[[#id]]" links to the note which has just got that title,
+// or has just been created with that id
+func resolvePendingNoteLinks(cursor cursorObj, noteID uint32, title string) (uint32, error) {
+	sqlStr := `update notebook.note_link
+					set dst_note_id = ?
+					where dst_note_id = 0 and (target = ? or target = ?) and src_note_id != ?`
+	result, err := cursor.Exec(sqlStr, noteID, title, fmt.Sprintf("#%d", noteID), noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func selectNoteLinksBySrcNoteID(cursor cursorObj, noteID uint32, closeRows bool) ([]noteLinkObj, error) {
+	linksIns := make([]noteLinkObj, 0)
+
+	sqlStr := `select note_link.target, note_link.dst_note_id, ifnull(note.title, ''), ifnull(note.private, 0)
+					from notebook.note_link note_link
+					left outer join notebook.note note
+					on note_link.dst_note_id = note.id
+					where note_link.src_note_id = ?`
+	rows, err := cursor.Query(sqlStr, noteID)
+	if err != nil {
+		return linksIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var linkIns noteLinkObj
+		if err := rows.Scan(&linkIns.Target, &linkIns.NoteID, &linkIns.Title, &linkIns.Private); err != nil {
+			return linksIns, err
+		}
+		linksIns = append(linksIns, linkIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return linksIns, err
+	}
+
+	return linksIns, nil
+}
+
+// selectNoteModifiedAt returns the latest update time of what a note response shows: the note and its tags,
+// the notes linking to it or linked by it, and its series with the other notes in it
+func selectNoteModifiedAt(cursor cursorObj, noteID uint32) (string, error) {
+	var modifiedAt sql.NullString
+	sqlStr := `select max(update_at) from (
+					  select update_at from notebook.note where id = ?
+					  union all
+					  select update_at from notebook.note_tag where note_id = ?
+					  union all
+					  select link.update_at from notebook.note_link link where link.src_note_id = ? or link.dst_note_id = ?
+					  union all
+					  select note.update_at
+					  from notebook.note_link link
+					  inner join notebook.note note
+					  on note.id = link.src_note_id and link.dst_note_id = ? or note.id = link.dst_note_id and link.src_note_id = ?
+					  union all
+					  select series.update_at
+					  from notebook.series_note series_note
+					  inner join notebook.series series
+					  on series.id = series_note.series_id
+					  where series_note.note_id = ?
+					  union all
+					  select other.update_at
+					  from notebook.series_note series_note
+					  inner join notebook.series_note other
+					  on other.series_id = series_note.series_id
+					  where series_note.note_id = ?
+					  union all
+					  select note.update_at
+					  from notebook.series_note series_note
+					  inner join notebook.series_note other
+					  on other.series_id = series_note.series_id
+					  inner join notebook.note note
+					  on note.id = other.note_id
+					  where series_note.note_id = ?
+					) times`
+	log.Logger.WithField("sql", sqlStr).Debug()
+	err := cursor.QueryRow(sqlStr, noteID, noteID, noteID, noteID, noteID, noteID, noteID, noteID, noteID).Scan(&modifiedAt)
+	if err != nil {
+		return "", err
+	}
+	return modifiedAt.String, nil
+}
+
+func selectBacklinksByNoteID(cursor cursorObj, noteID uint32, closeRows bool) ([]noteLinkObj, error) {
+	linksIns := make([]noteLinkObj, 0)
+
+	sqlStr := `select note_link.target, note.id, note.title, note.private
+					from notebook.note_link note_link
+					inner join notebook.note note
+					on note_link.src_note_id = note.id
+					where note_link.dst_note_id = ?
+					order by note.update_at desc`
+	rows, err := cursor.Query(sqlStr, noteID)
+	if err != nil {
+		return linksIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var linkIns noteLinkObj
+		if err := rows.Scan(&linkIns.Target, &linkIns.NoteID, &linkIns.Title, &linkIns.Private); err != nil {
+			return linksIns, err
+		}
+		linksIns = append(linksIns, linkIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return linksIns, err
+	}
+
+	return linksIns, nil
+}
+
+func selectGraphNodes(cursor cursorObj, closeRows bool) ([]graphNodeObj, error) {
+	nodesIns := make([]graphNodeObj, 0)
+
+	sqlStr := "select id, title, private from notebook.note"
+	rows, err := cursor.Query(sqlStr)
+	if err != nil {
+		return nodesIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var nodeIns graphNodeObj
+		if err := rows.Scan(&nodeIns.ID, &nodeIns.Title, &nodeIns.Private); err != nil {
+			return nodesIns, err
+		}
+		nodesIns = append(nodesIns, nodeIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nodesIns, err
+	}
+
+	return nodesIns, nil
+}
+
+func selectGraphEdges(cursor cursorObj, closeRows bool) ([]graphEdgeObj, error) {
+	edgesIns := make([]graphEdgeObj, 0)
+
+	sqlStr := `select distinct src_note_id, dst_note_id
+					from notebook.note_link
+					where dst_note_id != 0`
+	rows, err := cursor.Query(sqlStr)
+	if err != nil {
+		return edgesIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var edgeIns graphEdgeObj
+		if err := rows.Scan(&edgeIns.Source, &edgeIns.Target); err != nil {
+			return edgesIns, err
+		}
+		edgesIns = append(edgesIns, edgeIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return edgesIns, err
+	}
+
+	return edgesIns, nil
+}
+
+// selectArchive counts notes by the year and month they were created in, latest first
+func selectArchive(cursor cursorObj, closeRows bool) ([]archiveObj, error) {
+	archiveIns := make([]archiveObj, 0)
+
+	sqlStr := `select year(created_at) as y, month(created_at) as m, count(id)
+					from notebook.note
+					group by y, m
+					order by y desc, m desc`
+	rows, err := cursor.Query(sqlStr)
+	if err != nil {
+		return archiveIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var monthIns archiveObj
+		if err := rows.Scan(&monthIns.Year, &monthIns.Month, &monthIns.Count); err != nil {
+			return archiveIns, err
+		}
+		archiveIns = append(archiveIns, monthIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return archiveIns, err
+	}
+
+	return archiveIns, nil
+}
+
+// selectCalendarDays returns the days in [from, to) on which notes were created, with the number of notes and words
+func selectCalendarDays(cursor cursorObj, from string, to string, closeRows bool) ([]calendarDayObj, error) {
+	daysIns := make([]calendarDayObj, 0)
+
+	sqlStr := `select date_format(created_at, '%Y-%m-%d') as d, count(id), ifnull(sum(words), 0)
+					from notebook.note
+					where created_at >= ? and created_at < ?
+					group by d
+					order by d`
+	rows, err := cursor.Query(sqlStr, from, to)
+	if err != nil {
+		return daysIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var dayIns calendarDayObj
+		if err := rows.Scan(&dayIns.Date, &dayIns.Count, &dayIns.Words); err != nil {
+			return daysIns, err
+		}
+		daysIns = append(daysIns, dayIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return daysIns, err
+	}
+
+	return daysIns, nil
+}
+
+// selectFirstNoteCreatedAt returns the creation time of the oldest note, or "" if there are no notes
+func selectFirstNoteCreatedAt(cursor cursorObj) (string, error) {
+	var createdAt sql.NullString
+	sqlStr := "select min(created_at) from notebook.note"
+	if err := cursor.QueryRow(sqlStr).Scan(&createdAt); err != nil {
+		return "", err
+	}
+	return createdAt.String, nil
+}
+
+// selectNotesByCreatedRanges selects notes with their tags created in any of the [from, to) ranges, latest first
+func selectNotesByCreatedRanges(cursor cursorObj, ranges [][2]string, closeRows bool) ([]*noteObj, error) {
+	notesInsPtr := make([]*noteObj, 0)
+	if len(ranges) <= 0 {
+		return notesInsPtr, nil
+	}
+
+	var conditions []string
+	var args []interface{}
+	for _, r := range ranges {
+		conditions = append(conditions, "(created_at >= ? and created_at < ?)")
+		args = append(args, r[0], r[1])
+	}
+
+	sqlStr := `select note.id, title, author, content, plain_text, words, private, slug,
+       			note.created_at, note.update_at,
+					tag_id, tag_name from (
+					select id, title, author, content, plain_text, words, private, ifnull(slug, '') as slug,
+       			created_at, update_at
+					from notebook.note
+					where %s) as note
+					left outer join notebook.note_tag note_tag
+					on note.id = note_tag.note_id
+					order by note.created_at desc, note.id desc`
+	sqlStr = fmt.Sprintf(sqlStr, strings.Join(conditions, " or "))
+	log.Logger.WithField("sql", sqlStr).Debug()
+	rows, err := cursor.Query(sqlStr, args...)
+	if err != nil {
+		return notesInsPtr, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	return scanNotesWithTags(rows)
+}
+
+// sitemapNotesSQL selects public notes not tagged by any of the excluded tags or their descendants
+func sitemapNotesSQL(excludedTags []string) (string, []interface{}) {
+	sqlWhere := "where private = 0"
+	var args []interface{}
+	if len(excludedTags) > 0 {
+		var conditions []string
+		for _, name := range excludedTags {
+			conditions = append(conditions, "tag.name = ? or left(tag.name, char_length(?) + 1) = concat(?, '/')")
+			args = append(args, name, name, name)
+		}
+		sqlWhere += fmt.Sprintf(` and id not in (
+					  select note_tag.note_id
+					  from notebook.note_tag note_tag
+					  inner join notebook.tag tag
+					  on note_tag.tag_id = tag.id
+					  where %s
+					)`, strings.Join(conditions, " or "))
+	}
+	return sqlWhere, args
+}
+
+func selectSitemapNotesCount(cursor cursorObj, excludedTags []string) (uint32, error) {
+	var cnt uint32
+	sqlWhere, args := sitemapNotesSQL(excludedTags)
+	sqlStr := fmt.Sprintf("select count(id) from notebook.note %s", sqlWhere)
+	log.Logger.WithField("sql", sqlStr).Debug()
+	if err := cursor.QueryRow(sqlStr, args...).Scan(&cnt); err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+func selectSitemapNotes(cursor cursorObj, excludedTags []string, offset uint32, limit uint32, closeRows bool) ([]noteObj, error) {
+	notesIns := make([]noteObj, 0)
+
+	sqlWhere, args := sitemapNotesSQL(excludedTags)
+	sqlStr := fmt.Sprintf(`select id, ifnull(slug, ''), update_at
+					from notebook.note
+					%s
+					order by id
+					limit ?, ?`, sqlWhere)
+	log.Logger.WithField("sql", sqlStr).Debug()
+	rows, err := cursor.Query(sqlStr, append(args, offset, limit)...)
+	if err != nil {
+		return notesIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var noteIns noteObj
+		if err := rows.Scan(&noteIns.ID, &noteIns.Slug, &noteIns.UpdateAt); err != nil {
+			return notesIns, err
+		}
+		notesIns = append(notesIns, noteIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return notesIns, err
+	}
+
+	return notesIns, nil
+}
+
+func selectNotesCountByNoteIDs(cursor cursorObj, noteIDs ...uint32) (uint32, error) {
+	var params []string
+	for i := 0; i < len(noteIDs); i++ {
+		params = append(params, "?")
+	}
+	sqlStr := fmt.Sprintf("select count(id) from notebook.note where id in (%s)", strings.Join(params, ","))
+
+	var args []interface{}
+	for _, noteID := range noteIDs {
+		args = append(args, noteID)
+	}
+
+	var cnt uint32
+	if err := cursor.QueryRow(sqlStr, args...).Scan(&cnt); err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+func insertSeries(cursor cursorObj, title string, description string) (uint32, error) {
+	sqlStr := `insert into notebook.series
+					(title, description)
+					values
+					(?, ?)`
+	result, err := cursor.Exec(sqlStr, title, description)
+	if err != nil {
+		return 0, err
+	}
+
+	seriesID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(seriesID), nil
+}
+
+func updateSeriesBySeriesID(cursor cursorObj, seriesID uint32, title string, description string) (uint32, error) {
+	sqlStr := `update notebook.series
+					set title = ?, description = ?
+					where id = ?`
+	result, err := cursor.Exec(sqlStr, title, description, seriesID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func deleteSeriesBySeriesID(cursor cursorObj, seriesID uint32) (uint32, error) {
+	sqlStr := "delete from notebook.series where id = ?"
+	result, err := cursor.Exec(sqlStr, seriesID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func selectSeriesBySeriesID(cursor cursorObj, seriesID uint32, forUpdate bool) (*seriesObj, error) {
+	seriesInsPtr := &seriesObj{Notes: []noteLinkObj{}}
+	sqlStr := `select id, title, description, created_at, update_at
+					from notebook.series
+					where id = ?`
+	if forUpdate {
+		sqlStr += " for update"
+	}
+	err := cursor.QueryRow(sqlStr, seriesID).Scan(&seriesInsPtr.ID, &seriesInsPtr.Title, &seriesInsPtr.Description,
+		&seriesInsPtr.CreatedAt, &seriesInsPtr.UpdateAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return seriesInsPtr, nil
+}
+
+// selectSeriesWithNotesCount lists all series, private notes are not counted unless withPrivate
+func selectSeriesWithNotesCount(cursor cursorObj, withPrivate bool, closeRows bool) ([]seriesObj, error) {
+	seriesListIns := make([]seriesObj, 0)
+
+	sqlStr := `select series.id, series.title, series.description, series.created_at, series.update_at,
+					count(note.id) as cnt
+					from notebook.series series
+					left outer join notebook.series_note series_note
+					on series.id = series_note.series_id
+					left outer join notebook.note note
+					on series_note.note_id = note.id
+					and (note.private = 0 or ?)
+					group by series.id, series.title, series.description, series.created_at, series.update_at
+					order by series.update_at desc`
+	rows, err := cursor.Query(sqlStr, withPrivate)
+	if err != nil {
+		return seriesListIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		seriesIns := seriesObj{Notes: []noteLinkObj{}}
+		err := rows.Scan(&seriesIns.ID, &seriesIns.Title, &seriesIns.Description,
+			&seriesIns.CreatedAt, &seriesIns.UpdateAt, &seriesIns.Count)
+		if err != nil {
+			return seriesListIns, err
+		}
+		seriesListIns = append(seriesListIns, seriesIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return seriesListIns, err
+	}
+
+	return seriesListIns, nil
+}
+
+func insertSeriesNotes(cursor cursorObj, seriesID uint32, noteIDs ...uint32) (uint32, error) {
+	if len(noteIDs) <= 0 {
+		return 0, nil
+	}
+
+	var params []string
+	for i := 0; i < len(noteIDs); i++ {
+		params = append(params, fmt.Sprintf("(%d, ?, %d)", seriesID, i+1))
+	}
+	sqlStr := fmt.Sprintf("insert into notebook.series_note (series_id, note_id, position) values %s", strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+
+	var args []interface{}
+	for _, noteID := range noteIDs {
+		args = append(args, noteID)
+	}
+
+	result, err := cursor.Exec(sqlStr, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(rowsAffected), nil
+}
+
+func deleteSeriesNotesBySeriesID(cursor cursorObj, seriesID uint32) (uint32, error) {
+	sqlStr := `delete from notebook.series_note
+					where series_id = ?`
+	result, err := cursor.Exec(sqlStr, seriesID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func deleteSeriesNotesByNoteID(cursor cursorObj, noteIDs ...uint32) (uint32, error) {
+	var params []string
+	for i := 0; i < len(noteIDs); i++ {
+		params = append(params, "?")
+	}
+	sqlStr := fmt.Sprintf("delete from notebook.series_note where note_id in (%s)", strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+
+	var args []interface{}
+	for _, noteID := range noteIDs {
+		args = append(args, noteID)
+	}
+
+	result, err := cursor.Exec(sqlStr, args...)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func selectSeriesNotesBySeriesID(cursor cursorObj, seriesID uint32, closeRows bool) ([]noteLinkObj, error) {
+	notesIns := make([]noteLinkObj, 0)
+
+	sqlStr := `select note.id, note.title, note.private
+					from notebook.series_note series_note
+					inner join notebook.note note
+					on series_note.note_id = note.id
+					where series_note.series_id = ?
+					order by series_note.position`
+	rows, err := cursor.Query(sqlStr, seriesID)
+	if err != nil {
+		return notesIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var noteIns noteLinkObj
+		if err := rows.Scan(&noteIns.NoteID, &noteIns.Title, &noteIns.Private); err != nil {
+			return notesIns, err
+		}
+		notesIns = append(notesIns, noteIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return notesIns, err
+	}
+
+	return notesIns, nil
+}
+
+func selectSeriesIDByNoteID(cursor cursorObj, noteID uint32) (uint32, error) {
+	var seriesID uint32
+	sqlStr := "select series_id from notebook.series_note where note_id = ?"
+	err := cursor.QueryRow(sqlStr, noteID).Scan(&seriesID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return seriesID, nil
+}
+
+// selectNoteIDBySlug looks up the current and old slugs
+func selectNoteIDBySlug(cursor cursorObj, slug string, forUpdate bool) (uint32, error) {
+	var noteID uint32
+	sqlStr := "select note_id from notebook.note_slug where slug = ?"
+	if forUpdate {
+		sqlStr += " for update"
+	}
+	err := cursor.QueryRow(sqlStr, slug).Scan(&noteID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return noteID, nil
+}
+
+func insertNoteSlug(cursor cursorObj, noteID uint32, slug string) (uint32, error) {
+	sqlStr := "insert into notebook.note_slug (note_id, slug) values (?, ?)"
+	result, err := cursor.Exec(sqlStr, noteID, slug)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func updateNoteSlugByNoteID(cursor cursorObj, noteID uint32, slug string) (uint32, error) {
+	sqlStr := `update notebook.note
+					set slug = ?
+					where id = ?`
+	result, err := cursor.Exec(sqlStr, slug, noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func deleteNoteSlugsByNoteID(cursor cursorObj, noteID uint32) (uint32, error) {
+	sqlStr := `delete from notebook.note_slug
+					where note_id = ?`
+	result, err := cursor.Exec(sqlStr, noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// selectNoteIDByImportSource returns the note imported from source, e.g. "wp:42", or 0 if it was not imported
+func selectNoteIDByImportSource(cursor cursorObj, source string) (uint32, error) {
+	var noteID uint32
+	sqlStr := "select note_id from notebook.note_import where source = ?"
+	err := cursor.QueryRow(sqlStr, source).Scan(&noteID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return noteID, nil
+}
+
+func insertNoteImport(cursor cursorObj, noteID uint32, source string) (uint32, error) {
+	sqlStr := "insert into notebook.note_import (note_id, source) values (?, ?)"
+	result, err := cursor.Exec(sqlStr, noteID, source)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func deleteNoteImportsByNoteID(cursor cursorObj, noteID uint32) (uint32, error) {
+	sqlStr := `delete from notebook.note_import
+					where note_id = ?`
+	result, err := cursor.Exec(sqlStr, noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// selectNotesWithoutSlug selects the notes without a slug
+func selectNotesWithoutSlug(cursor cursorObj, closeRows bool) ([]noteLinkObj, error) {
+	notesIns := make([]noteLinkObj, 0)
+
+	sqlStr := "select id, title from notebook.note where slug is null order by id"
+	rows, err := cursor.Query(sqlStr)
+	if err != nil {
+		return notesIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var noteIns noteLinkObj
+		if err := rows.Scan(&noteIns.NoteID, &noteIns.Title); err != nil {
+			return notesIns, err
+		}
+		notesIns = append(notesIns, noteIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return notesIns, err
+	}
+
+	return notesIns, nil
+}
+
+// selectNotesContent calls fn with the content, plain text and stored words of every note, without holding them
+// all in memory
+func selectNotesContent(cursor cursorObj, fn func(noteIns noteObj) error) error {
+	sqlStr := "select id, content, plain_text, words from notebook.note order by id"
+	rows, err := cursor.Query(sqlStr)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var noteIns noteObj
+		if err := rows.Scan(&noteIns.ID, &noteIns.Content, &noteIns.PlainText, &noteIns.Words); err != nil {
+			return err
+		}
+		if err := fn(noteIns); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// updateNotePlainTextByNoteID keeps update_at, extracting the text again is not an edit of the note
+func updateNotePlainTextByNoteID(cursor cursorObj, noteID uint32, plainText string, words uint32) (uint32, error) {
+	sqlStr := `update notebook.note
+					set plain_text = ?, words = ?, update_at = update_at
+					where id = ?`
+	result, err := cursor.Exec(sqlStr, plainText, words, noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// ------------------------------------------------------------------
+
+// selectTableRows calls fn with every row of table in primary key order, as values of the mysql driver:
+// []byte for text and timestamps, int64 for integers and nil for null
+func selectTableRows(cursor cursorObj, table string, fn func(values []interface{}) error) ([]string, error) {
+	sqlStr := fmt.Sprintf("select * from notebook.`%s` order by 1", table)
+	log.Logger.WithField("sql", sqlStr).Debug()
+	rows, err := cursor.Query(sqlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return columns, err
+		}
+		if err := fn(values); err != nil {
+			return columns, err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return columns, err
+	}
+
+	return columns, nil
+}
+
+func selectTableRowsCount(cursor cursorObj, table string) (uint32, error) {
+	var cnt uint32
+
+	sqlStr := fmt.Sprintf("select count(*) from notebook.`%s`", table)
+	log.Logger.WithField("sql", sqlStr).Debug()
+	if err := cursor.QueryRow(sqlStr).Scan(&cnt); err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+func insertTableRow(cursor cursorObj, table string, columns []string, values []interface{}) (uint32, error) {
+	params := make([]string, len(columns))
+	for i := range params {
+		params[i] = "?"
+	}
+	sqlStr := fmt.Sprintf("insert into notebook.`%s` (`%s`) values (%s)",
+		table, strings.Join(columns, "`, `"), strings.Join(params, ", "))
+	result, err := cursor.Exec(sqlStr, values...)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// ------------------------------------------------------------------
+
+// insertAttachment ignores the attachment if one with the same content exists
+func insertAttachment(cursor cursorObj, attachmentIns *attachmentObj) (uint32, error) {
+	sqlStr := `insert ignore into notebook.attachment
+					(sha256, name, mime, size, width, height)
+					values
+					(?, ?, ?, ?, ?, ?)`
+	result, err := cursor.Exec(sqlStr, attachmentIns.SHA256, attachmentIns.Name, attachmentIns.MIME, attachmentIns.Size,
+		attachmentIns.Width, attachmentIns.Height)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func selectAttachment(cursor cursorObj, column string, value interface{}) (*attachmentObj, error) {
+	var attachmentIns attachmentObj
+	sqlStr := fmt.Sprintf(`select id, sha256, name, mime, size, width, height, created_at
+					from notebook.attachment
+					where %s = ?`, column)
+	err := cursor.QueryRow(sqlStr, value).Scan(&attachmentIns.ID, &attachmentIns.SHA256, &attachmentIns.Name,
+		&attachmentIns.MIME, &attachmentIns.Size, &attachmentIns.Width, &attachmentIns.Height, &attachmentIns.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &attachmentIns, nil
+}
+
+func selectAttachmentByID(cursor cursorObj, attachmentID uint32) (*attachmentObj, error) {
+	return selectAttachment(cursor, "id", attachmentID)
+}
+
+func selectAttachmentBySHA256(cursor cursorObj, sha256 string) (*attachmentObj, error) {
+	return selectAttachment(cursor, "sha256", sha256)
+}
+
+func selectAttachmentIDsBySHA256s(cursor cursorObj, closeRows bool, sha256s ...string) ([]uint32, error) {
+	ids := make([]uint32, 0)
+	if len(sha256s) <= 0 {
+		return ids, nil
+	}
+
+	var params []string
+	var args []interface{}
+	for _, sha256 := range sha256s {
+		params = append(params, "?")
+		args = append(args, sha256)
+	}
+	sqlStr := fmt.Sprintf("select id from notebook.attachment where sha256 in (%s) order by id", strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+	rows, err := cursor.Query(sqlStr, args...)
+	if err != nil {
+		return ids, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var id uint32
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return ids, err
+	}
+
+	return ids, nil
+}
+
+func selectAttachmentsBySHA256s(cursor cursorObj, closeRows bool, sha256s ...string) ([]attachmentObj, error) {
+	attachmentsIns := make([]attachmentObj, 0)
+	if len(sha256s) <= 0 {
+		return attachmentsIns, nil
+	}
+
+	var params []string
+	var args []interface{}
+	for _, sha256 := range sha256s {
+		params = append(params, "?")
+		args = append(args, sha256)
+	}
+	sqlStr := fmt.Sprintf(`select id, sha256, name, mime, size, width, height, created_at
+					from notebook.attachment
+					where sha256 in (%s)
+					order by id`, strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+	rows, err := cursor.Query(sqlStr, args...)
+	if err != nil {
+		return attachmentsIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var attachmentIns attachmentObj
+		if err := rows.Scan(&attachmentIns.ID, &attachmentIns.SHA256, &attachmentIns.Name, &attachmentIns.MIME,
+			&attachmentIns.Size, &attachmentIns.Width, &attachmentIns.Height, &attachmentIns.CreatedAt); err != nil {
+			return attachmentsIns, err
+		}
+		attachmentsIns = append(attachmentsIns, attachmentIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return attachmentsIns, err
+	}
+
+	return attachmentsIns, nil
+}
+
+func selectAttachmentSHA256s(cursor cursorObj, closeRows bool) ([]string, error) {
+	sha256s := make([]string, 0)
+
+	sqlStr := "select sha256 from notebook.attachment order by id"
+	rows, err := cursor.Query(sqlStr)
+	if err != nil {
+		return sha256s, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var sha256 string
+		if err := rows.Scan(&sha256); err != nil {
+			return sha256s, err
+		}
+		sha256s = append(sha256s, sha256)
+	}
+
+	if err := rows.Err(); err != nil {
+		return sha256s, err
+	}
+
+	return sha256s, nil
+}
+
+func insertNoteAttachments(cursor cursorObj, noteID uint32, attachmentIDs ...uint32) (uint32, error) {
+	if len(attachmentIDs) <= 0 {
+		return 0, nil
+	}
+
+	var params []string
+	var args []interface{}
+	for _, attachmentID := range attachmentIDs {
+		params = append(params, fmt.Sprintf("(%d, ?)", noteID))
+		args = append(args, attachmentID)
+	}
+	sqlStr := fmt.Sprintf("insert into notebook.note_attachment (note_id, attachment_id) values %s", strings.Join(params, ","))
+	log.Logger.WithField("sql", sqlStr).Debug()
+	result, err := cursor.Exec(sqlStr, args...)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+func deleteNoteAttachmentsByNoteID(cursor cursorObj, noteID uint32) (uint32, error) {
+	sqlStr := "delete from notebook.note_attachment where note_id = ?"
+	result, err := cursor.Exec(sqlStr, noteID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(rowsAffected), nil
+}
+
+// selectNotesByAttachmentID returns the notes referencing an attachment, private ones only if withPrivate is set
+func selectNotesByAttachmentID(cursor cursorObj, attachmentID uint32, withPrivate bool, closeRows bool) ([]noteLinkObj, error) {
+	notesIns := make([]noteLinkObj, 0)
+
+	sqlStr := `select note.id, note.title
+					from notebook.note_attachment note_attachment
+					inner join notebook.note note
+					on note_attachment.note_id = note.id
+					where note_attachment.attachment_id = ?`
+	if !withPrivate {
+		sqlStr += " and note.private = 0"
+	}
+	sqlStr += " order by note.id"
+	rows, err := cursor.Query(sqlStr, attachmentID)
+	if err != nil {
+		return notesIns, err
+	}
+	if closeRows {
+		defer rows.Close()
+	}
+
+	for rows.Next() {
+		var noteIns noteLinkObj
+		if err := rows.Scan(&noteIns.NoteID, &noteIns.Title); err != nil {
+			return notesIns, err
+		}
+		notesIns = append(notesIns, noteIns)
+	}
+
+	if err := rows.Err(); err != nil {
+		return notesIns, err
+	}
+
+	return notesIns, nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const tagSeparator = "/"
+
+var tagColorRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+var tagSlugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// ------------------------------------------------------------------
+
+// normalizeTagNames trims every level of nested tags like " lang / go/ " into "lang/go",
+// empty and duplicated names are dropped
+func normalizeTagNames(names []string) []string {
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		var parts []string
+		for _, part := range strings.Split(name, tagSeparator) {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		name = strings.Join(parts, tagSeparator)
+		if name != "" && !containsString(normalized, name) {
+			normalized = append(normalized, name)
+		}
+	}
+	return normalized
+}
+
+// withTagAncestors returns names together with all their ancestors, e.g. "lang/go" gives "lang/go" and "lang"
+func withTagAncestors(names []string) []string {
+	all := make([]string, 0, len(names))
+	for _, name := range names {
+		for {
+			if !containsString(all, name) {
+				all = append(all, name)
+			}
+			i := strings.LastIndex(name, tagSeparator)
+			if i < 0 {
+				break
+			}
+			name = name[:i]
+		}
+	}
+	return all
+}
+
+// filterTagsByName keeps the tags named in names. Names are compared as the case insensitive collation of the
+// tag table does, "go" given for an existing "Go" is that tag
+func filterTagsByName(tagsIns []tagObj, names []string) []tagObj {
+	filtered := make([]tagObj, 0, len(names))
+	for _, tagIns := range tagsIns {
+		for _, name := range names {
+			if strings.EqualFold(tagIns.Name, name) {
+				filtered = append(filtered, tagIns)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// missingTagAncestors returns the ancestors of tags missing in the tag table, i.e. tags created before
+// nesting was supported
+func missingTagAncestors(tagsIns []tagObj) []string {
+	names := tagNames(tagsIns)
+	missing := make([]string, 0)
+	for _, name := range withTagAncestors(names) {
+		if !containsString(names, name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// buildTagTree nests tags by their names. Tagged of a tag already includes its descendants, the one of ancestors
+// missing in the tag table is taken from ancestorsTagged, counted the same way
+func buildTagTree(tagsIns []tagObj, ancestorsTagged map[string]uint32) []*tagObj {
+	nodes := map[string]*tagObj{}
+	for i := range tagsIns {
+		nodes[tagsIns[i].Name] = &tagsIns[i]
+	}
+	for _, name := range missingTagAncestors(tagsIns) {
+		nodes[name] = &tagObj{Name: name, Tagged: ancestorsTagged[name]}
+	}
+
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	// parents are sorted before their children
+	sort.Strings(names)
+
+	roots := make([]*tagObj, 0)
+	for _, name := range names {
+		i := strings.LastIndex(name, tagSeparator)
+		if i < 0 {
+			roots = append(roots, nodes[name])
+			continue
+		}
+		parent := nodes[name[:i]]
+		parent.Children = append(parent.Children, nodes[name])
+	}
+
+	return roots
+}
+
+func tagNames(tagsIns []tagObj) []string {
+	names := make([]string, 0, len(tagsIns))
+	for _, tagIns := range tagsIns {
+		names = append(names, tagIns.Name)
+	}
+	return names
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTagTreeMissingAncestors(t *testing.T) {
+	db := openTestDB(t)
+	// "a" is missing in the tag table, note 1 is tagged with two of its children
+	mustExec(t, db, `insert into notebook.tag (id, name) values (1, 'a/b'), (2, 'a/c'), (3, 'd')`)
+	mustExec(t, db, `insert into notebook.note_tag (note_id, tag_id, tag_name)
+					values (1, 1, 'a/b'), (1, 2, 'a/c'), (2, 2, 'a/c'), (2, 3, 'd')`)
+
+	tagsIns, err := selectTagsWithNotesCount(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := missingTagAncestors(tagsIns); len(missing) != 1 || missing[0] != "a" {
+		t.Fatalf("missing ancestors %v", missing)
+	}
+	cnt, err := selectNotesCountInTagSubtree(db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := buildTagTree(tagsIns, map[string]uint32{"a": cnt})
+	want := map[string]uint32{"a": 2, "a/b": 1, "a/c": 2, "d": 1}
+	var walk func(nodes []*tagObj)
+	walk = func(nodes []*tagObj) {
+		for _, node := range nodes {
+			if node.Tagged != want[node.Name] {
+				t.Errorf("%s tagged %d, want %d", node.Name, node.Tagged, want[node.Name])
+			}
+			delete(want, node.Name)
+			walk(node.Children)
+		}
+	}
+	walk(roots)
+	if len(roots) != 2 || len(want) != 0 {
+		t.Errorf("%d roots, %v not in the tree", len(roots), want)
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `insert into notebook.tag (id, name)
+					values (1, 'code'), (2, 'code/go'), (3, 'lang'), (4, 'lang/go'), (5, 'lang/rust'), (6, 'lang/rust/async')`)
+	mustExec(t, db, `insert into notebook.note_tag (note_id, tag_id, tag_name)
+					values (1, 3, 'lang'), (2, 4, 'lang/go'), (3, 2, 'code/go'), (4, 6, 'lang/rust/async'), (5, 1, 'code')`)
+
+	for _, ids := range [][2]uint32{{3, 4}, {4, 3}, {1, 2}} {
+		if err := mergeTags(ids[0], ids[1]); err != paramsErr {
+			t.Errorf("merging %d into %d: got %v, want paramsErr", ids[1], ids[0], err)
+		}
+	}
+
+	if err := mergeTags(1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	tagsIns, err := selectTagsByID(db, true, false, 1, 2, 3, 4, 5, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[uint32]string{}
+	for _, tagIns := range tagsIns {
+		names[tagIns.ID] = tagIns.Name
+	}
+	if subtreeIns, err := selectTagsInSubtree(db, "code", true, false); err != nil || len(subtreeIns) != 4 {
+		t.Errorf("code subtree %v %v", subtreeIns, err)
+	}
+	if _, ok := names[3]; ok {
+		t.Error("lang is not deleted")
+	}
+	if _, ok := names[4]; ok {
+		t.Error("lang/go is not merged into code/go")
+	}
+	if names[5] != "code/rust" || names[6] != "code/rust/async" {
+		t.Errorf("descendants not moved: %v", names)
+	}
+
+	rows, err := db.Query("select note_id, tag_id, tag_name from notebook.note_tag order by note_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := map[uint32]string{1: "1 code", 2: "2 code/go", 3: "2 code/go", 4: "6 code/rust/async", 5: "1 code"}
+	for rows.Next() {
+		var noteID, tagID uint32
+		var tagName string
+		if err := rows.Scan(&noteID, &tagID, &tagName); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%d %s", tagID, tagName); got != want[noteID] {
+			t.Errorf("note %d tagged %s, want %s", noteID, got, want[noteID])
+		}
+	}
+}
+
+func TestNoteTagsCaseInsensitive(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"cache.enabled": false})
+	mustExec(t, db, `insert into notebook.tag (id, name) values (1, 'Go'), (2, 'Lang')`)
+
+	noteTags := func(noteID uint32) string {
+		var names string
+		err := db.QueryRow(`select group_concat(tag_name, ',')
+							from (select * from notebook.note_tag where note_id = ? order by tag_name)`, noteID).Scan(&names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+
+	// the existing tags are used, the note is not left without them
+	noteID, _, err := publishNote("Note", "<p>note</p>", false, "go", "lang/rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := noteTags(noteID); names != "Go,lang/rust" {
+		t.Errorf("tags after publishing %q", names)
+	}
+
+	if err := updateNote(noteID, "Note", "<p>note</p>", false, "GO"); err != nil {
+		t.Fatal(err)
+	}
+	if names := noteTags(noteID); names != "Go" {
+		t.Errorf("tags after updating %q", names)
+	}
+}
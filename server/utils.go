@@ -1,10 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
 	"github.com/speed18/d18-notebook/log"
+	"github.com/spf13/viper"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func min(n1 int, n2 int) int {
@@ -21,6 +32,169 @@ func max(n1 int, n2 int) int {
 	return n2
 }
 
+func containsUint32(nums []uint32, target uint32) bool {
+	for _, num := range nums {
+		if num == target {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDuplicatedUint32(nums []uint32) bool {
+	seen := map[uint32]bool{}
+	for _, num := range nums {
+		if seen[num] {
+			return true
+		}
+		seen[num] = true
+	}
+	return false
+}
+
+func reqToken(req *http.Request) string {
+	tokenCookie, err := req.Cookie(tokenName)
+	if err != nil {
+		return ""
+	}
+	return tokenCookie.Value
+}
+
+// queryUint32 returns defaultValue if the query parameter is absent
+func queryUint32(query url.Values, key string, defaultValue uint32) (uint32, error) {
+	value := query.Get(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	num, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, paramsErr
+	}
+	return uint32(num), nil
+}
+
+func encodeNotesCursor(cursorIns notesCursorObj) string {
+	data, _ := json.Marshal(cursorIns)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeNotesCursor rejects cursors made for another sort, the keyset would be meaningless
+func decodeNotesCursor(cursor string, sortKey string) (*notesCursorObj, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, paramsErr
+	}
+	var cursorIns notesCursorObj
+	if err := json.Unmarshal(data, &cursorIns); err != nil {
+		return nil, paramsErr
+	}
+	if cursorIns.Sort != sortKey || cursorIns.ID == 0 {
+		return nil, paramsErr
+	}
+	return &cursorIns, nil
+}
+
+// queryUint32s accepts both repeated and comma separated parameters, e.g. "tag=1&tag=2" and "tag=1,2"
+func queryUint32s(query url.Values, key string) ([]uint32, error) {
+	var nums []uint32
+	for _, value := range query[key] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			num, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, paramsErr
+			}
+			nums = append(nums, uint32(num))
+		}
+	}
+	return nums, nil
+}
+
+func pathUint32(req *http.Request, key string) (uint32, error) {
+	num, err := strconv.ParseUint(mux.Vars(req)[key], 10, 32)
+	if err != nil {
+		return 0, paramsErr
+	}
+	return uint32(num), nil
+}
+
+func dbLocation() *time.Location {
+	loc, err := time.LoadLocation(viper.GetString("mysql.loc"))
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// noteLocation is the time zone the notes are written in, which decides what "today" is
+func noteLocation() *time.Location {
+	name := viper.GetString("note.timezone")
+	if name == "" {
+		return dbLocation()
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Logger.WithField("timezone", name).WithField("err", err).Warn("load note timezone failed, use mysql one")
+		return dbLocation()
+	}
+	return loc
+}
+
+// parseDBTime parses timestamps scanned as strings, the zero time is returned if it fails
+func parseDBTime(value string) time.Time {
+	t, err := time.ParseInLocation(dbTimeLayout, value, dbLocation())
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func matchETag(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setCacheHeaders sets Cache-Control, ETag and Last-Modified, and reports whether the client's copy is still fresh.
+// Responses to authed users are only cached by the browser, and hidden private notes are not cached at all,
+// as they have to change once the user logs in
+func setCacheHeaders(resp http.ResponseWriter, req *http.Request, cacheIns cacheableObj, body []byte) bool {
+	header := resp.Header()
+	header.Set("Vary", "Cookie")
+
+	if isAuth(reqToken(req)) {
+		header.Set("Cache-Control", "private, no-cache")
+	} else if cacheIns.hasPrivateNote() {
+		header.Set("Cache-Control", "no-store")
+		return false
+	} else {
+		header.Set("Cache-Control", "public, no-cache")
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(body))
+	header.Set("ETag", etag)
+	lastModified := cacheIns.lastModified()
+	if !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	// If-Modified-Since is ignored if If-None-Match is present, see RFC 7232
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return matchETag(ifNoneMatch, etag)
+	}
+	if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
 func beforeReq(api apiFunc) apiFunc {
 	return func(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
 		log.Logger.WithField("url", req.URL).Info("incoming request")
@@ -59,6 +233,34 @@ func checkAuth(api apiFunc) apiFunc {
 	}
 }
 
+// withHTTPStatus answers the failures of the restful apis with an http status as well as the status in the body,
+// the POST only apis always answer 200
+func withHTTPStatus(api apiFunc) apiFunc {
+	return func(resp http.ResponseWriter, req *http.Request) (interface{}, int, error) {
+		data, status, err := api(resp, req)
+		if status == noError {
+			return data, status, err
+		}
+
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, noteNotExistsErr) || errors.Is(err, seriesNotExistsErr) || errors.Is(err, tagNotExistsErr) ||
+			errors.Is(err, attachmentNotExistsErr):
+			code = http.StatusNotFound
+		case status == paramsError || status == decodeError || status == shortcodeError || errors.Is(err, paramsErr):
+			code = http.StatusBadRequest
+		case status == notAuthError:
+			code = http.StatusUnauthorized
+		case status == attachmentTooLargeError:
+			code = http.StatusRequestEntityTooLarge
+		case status == attachmentTypeError:
+			code = http.StatusUnsupportedMediaType
+		}
+		resp.WriteHeader(code)
+		return data, status, err
+	}
+}
+
 func makeHandler(api apiFunc) func(resp http.ResponseWriter, req *http.Request) {
 	return func(resp http.ResponseWriter, req *http.Request) {
 		ret, status, err := api(resp, req)
@@ -70,7 +272,33 @@ func makeHandler(api apiFunc) func(resp http.ResponseWriter, req *http.Request)
 			return
 		}
 
+		if fileIns, ok := ret.(*fileObj); ok {
+			resp.Header().Set("Content-Type", fileIns.ContentType)
+			resp.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileIns.Name}))
+			// the headers are sent with the first bytes, so a failure can only cut the file short
+			if err := fileIns.Write(resp); err != nil {
+				log.Logger.WithField("file", fileIns.Name).WithField("err", err).Error("write file failed")
+			}
+			return
+		}
+
 		resp.Header().Set("content-type", "application-json")
+
+		if cacheIns, ok := ret.(cacheableObj); ok && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+			var buf bytes.Buffer
+			if err := json.NewEncoder(&buf).Encode(RespObj{Status: noError, Data: ret}); err != nil {
+				log.Logger.WithField("err", err).Error("encode api ret failed.")
+				_ = encoder.Encode(RespObj{Status: encodeError, Data: nil})
+				return
+			}
+			if notModified := setCacheHeaders(resp, req, cacheIns, buf.Bytes()); notModified {
+				resp.WriteHeader(http.StatusNotModified)
+				return
+			}
+			_, _ = resp.Write(buf.Bytes())
+			return
+		}
+
 		if err := encoder.Encode(RespObj{Status: noError, Data: ret}); err != nil {
 			log.Logger.WithField("err", err).Error("encode api ret failed.")
 			_ = encoder.Encode(RespObj{Status: encodeError, Data: nil})
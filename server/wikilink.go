@@ -0,0 +1,108 @@
+package server
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"github.com/spf13/viper"
+	"golang.org/x/net/html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// "[[Note Title]]" links to the oldest note with that title, "[[#42]]" links to note 42
+var wikiLinkRegexp = regexp.MustCompile(`\[\[([^\[\]]+)\]\]`)
+
+var wikiLinkIDRegexp = regexp.MustCompile(`^#(\d+)$`)
+
+// ------------------------------------------------------------------
+
+// walkWikiLinkText calls fn with every text node that may contain wiki links, code blocks and links are skipped
+func walkWikiLinkText(node *html.Node, fn func(node *html.Node)) {
+	walkTextNodes(node, []string{"code", "pre", "a"}, fn)
+}
+
+// extractWikiLinks returns the distinct link targets in content
+func extractWikiLinks(content string) ([]string, error) {
+	targets := make([]string, 0)
+	_, err := transformFragment(content, func(sel *goquery.Selection) {
+		for _, node := range sel.Nodes {
+			walkWikiLinkText(node, func(text *html.Node) {
+				for _, submatch := range wikiLinkRegexp.FindAllStringSubmatch(text.Data, -1) {
+					target := strings.TrimSpace(submatch[1])
+					if target != "" && len([]rune(target)) <= 255 && !containsString(targets, target) {
+						targets = append(targets, target)
+					}
+				}
+			})
+		}
+	})
+	return targets, err
+}
+
+// resolveWikiLink returns the id of the note the target refers to, or 0 if there is no such note yet
+func resolveWikiLink(cursor cursorObj, target string) (uint32, error) {
+	if submatch := wikiLinkIDRegexp.FindStringSubmatch(target); submatch != nil {
+		noteID, err := strconv.ParseUint(submatch[1], 10, 32)
+		if err != nil {
+			return 0, nil
+		}
+		noteInsPtr, err := selectNoteBriefByNoteID(cursor, uint32(noteID))
+		if err != nil || noteInsPtr == nil {
+			return 0, err
+		}
+		return noteInsPtr.ID, nil
+	}
+	return selectNoteIDByTitle(cursor, target)
+}
+
+func wikiLinkTransformer(ctx *transformCtxObj, content string) (string, error) {
+	if !wikiLinkRegexp.MatchString(content) {
+		return content, nil
+	}
+
+	linksIns, err := selectNoteLinksBySrcNoteID(ctx.Cursor, ctx.NoteID, true)
+	if err != nil {
+		return "", err
+	}
+	linksMap := map[string]noteLinkObj{}
+	for _, linkIns := range linksIns {
+		linksMap[linkIns.Target] = linkIns
+	}
+
+	return transformFragment(content, func(sel *goquery.Selection) {
+		for _, node := range sel.Nodes {
+			walkWikiLinkText(node, func(text *html.Node) {
+				if !wikiLinkRegexp.MatchString(text.Data) {
+					return
+				}
+				var sb strings.Builder
+				last := 0
+				for _, loc := range wikiLinkRegexp.FindAllStringSubmatchIndex(text.Data, -1) {
+					sb.WriteString(html.EscapeString(text.Data[last:loc[0]]))
+					last = loc[1]
+
+					target := strings.TrimSpace(text.Data[loc[2]:loc[3]])
+					linkIns, ok := linksMap[target]
+					if !ok || linkIns.NoteID == 0 {
+						sb.WriteString(`<span class="wiki-link missing">` + html.EscapeString(target) + `</span>`)
+						continue
+					}
+
+					label := target
+					if wikiLinkIDRegexp.MatchString(target) {
+						label = linkIns.Title
+					}
+					if linkIns.Private && !ctx.IsAuth {
+						label = viper.GetString("note.private_title")
+					}
+					sb.WriteString(`<a class="wiki-link" href="` + html.EscapeString(noteLink(linkIns.NoteID)) + `">` +
+						html.EscapeString(label) + `</a>`)
+				}
+				sb.WriteString(html.EscapeString(text.Data[last:]))
+
+				// the replaced text is html now
+				replaceTextNode(text, sb.String())
+			})
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package server
+
+import "testing"
+
+func TestResolvePendingNoteLinks(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text)
+					values (1, 'Source', 'me', '', ''), (5, 'Five', 'me', '', '')`)
+	mustExec(t, db, `insert into notebook.note_link (src_note_id, dst_note_id, target)
+					values (1, 0, '#2'), (1, 0, 'Two'), (1, 0, '#3'), (5, 0, '#5'), (5, 0, 'Five')`)
+
+	for noteID, title := range map[uint32]string{2: "Two", 5: "Five"} {
+		if _, err := resolvePendingNoteLinks(db, noteID, title); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	linksIns, err := selectNoteLinksBySrcNoteID(db, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint32{"#2": 2, "Two": 2, "#3": 0}
+	for _, linkIns := range linksIns {
+		if linkIns.NoteID != want[linkIns.Target] {
+			t.Errorf("%s points to %d, want %d", linkIns.Target, linkIns.NoteID, want[linkIns.Target])
+		}
+	}
+	// a note never links to itself
+	selfLinksIns, err := selectNoteLinksBySrcNoteID(db, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, linkIns := range selfLinksIns {
+		if linkIns.NoteID != 0 {
+			t.Errorf("self link resolved: %+v", linkIns)
+		}
+	}
+}
+
+func TestShortcodeNoteRefsAreLinks(t *testing.T) {
+	db := openTestDB(t)
+	setTestConfig(t, map[string]interface{}{"plugin.on_read": []string{"shortcode", "wiki_link"}})
+	mustExec(t, db, `insert into notebook.note (id, title, author, content, plain_text)
+					values (1, 'Source', 'me', '<p>{{< note 2 >}} [[#2]] <code>{{< note 3 >}}</code> {{< note 4 >}}</p>', ''),
+					(2, 'Two', 'me', '', '')`)
+
+	_, err := withTransaction(func(cursor cursorObj) (interface{}, error) {
+		return nil, saveNoteLinks(cursor, 1, "Source", "<p>{{< note 2 >}} [[#2]] <code>{{< note 3 >}}</code> {{< note 4 >}}</p>")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linksIns, err := selectNoteLinksBySrcNoteID(db, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint32{"#2": 2, "#4": 0}
+	if len(linksIns) != len(want) {
+		t.Errorf("links %+v, want %v", linksIns, want)
+	}
+	for _, linkIns := range linksIns {
+		if dst, ok := want[linkIns.Target]; !ok || linkIns.NoteID != dst {
+			t.Errorf("link %+v, want %v", linkIns, want)
+		}
+	}
+
+	// the note referencing note 2 is rendered with its title, so it depends on note 2
+	noteIDs, _, err := selectCacheDependencies(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsUint32(noteIDs, 1) {
+		t.Errorf("dependencies of note 2: %v", noteIDs)
+	}
+}
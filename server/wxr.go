@@ -0,0 +1,273 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/speed18/d18-notebook/log"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const wxrZeroTime = "0000-00-00 00:00:00"
+
+// gutenberg block delimiters such as "<!-- wp:paragraph -->"
+var wxrBlockCommentRegexp = regexp.MustCompile(`<!--\s*/?wp:[^>]*-->\n?`)
+
+var wxrParagraphBreakRegexp = regexp.MustCompile(`\n\s*\n`)
+
+var wxrBlockStartRegexp = regexp.MustCompile(`(?i)^<(address|article|aside|blockquote|div|dl|figure|h[1-6]|hr|ol|p|pre|section|table|ul)[\s>/]`)
+
+// block elements which may have blank lines inside, "p" is often left open and cannot hold blocks anyway
+var wxrBlockTagRegexp = regexp.MustCompile(`(?i)<(/?)(address|article|aside|blockquote|div|dl|figure|h[1-6]|ol|pre|section|table|ul)[\s>]`)
+
+// ------------------------------------------------------------------
+
+// elements of the "wp" namespace are matched by local name, since the namespace changes with the export version
+type wxrObj struct {
+	Channel struct {
+		Categories []wxrCategoryObj `xml:"category"`
+		Items      []wxrItemObj     `xml:"item"`
+	} `xml:"channel"`
+}
+
+// wxrCategoryObj is a category declared by the channel, with the nicename of its parent
+type wxrCategoryObj struct {
+	Nicename string `xml:"category_nicename"`
+	Parent   string `xml:"category_parent"`
+	Name     string `xml:"cat_name"`
+}
+
+type wxrItemObj struct {
+	Title           string               `xml:"title"`
+	Link            string               `xml:"link"`
+	GUID            string               `xml:"guid"`
+	Content         string               `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID          uint32               `xml:"post_id"`
+	PostName        string               `xml:"post_name"`
+	PostDate        string               `xml:"post_date"`
+	PostDateGMT     string               `xml:"post_date_gmt"`
+	PostModified    string               `xml:"post_modified"`
+	PostModifiedGMT string               `xml:"post_modified_gmt"`
+	Status          string               `xml:"status"`
+	PostType        string               `xml:"post_type"`
+	Categories      []wxrItemCategoryObj `xml:"category"`
+}
+
+type wxrItemCategoryObj struct {
+	Domain   string `xml:"domain,attr"`
+	Nicename string `xml:"nicename,attr"`
+	Name     string `xml:",chardata"`
+}
+
+// wxrMappingObj maps an old url to the imported note, for redirects
+type wxrMappingObj struct {
+	OldURL string `json:"old_url"`
+	Source string `json:"source"`
+	NoteID uint32 `json:"note_id"`
+	NewURL string `json:"new_url"`
+}
+
+// ------------------------------------------------------------------
+
+// wxrTime prefers the gmt time, drafts have a zero gmt time and only the local one
+func wxrTime(gmt string, local string) time.Time {
+	if gmt != "" && gmt != wxrZeroTime {
+		if t, err := time.ParseInLocation(dbTimeLayout, gmt, time.UTC); err == nil {
+			return t
+		}
+	}
+	if local != "" && local != wxrZeroTime {
+		if t, err := time.ParseInLocation(dbTimeLayout, local, noteLocation()); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// wxrCategoryPaths returns the tag name of every category nicename, nested categories become nested tags
+// such as "travel/japan"
+func wxrCategoryPaths(categoriesIns []wxrCategoryObj) map[string]string {
+	categoriesMap := map[string]wxrCategoryObj{}
+	for _, categoryIns := range categoriesIns {
+		categoriesMap[categoryIns.Nicename] = categoryIns
+	}
+
+	paths := map[string]string{}
+	for nicename := range categoriesMap {
+		var names []string
+		// parents are followed at most once each, in case the export has a cycle
+		visited := map[string]bool{}
+		for current, ok := categoriesMap[nicename]; ok && !visited[current.Nicename]; current, ok = categoriesMap[current.Parent] {
+			visited[current.Nicename] = true
+			names = append([]string{strings.Replace(current.Name, tagSeparator, " ", -1)}, names...)
+		}
+		paths[nicename] = strings.Join(names, tagSeparator)
+	}
+	return paths
+}
+
+// wxrSplitBlocks splits content at blank lines, except for those inside block elements such as "<pre>"
+func wxrSplitBlocks(content string) []string {
+	var blocks []string
+	start, last, depth := 0, 0, 0
+	for _, loc := range wxrParagraphBreakRegexp.FindAllStringIndex(content, -1) {
+		for _, submatch := range wxrBlockTagRegexp.FindAllStringSubmatch(content[last:loc[0]], -1) {
+			if submatch[1] == "" {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		last = loc[1]
+		if depth > 0 {
+			continue
+		}
+		blocks = append(blocks, content[start:loc[0]])
+		start, depth = loc[1], 0
+	}
+	return append(blocks, content[start:])
+}
+
+// wxrAutoParagraph wraps the text of classic editor posts in paragraphs, which wordpress does when rendering
+func wxrAutoParagraph(content string) string {
+	content = strings.TrimSpace(strings.Replace(content, "\r\n", "\n", -1))
+	if content == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, block := range wxrSplitBlocks(content) {
+		block = strings.TrimSpace(block)
+		// a leading comment such as "<!--more-->" stays out of the paragraph
+		if end := strings.Index(block, "-->"); strings.HasPrefix(block, "<!--") && end >= 0 {
+			sb.WriteString(block[:end+3] + "\n")
+			block = strings.TrimSpace(block[end+3:])
+		}
+		if block == "" {
+			continue
+		}
+		if wxrBlockStartRegexp.MatchString(block) {
+			sb.WriteString(block + "\n")
+			continue
+		}
+		sb.WriteString("<p>" + strings.Replace(block, "\n", "<br>\n", -1) + "</p>\n")
+	}
+	return sb.String()
+}
+
+// parseWXRNote maps a post or page onto a note, nil is returned with the reason for other items
+func parseWXRNote(itemIns wxrItemObj, categoryPaths map[string]string) (*importNoteObj, string) {
+	if itemIns.PostType != "post" && itemIns.PostType != "page" {
+		return nil, "post type " + itemIns.PostType
+	}
+
+	noteInsPtr := &importNoteObj{Source: fmt.Sprintf("wp:%d", itemIns.PostID), Title: strings.TrimSpace(itemIns.Title),
+		Tags: make([]string, 0), CreatedAt: wxrTime(itemIns.PostDateGMT, itemIns.PostDate),
+		UpdateAt: wxrTime(itemIns.PostModifiedGMT, itemIns.PostModified)}
+	// posts may have no title in wordpress
+	if noteInsPtr.Title == "" {
+		noteInsPtr.Title = strings.Replace(itemIns.PostName, "-", " ", -1)
+	}
+	if noteInsPtr.Title == "" {
+		noteInsPtr.Title = noteInsPtr.Source
+	}
+
+	switch itemIns.Status {
+	case "publish":
+	case "private", "draft", "pending", "future":
+		noteInsPtr.Private = true
+	default:
+		return nil, "status " + itemIns.Status
+	}
+
+	// categories and tags are both tags of the note
+	for _, categoryIns := range itemIns.Categories {
+		name := strings.TrimSpace(categoryIns.Name)
+		if categoryIns.Domain == "category" {
+			if path, ok := categoryPaths[categoryIns.Nicename]; ok && path != "" {
+				name = path
+			}
+		} else if categoryIns.Domain != "post_tag" {
+			continue
+		}
+		// "Uncategorized" is the default category of wordpress, not one chosen for the post
+		if categoryIns.Domain == "category" && categoryIns.Nicename == "uncategorized" {
+			continue
+		}
+		noteInsPtr.Tags = append(noteInsPtr.Tags, name)
+	}
+
+	for _, link := range []string{itemIns.Link, itemIns.GUID} {
+		if link = strings.TrimSpace(link); link != "" && !containsString(noteInsPtr.Links, link) {
+			noteInsPtr.Links = append(noteInsPtr.Links, link)
+		}
+	}
+
+	noteInsPtr.Content = wxrAutoParagraph(wxrBlockCommentRegexp.ReplaceAllString(itemIns.Content, ""))
+	return noteInsPtr, ""
+}
+
+// ImportWXR imports the posts and pages of a wordpress export file. Unless dryRun is set, the old urls of the
+// imported notes are written to mappingPath as json, for setting up redirects
+func ImportWXR(path string, mappingPath string, dryRun bool) ([]importResultObj, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var wxrIns wxrObj
+	if err := xml.Unmarshal(data, &wxrIns); err != nil {
+		return nil, err
+	}
+
+	categoryPaths := wxrCategoryPaths(wxrIns.Channel.Categories)
+	notesInsPtr := make([]*importNoteObj, 0)
+	skipped := make([]importResultObj, 0)
+	for _, itemIns := range wxrIns.Channel.Items {
+		noteInsPtr, reason := parseWXRNote(itemIns, categoryPaths)
+		if noteInsPtr == nil {
+			skipped = append(skipped, importResultObj{Source: fmt.Sprintf("wp:%d", itemIns.PostID), Title: itemIns.Title,
+				Skipped: reason})
+			continue
+		}
+		notesInsPtr = append(notesInsPtr, noteInsPtr)
+	}
+
+	results, err := importNotes(notesInsPtr, dryRun)
+	// the mapping of the notes imported before a failure is still written, so that they can be found
+	if !dryRun && mappingPath != "" {
+		if mappingErr := writeWXRMapping(mappingPath, notesInsPtr, results); mappingErr != nil && err == nil {
+			err = mappingErr
+		}
+	}
+	results = append(results, skipped...)
+	if err != nil {
+		return results, err
+	}
+
+	log.Logger.WithField("file", path).WithField("notes", len(notesInsPtr)).WithField("dry_run", dryRun).
+		Info("done importing wxr")
+	return results, nil
+}
+
+func writeWXRMapping(mappingPath string, notesInsPtr []*importNoteObj, results []importResultObj) error {
+	mappingsIns := make([]wxrMappingObj, 0)
+	for i, resultIns := range results {
+		if resultIns.NoteID == 0 {
+			continue
+		}
+		for _, link := range notesInsPtr[i].Links {
+			mappingsIns = append(mappingsIns, wxrMappingObj{OldURL: link, Source: resultIns.Source, NoteID: resultIns.NoteID,
+				NewURL: absoluteURL(noteLink(resultIns.NoteID))})
+		}
+	}
+
+	data, err := json.MarshalIndent(mappingsIns, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mappingPath, data, os.FileMode(0644))
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestWXRAutoParagraph(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"paragraphs", "one\nline\n\ntwo", "<p>one<br>\nline</p>\n<p>two</p>\n"},
+		{"more comment", "<!--more-->\nintro\n\nbody", "<!--more-->\n<p>intro</p>\n<p>body</p>\n"},
+		{"pre with blank lines", "before\n\n<pre>a\n\nb\n</pre>\n\nafter",
+			"<p>before</p>\n<pre>a\n\nb\n</pre>\n<p>after</p>\n"},
+		{"nested lists", "<ul>\n<li>a\n\n<ol><li>b</li></ol>\n\n</li>\n</ul>\n\nafter",
+			"<ul>\n<li>a\n\n<ol><li>b</li></ol>\n\n</li>\n</ul>\n<p>after</p>\n"},
+		{"stray close tag", "</div>\n\ntext", "<p></div></p>\n<p>text</p>\n"},
+		{"unclosed paragraph", "<p>one\n\ntwo", "<p>one\n<p>two</p>\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := wxrAutoParagraph(c.content); got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}